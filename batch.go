@@ -0,0 +1,97 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// getBatchSize is the number of keys GetBatch hashes and prefetches before
+// performing the lookups for those keys.
+const getBatchSize = 16
+
+// GetBatch retrieves the values for the specified keys, storing the value for
+// keys[i] in values[i] and whether the key was present in found[i]. If
+// values is shorter than keys a new slice is allocated, and the same for
+// found, so either may be nil. The values and found slices are returned.
+//
+// GetBatch software pipelines the lookups: the keys are processed in small
+// batches, first computing the hash of every key in the batch and loading the
+// control bytes of the first group in each key's probe sequence, and then
+// performing the lookups. The loads of the control bytes are independent of
+// one another which allows the CPU to overlap the resulting cache misses,
+// rather than incurring them one at a time as a sequence of calls to Get
+// would. Go does not provide a prefetch intrinsic, so plain loads are used.
+func (m *Map[K, V]) GetBatch(keys []K, values []V, found []bool) ([]V, []bool) {
+	if len(values) < len(keys) {
+		values = make([]V, len(keys))
+	}
+	if len(found) < len(keys) {
+		found = make([]bool, len(keys))
+	}
+	values = values[:len(keys)]
+	found = found[:len(keys)]
+	if m.hash == nil {
+		// A zero value Map is empty.
+		clear(values)
+		clear(found)
+		return values, found
+	}
+
+	var hashes [getBatchSize]uintptr
+	// sink accumulates the prefetched control bytes so that the compiler
+	// cannot eliminate the loads.
+	var sink uint64
+	for start := 0; start < len(keys); start += getBatchSize {
+		batch := keys[start:min(start+getBatchSize, len(keys))]
+
+		for i := range batch {
+			h := m.hash(noescape(unsafe.Pointer(&batch[i])), m.seed)
+			hashes[i] = h
+			b := m.bucket(h)
+			sink += uint64(b.ctrls.Get(h1(h) & b.capacity))
+		}
+
+		for i := range batch {
+			b, j, ok := m.find(hashes[i], batch[i])
+			if ok {
+				values[start+i] = b.slots.At(j).value
+			} else {
+				var zero V
+				values[start+i] = zero
+			}
+			found[start+i] = ok
+		}
+	}
+	runtime.KeepAlive(sink)
+	return values, found
+}
+
+// PutBatch inserts the entries keys[i]:values[i] into the map, overwriting
+// existing values for keys which are already present. If a key appears more
+// than once in keys, the last value wins. The map is grown to hold
+// len(keys) additional entries before inserting which avoids repeatedly
+// resizing and splitting buckets as the entries are inserted. PutBatch panics
+// if len(keys) != len(values).
+func (m *Map[K, V]) PutBatch(keys []K, values []V) {
+	if len(keys) != len(values) {
+		panic("swiss: PutBatch: len(keys) != len(values)")
+	}
+	m.Grow(len(keys))
+	for i := range keys {
+		m.Put(keys[i], values[i])
+	}
+}
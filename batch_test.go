@@ -0,0 +1,96 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetBatch(t *testing.T) {
+	m := New[int, int](0)
+	values, found := m.GetBatch(nil, nil, nil)
+	require.Empty(t, values)
+	require.Empty(t, found)
+
+	const count = 1000
+	for i := 0; i < count; i += 2 {
+		m.Put(i, -i)
+	}
+
+	for _, n := range []int{1, getBatchSize - 1, getBatchSize, getBatchSize + 1, count} {
+		keys := make([]int, n)
+		for i := range keys {
+			keys[i] = (i * 7) % count
+		}
+
+		check := func(values []int, found []bool) {
+			require.Len(t, values, n)
+			require.Len(t, found, n)
+			for i, k := range keys {
+				v, ok := m.Get(k)
+				require.Equal(t, ok, found[i])
+				require.Equal(t, v, values[i])
+			}
+		}
+
+		// Nil output slices are allocated.
+		check(m.GetBatch(keys, nil, nil))
+
+		// Preallocated output slices are reused and stale values are
+		// overwritten.
+		values := make([]int, n+1)
+		found := make([]bool, n+1)
+		for i := range values {
+			values[i] = 1
+			found[i] = true
+		}
+		v, f := m.GetBatch(keys, values, found)
+		check(v, f)
+		require.Same(t, &values[0], &v[0])
+		require.Same(t, &found[0], &f[0])
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a))
+	m.PutBatch(nil, nil)
+	require.EqualValues(t, 0, m.Len())
+
+	const count = 800
+	keys := make([]int, count)
+	values := make([]int, count)
+	for i := range keys {
+		keys[i] = i
+		values[i] = -i
+	}
+	m.PutBatch(keys, values)
+	require.EqualValues(t, count, m.Len())
+	// The map is sized once up front.
+	require.EqualValues(t, 1, a.alloc)
+
+	// The last value for a duplicate key wins.
+	m.PutBatch([]int{1, 2, 1, count}, []int{10, 20, 11, 30})
+	e := make(map[int]int)
+	for i := range keys {
+		e[i] = -i
+	}
+	e[1], e[2], e[count] = 11, 20, 30
+	require.Equal(t, e, m.toBuiltinMap())
+
+	require.Panics(t, func() { m.PutBatch([]int{1}, nil) })
+}
@@ -3,7 +3,11 @@ package swiss
 import (
 	"fmt"
 	"io"
+	"math/bits"
+	"math/rand"
+	"runtime"
 	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"github.com/aclements/go-perfevent/perfbench"
@@ -406,3 +410,197 @@ func benchmarkSwissMapPutDelete[T benchTypes](
 		m.Put(keys[j], keys[j])
 	}
 }
+
+func BenchmarkConcurrentPut(b *testing.B) {
+	b.Run("impl=syncMap", func(b *testing.B) {
+		s := NewSyncMap[int64, int64](0)
+		benchmarkConcurrentPut(b, s.Put)
+	})
+	b.Run("impl=shardedMap", func(b *testing.B) {
+		s := NewShardedMap[int64, int64](0)
+		benchmarkConcurrentPut(b, s.Put)
+	})
+}
+
+func benchmarkConcurrentPut(b *testing.B, put func(key, value int64)) {
+	const n = 1 << 16
+	keys := genKeys[int64](0, n)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := rand.Intn(n)
+		for pb.Next() {
+			put(keys[i&(n-1)], 1)
+			i++
+		}
+	})
+}
+
+// BenchmarkTablePadding measures concurrent insertions and deletions into small
+// maps owned by different goroutines. Without padding the tables of the maps
+// are allocated in adjacent memory and the writes suffer from false sharing.
+func BenchmarkTablePadding(b *testing.B) {
+	b.Run("impl=default", func(b *testing.B) {
+		benchmarkTablePadding(b)
+	})
+	b.Run("impl=padded", func(b *testing.B) {
+		benchmarkTablePadding(b, WithTablePadding[int64, int64]())
+	})
+}
+
+func benchmarkTablePadding(b *testing.B, options ...option[int64, int64]) {
+	// Each of the GOMAXPROCS goroutines started by RunParallel uses its own
+	// map, allocated one after another.
+	maps := make([]*Map[int64, int64], runtime.GOMAXPROCS(0))
+	for i := range maps {
+		maps[i] = New[int64, int64](4, options...)
+	}
+	var next atomic.Int32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		m := maps[int(next.Add(1)-1)%len(maps)]
+		var i int64
+		for pb.Next() {
+			m.Put(i&3, i)
+			m.Delete((i + 2) & 3)
+			i++
+		}
+	})
+}
+
+func BenchmarkGetBatch(b *testing.B) {
+	const n = 1 << 20
+	m := New[int64, int64](n)
+	keys := genKeys[int64](0, n)
+	for _, k := range keys {
+		m.Put(k, k)
+	}
+	rand.Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+
+	const batchSize = 1024
+	b.Run("impl=get", func(b *testing.B) {
+		for i := 0; i < b.N; i += batchSize {
+			batch := keys[i%n:][:batchSize]
+			for _, k := range batch {
+				m.Get(k)
+			}
+		}
+	})
+	b.Run("impl=getBatch", func(b *testing.B) {
+		values := make([]int64, batchSize)
+		found := make([]bool, batchSize)
+		for i := 0; i < b.N; i += batchSize {
+			m.GetBatch(keys[i%n:][:batchSize], values, found)
+		}
+	})
+}
+
+func BenchmarkPutBatch(b *testing.B) {
+	const n = 1 << 20
+	keys := genKeys[int64](0, n)
+	b.Run("impl=put", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := New[int64, int64](0)
+			for _, k := range keys {
+				m.Put(k, k)
+			}
+		}
+	})
+	b.Run("impl=putBatch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := New[int64, int64](0)
+			m.PutBatch(keys, keys)
+		}
+	})
+}
+
+func BenchmarkPutLargeValue(b *testing.B) {
+	type value [64]int64
+	const n = 1024
+	keys := genKeys[int64](0, n)
+	var v value
+
+	b.Run("impl=put", func(b *testing.B) {
+		m := New[int64, value](n)
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				v[0] = k
+				m.Put(k, v)
+			}
+			m.Clear()
+		}
+	})
+	b.Run("impl=putGrow", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := New[int64, value](0)
+			for _, k := range keys {
+				v[0] = k
+				m.Put(k, v)
+			}
+		}
+	})
+	b.Run("impl=putPtr", func(b *testing.B) {
+		m := New[int64, value](n)
+		for i := 0; i < b.N; i++ {
+			for _, k := range keys {
+				v[0] = k
+				m.PutPtr(k, &v)
+			}
+			m.Clear()
+		}
+	})
+	b.Run("impl=putPtrGrow", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			m := New[int64, value](0)
+			for _, k := range keys {
+				v[0] = k
+				m.PutPtr(k, &v)
+			}
+		}
+	})
+}
+
+// BenchmarkBulkLoad loads a map far larger than the last level cache. It
+// compares the load with the same number of slot-sized stores made at the
+// slots' hash-determined positions (impl=scatter) and made sequentially
+// (impl=sequential). The stores of a load follow the scattered pattern, for
+// which non-temporal stores do not help, and bound how much of the cost of a
+// load any change to the stores could save.
+func BenchmarkBulkLoad(b *testing.B) {
+	const n = 1 << 22
+	keys := genKeys[int64](0, n)
+
+	b.Run("impl=putBatch", func(b *testing.B) {
+		perfbench.Open(b)
+		for i := 0; i < b.N; i++ {
+			m := New[int64, int64](0)
+			m.PutBatch(keys, keys)
+		}
+	})
+
+	// The number of slots of the loaded map.
+	slots := 1 << bits.Len(uint(n+n/7))
+	positions := make([]int, n)
+	for i, k := range keys {
+		positions[i] = int(mix64(uint64(k)) & uint64(slots-1))
+	}
+	b.Run("impl=scatter", func(b *testing.B) {
+		perfbench.Open(b)
+		for i := 0; i < b.N; i++ {
+			s := make([]Slot[int64, int64], slots)
+			for j, k := range keys {
+				s[positions[j]] = Slot[int64, int64]{key: k, value: k}
+			}
+		}
+	})
+	b.Run("impl=sequential", func(b *testing.B) {
+		perfbench.Open(b)
+		for i := 0; i < b.N; i++ {
+			s := make([]Slot[int64, int64], slots)
+			for j, k := range keys {
+				s[j] = Slot[int64, int64]{key: k, value: k}
+			}
+		}
+	})
+}
@@ -0,0 +1,136 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "fmt"
+
+// boundedMapSamples is the number of entries sampled by a BoundedMap when
+// selecting an entry to evict.
+const boundedMapSamples = 5
+
+// BoundedMap is a Map which holds at most a fixed number of entries, making
+// it usable as a fixed-budget cache. Inserting a new key into a full
+// BoundedMap evicts an existing entry using a sampled LRU policy: a small
+// number of entries are sampled at random and the least recently used of the
+// samples is evicted. This approximates LRU eviction without the bookkeeping
+// of a recency list, at the cost of an additional timestamp per entry.
+//
+// A BoundedMap is not safe for concurrent use. Note that Get updates the
+// recency of the entry and is therefore a mutation.
+type BoundedMap[K comparable, V any] struct {
+	m          Map[K, boundedEntry[V]]
+	maxEntries int
+	clock      uint64
+	onEvict    func(key K, value V)
+}
+
+// boundedEntry is the value stored in the underlying Map of a BoundedMap.
+type boundedEntry[V any] struct {
+	value V
+	// used is the value of the BoundedMap's clock when the entry was last
+	// inserted or retrieved.
+	used uint64
+}
+
+// NewBoundedMap constructs a new BoundedMap which holds at most maxEntries
+// entries. If onEvict is non-nil it is called with the key and value of each
+// evicted entry after the entry has been removed from the map, allowing the
+// caller to clean up the value. Entries removed by Delete are not passed to
+// onEvict. NewBoundedMap panics if maxEntries <= 0.
+func NewBoundedMap[K comparable, V any](
+	maxEntries int, onEvict func(key K, value V),
+) *BoundedMap[K, V] {
+	if maxEntries <= 0 {
+		panic(fmt.Sprintf("swiss: NewBoundedMap: invalid max entries %d", maxEntries))
+	}
+	b := &BoundedMap[K, V]{
+		maxEntries: maxEntries,
+		onEvict:    onEvict,
+	}
+	b.m.Init(maxEntries)
+	return b
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present. Retrieving an entry marks it as the
+// most recently used.
+func (b *BoundedMap[K, V]) Get(key K) (value V, ok bool) {
+	e := b.m.GetPtr(key)
+	if e == nil {
+		return value, false
+	}
+	b.clock++
+	e.used = b.clock
+	return e.value, true
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists, and marks the entry as the most
+// recently used. If the key is not present and the map is full an existing
+// entry is evicted first.
+func (b *BoundedMap[K, V]) Put(key K, value V) {
+	b.clock++
+	if e := b.m.GetPtr(key); e != nil {
+		e.value = value
+		e.used = b.clock
+		return
+	}
+	if b.m.Len() >= b.maxEntries {
+		b.evict()
+	}
+	b.m.Put(key, boundedEntry[V]{value: value, used: b.clock})
+}
+
+// evict removes the least recently used of boundedMapSamples randomly
+// sampled entries from the map and passes it to the eviction callback.
+func (b *BoundedMap[K, V]) evict() {
+	victim := b.m.randomSlot()
+	for i := 1; i < boundedMapSamples; i++ {
+		if s := b.m.randomSlot(); s.value.used < victim.value.used {
+			victim = s
+		}
+	}
+	key, value := victim.key, victim.value.value
+	b.m.Delete(key)
+	if b.onEvict != nil {
+		b.onEvict(key, value)
+	}
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (b *BoundedMap[K, V]) Delete(key K) {
+	b.m.Delete(key)
+}
+
+// Len returns the number of entries in the map.
+func (b *BoundedMap[K, V]) Len() int {
+	return b.m.Len()
+}
+
+// MaxEntries returns the maximum number of entries the map holds.
+func (b *BoundedMap[K, V]) MaxEntries() int {
+	return b.maxEntries
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, range stops the iteration. All does not affect the
+// recency of the entries. See Map.All for the semantics of mutating the map
+// during iteration.
+func (b *BoundedMap[K, V]) All(yield func(key K, value V) bool) {
+	b.m.All(func(key K, e boundedEntry[V]) bool {
+		return yield(key, e.value)
+	})
+}
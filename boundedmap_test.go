@@ -0,0 +1,83 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoundedMap(t *testing.T) {
+	const maxEntries = 1000
+	const count = 20000
+	const hot = 5
+
+	evicted := make(map[int]int)
+	var b *BoundedMap[int, int]
+	b = NewBoundedMap[int, int](maxEntries, func(k, v int) {
+		require.EqualValues(t, k, v)
+		evicted[k]++
+		// The evicted entry has been removed from the map.
+		_, ok := b.Get(k)
+		require.False(t, ok)
+	})
+	require.EqualValues(t, maxEntries, b.MaxEntries())
+
+	for i := 0; i < count; i++ {
+		// Keep the hot keys recently used. They are only evicted if every
+		// sampled entry is hot which is vanishingly unlikely.
+		for k := 0; k < min(i, hot); k++ {
+			v, ok := b.Get(k)
+			require.True(t, ok)
+			require.EqualValues(t, k, v)
+		}
+		b.Put(i, i)
+		require.LessOrEqual(t, b.Len(), maxEntries)
+	}
+	require.EqualValues(t, maxEntries, b.Len())
+	require.Len(t, evicted, count-maxEntries)
+
+	// Every key is either present or was evicted exactly once.
+	for k := 0; k < count; k++ {
+		_, ok := b.Get(k)
+		if ok {
+			require.Zero(t, evicted[k], "%d", k)
+		} else {
+			require.EqualValues(t, 1, evicted[k], "%d", k)
+		}
+	}
+	for k := 0; k < hot; k++ {
+		require.Zero(t, evicted[k], "%d", k)
+	}
+
+	// Overwriting an existing key does not evict.
+	n := len(evicted)
+	b.All(func(k, v int) bool {
+		b.Put(k, v)
+		return true
+	})
+	require.Len(t, evicted, n)
+
+	// Deleted entries are not passed to the eviction callback.
+	b.All(func(k, _ int) bool {
+		b.Delete(k)
+		return true
+	})
+	require.EqualValues(t, 0, b.Len())
+	require.Len(t, evicted, n)
+
+	require.Panics(t, func() { NewBoundedMap[int, int](0, nil) })
+}
@@ -0,0 +1,555 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+)
+
+// jsonEntry is the JSON encoding of an entry in a map whose keys are not
+// strings.
+type jsonEntry[K comparable, V any] struct {
+	Key   K `json:"key"`
+	Value V `json:"value"`
+}
+
+// jsonStringKeys returns true if K is encoded as a JSON object key, i.e. if
+// the kind of K is string.
+func jsonStringKeys[K comparable]() bool {
+	return reflect.TypeOf((*K)(nil)).Elem().Kind() == reflect.String
+}
+
+// MarshalJSON implements the json.Marshaler interface. A map whose keys are
+// strings is encoded as a JSON object with the keys in sorted order, the same
+// as a builtin map. A map with any other key type is encoded as a JSON array
+// of {"key":...,"value":...} objects in iteration order. A nil map is encoded
+// as null, while an empty map is encoded as {} or [] respectively.
+func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
+	if m == nil {
+		return []byte("null"), nil
+	}
+
+	if !jsonStringKeys[K]() {
+		entries := make([]jsonEntry[K, V], 0, m.used)
+		m.All(func(key K, value V) bool {
+			entries = append(entries, jsonEntry[K, V]{key, value})
+			return true
+		})
+		return json.Marshal(entries)
+	}
+
+	type entry struct {
+		key   string
+		value V
+	}
+	entries := make([]entry, 0, m.used)
+	m.All(func(key K, value V) bool {
+		entries = append(entries, entry{reflect.ValueOf(key).String(), value})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range entries {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(entries[i].key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(entries[i].value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, accepting the
+// encoding produced by MarshalJSON. The decoded entries are added to the map
+// using Put, overwriting existing entries with the same key, which mirrors
+// the behavior of decoding into a non-nil builtin map. The map is grown to
+// hold the decoded entries before they are added. If the map has not been
+// initialized it is initialized with the default options. Decoding null is a
+// no-op.
+func (m *Map[K, V]) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(bytes.TrimSpace(data), []byte("null")) {
+		return nil
+	}
+	m.lazyInit()
+
+	if !jsonStringKeys[K]() {
+		var entries []jsonEntry[K, V]
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return err
+		}
+		m.Grow(len(entries))
+		for i := range entries {
+			m.Put(entries[i].Key, entries[i].Value)
+		}
+		return nil
+	}
+
+	var entries map[string]V
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	m.Grow(len(entries))
+	for k, v := range entries {
+		var key K
+		reflect.ValueOf(&key).Elem().SetString(k)
+		m.Put(key, v)
+	}
+	return nil
+}
+
+// GobEncode implements the gob.GobEncoder interface. The live entries are
+// encoded as a slice of keys followed by a slice of the corresponding values.
+// Map options such as the hash function and allocator are not encoded.
+func (m *Map[K, V]) GobEncode() ([]byte, error) {
+	keys := make([]K, 0, m.used)
+	values := make([]V, 0, m.used)
+	m.All(func(key K, value V) bool {
+		keys = append(keys, key)
+		values = append(values, value)
+		return true
+	})
+
+	var buf bytes.Buffer
+	enc := gob.NewEncoder(&buf)
+	if err := enc.Encode(keys); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(values); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// GobDecode implements the gob.GobDecoder interface, accepting the encoding
+// produced by GobEncode. The decoded entries are added to the map using Put
+// after growing the map to hold them. Because map options cannot be encoded,
+// a map which has not been initialized is initialized with the default
+// options. To decode into a map with a custom hash function or allocator,
+// initialize the map with those options before decoding.
+func (m *Map[K, V]) GobDecode(data []byte) error {
+	var keys []K
+	var values []V
+	dec := gob.NewDecoder(bytes.NewReader(data))
+	if err := dec.Decode(&keys); err != nil {
+		return err
+	}
+	if err := dec.Decode(&values); err != nil {
+		return err
+	}
+	if len(keys) != len(values) {
+		return fmt.Errorf("swiss: gob: mismatched key and value counts: %d != %d",
+			len(keys), len(values))
+	}
+
+	m.lazyInit()
+	m.Grow(len(keys))
+	for i := range keys {
+		m.Put(keys[i], values[i])
+	}
+	return nil
+}
+
+const (
+	// binaryMagic identifies the binary encoding of a Map.
+	binaryMagic = "SWSM"
+	// binaryFuncMagic identifies the encoding produced by WriteToFunc, in
+	// which each entry is a single field encoded by the caller.
+	binaryFuncMagic = "SWSF"
+	// binaryVersion is the version of the binary encoding.
+	binaryVersion = 1
+	// binaryHeaderLen is the length of the fixed-size portion of the header.
+	binaryHeaderLen = len(binaryMagic) + 1
+	// binaryWriteBatchSize is the size of the batches written by WriteTo.
+	binaryWriteBatchSize = 32 << 10
+	// binaryReadMaxGrow is the maximum number of entries ReadFrom will grow
+	// the map by based on the untrusted count in the header.
+	binaryReadMaxGrow = 1 << 20
+)
+
+var (
+	errNoCodec           = errors.New("swiss: no codec configured (see WithCodec)")
+	errBinaryTruncated   = errors.New("swiss: binary encoding is truncated")
+	errBinaryFieldLength = errors.New("swiss: binary encoding has invalid field length")
+)
+
+// MarshalBinary implements the encoding.BinaryMarshaler interface using the
+// Codec specified by WithCodec. The encoding consists of a header containing
+// a magic number, a version, and the number of entries as a uvarint, followed
+// by each entry in iteration order. An entry is encoded as the uvarint length
+// of the encoded key, the encoded key, the uvarint length of the encoded
+// value, and the encoded value.
+func (m *Map[K, V]) MarshalBinary() ([]byte, error) {
+	if m.codec == nil {
+		return nil, errNoCodec
+	}
+
+	buf := m.appendBinaryHeader(nil, binaryMagic)
+	var scratch []byte
+	var err error
+	m.All(func(key K, value V) bool {
+		buf, scratch, err = m.appendBinaryEntry(buf, scratch, key, value)
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// WriteTo implements the io.WriterTo interface, streaming the encoding
+// produced by MarshalBinary to w. The entries are written in batches so that
+// the memory used is bounded regardless of the size of the map.
+func (m *Map[K, V]) WriteTo(w io.Writer) (n int64, err error) {
+	if m.codec == nil {
+		return 0, errNoCodec
+	}
+	return m.writeBinary(w, binaryMagic, m.appendBinaryEntry)
+}
+
+// WriteToFunc is like WriteTo, but encodes each entry using enc rather than
+// the map's Codec. The encoding has the same header as the encoding produced
+// by MarshalBinary, with a different magic number, followed by each entry as
+// the uvarint length of the data returned by enc and the data. The encoding is
+// decoded by ReadFromFunc.
+func (m *Map[K, V]) WriteToFunc(
+	w io.Writer, enc func(key K, value V) ([]byte, error),
+) (n int64, err error) {
+	return m.writeBinary(w, binaryFuncMagic, func(
+		buf, scratch []byte, key K, value V,
+	) ([]byte, []byte, error) {
+		data, err := enc(key, value)
+		if err != nil {
+			return buf, scratch, err
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(data)))
+		return append(buf, data...), scratch, nil
+	})
+}
+
+// writeBinary streams a binary encoding of the map with the specified magic
+// number to w, appending each entry to the batch being written using
+// appendEntry.
+func (m *Map[K, V]) writeBinary(
+	w io.Writer,
+	magic string,
+	appendEntry func(buf, scratch []byte, key K, value V) (_, _ []byte, err error),
+) (n int64, err error) {
+	buf := m.appendBinaryHeader(make([]byte, 0, binaryWriteBatchSize), magic)
+	flush := func() error {
+		k, err := w.Write(buf)
+		n += int64(k)
+		buf = buf[:0]
+		return err
+	}
+
+	var scratch []byte
+	m.All(func(key K, value V) bool {
+		buf, scratch, err = appendEntry(buf, scratch, key, value)
+		if err == nil && len(buf) >= binaryWriteBatchSize {
+			err = flush()
+		}
+		return err == nil
+	})
+	if err != nil {
+		return n, err
+	}
+	return n, flush()
+}
+
+// ReadFrom implements the io.ReaderFrom interface, decoding the encoding
+// produced by MarshalBinary or WriteTo from r and adding each entry to the
+// map using Put as it is read. The map must have been configured with a
+// Codec using WithCodec. ReadFrom does not read past the end of the encoding,
+// so further data, such as the encoding of another map, may follow it in r.
+// The lengths of the fields are read a byte at a time, using ReadByte if r
+// implements io.ByteReader, so r should be buffered (e.g. with a
+// bufio.Reader) if it does not. If an error is returned, the map contains the
+// entries decoded prior to the error.
+func (m *Map[K, V]) ReadFrom(r io.Reader) (n int64, err error) {
+	if m.codec == nil {
+		return 0, errNoCodec
+	}
+	return m.readBinary(r, binaryMagic, func(readField func() ([]byte, error)) error {
+		field, err := readField()
+		if err != nil {
+			return err
+		}
+		key, err := m.codec.DecodeKey(field)
+		if err != nil {
+			return err
+		}
+		if field, err = readField(); err != nil {
+			return err
+		}
+		value, err := m.codec.DecodeValue(field)
+		if err != nil {
+			return err
+		}
+		m.Put(key, value)
+		return nil
+	})
+}
+
+// ReadFromFunc is like ReadFrom, but decodes the encoding produced by
+// WriteToFunc, decoding each entry using dec rather than the map's Codec. The
+// data passed to dec must not be retained after dec returns.
+func (m *Map[K, V]) ReadFromFunc(
+	r io.Reader, dec func(data []byte) (K, V, error),
+) (n int64, err error) {
+	return m.readBinary(r, binaryFuncMagic, func(readField func() ([]byte, error)) error {
+		field, err := readField()
+		if err != nil {
+			return err
+		}
+		key, value, err := dec(field)
+		if err != nil {
+			return err
+		}
+		m.Put(key, value)
+		return nil
+	})
+}
+
+// readBinary decodes a binary encoding of a map with the specified magic
+// number from r, calling readEntry to decode and add each entry to the map as
+// it is read. It returns the number of bytes read from r.
+func (m *Map[K, V]) readBinary(
+	r io.Reader, magic string, readEntry func(readField func() ([]byte, error)) error,
+) (int64, error) {
+	br := &binaryReader{r: r}
+	br.br, _ = r.(io.ByteReader)
+	err := m.readBinaryEntries(br, magic, readEntry)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = errBinaryTruncated
+	}
+	return br.n, err
+}
+
+func (m *Map[K, V]) readBinaryEntries(
+	br *binaryReader, magic string, readEntry func(readField func() ([]byte, error)) error,
+) error {
+	var header [binaryHeaderLen]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		return err
+	}
+	if err := checkBinaryHeader(header[:], magic); err != nil {
+		return err
+	}
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+
+	// The count has not been validated against the length of the data, so
+	// limit how much we trust it when growing the map.
+	m.Grow(int(min(count, binaryReadMaxGrow)))
+
+	// The lengths of the fields have not been validated against the length
+	// of the data either, so a field is read into a buffer which grows in
+	// bounded chunks as the data arrives rather than being allocated up front.
+	var field bytes.Buffer
+	readField := func() ([]byte, error) {
+		n, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return nil, errBinaryFieldLength
+		}
+		field.Reset()
+		_, err = io.CopyN(&field, br, int64(n))
+		return field.Bytes(), err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		if err := readEntry(readField); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendBinaryHeader appends the header of a binary encoding of the map with
+// the specified magic number to buf.
+func (m *Map[K, V]) appendBinaryHeader(buf []byte, magic string) []byte {
+	buf = append(buf, magic...)
+	buf = append(buf, binaryVersion)
+	return binary.AppendUvarint(buf, uint64(m.used))
+}
+
+// appendBinaryEntry appends the binary encoding of an entry to buf, using
+// scratch as temporary space for the codec.
+func (m *Map[K, V]) appendBinaryEntry(
+	buf, scratch []byte, key K, value V,
+) (_, _ []byte, err error) {
+	scratch, err = m.codec.AppendKey(scratch[:0], key)
+	if err != nil {
+		return buf, scratch, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(scratch)))
+	buf = append(buf, scratch...)
+
+	scratch, err = m.codec.AppendValue(scratch[:0], value)
+	if err != nil {
+		return buf, scratch, err
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(scratch)))
+	buf = append(buf, scratch...)
+	return buf, scratch, nil
+}
+
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface,
+// accepting the encoding produced by MarshalBinary. The map must have been
+// configured with a Codec using WithCodec. The header and the framing of the
+// entries are validated before any entries are decoded, so malformed or
+// truncated input leaves the map unmodified. The decoded entries are added to
+// the map using Put after growing the map to hold them. If the Codec returns
+// an error, the map may contain a subset of the decoded entries.
+func (m *Map[K, V]) UnmarshalBinary(data []byte) error {
+	if m.codec == nil {
+		return errNoCodec
+	}
+
+	count, data, err := decodeBinaryHeader(data)
+	if err != nil {
+		return err
+	}
+
+	// Validate the framing of every entry before modifying the map.
+	rest := data
+	for i := uint64(0); i < 2*count; i++ {
+		if _, rest, err = decodeBinaryField(rest); err != nil {
+			return err
+		}
+	}
+	if len(rest) != 0 {
+		return fmt.Errorf("swiss: binary encoding has %d bytes of trailing data", len(rest))
+	}
+
+	m.Grow(int(count))
+	for i := uint64(0); i < count; i++ {
+		var field []byte
+		field, data, _ = decodeBinaryField(data)
+		key, err := m.codec.DecodeKey(field)
+		if err != nil {
+			return err
+		}
+		field, data, _ = decodeBinaryField(data)
+		value, err := m.codec.DecodeValue(field)
+		if err != nil {
+			return err
+		}
+		m.Put(key, value)
+	}
+	return nil
+}
+
+// decodeBinaryHeader validates the header of the binary encoding of a Map,
+// returning the number of entries and the remaining data.
+func decodeBinaryHeader(data []byte) (count uint64, rest []byte, err error) {
+	if len(data) < binaryHeaderLen {
+		return 0, nil, errBinaryTruncated
+	}
+	if err := checkBinaryHeader(data[:binaryHeaderLen], binaryMagic); err != nil {
+		return 0, nil, err
+	}
+	count, n := binary.Uvarint(data[binaryHeaderLen:])
+	if n <= 0 {
+		return 0, nil, errBinaryTruncated
+	}
+	rest = data[binaryHeaderLen+n:]
+	// Every entry occupies at least 2 bytes for the lengths of its key and
+	// value. Reject counts that cannot possibly be satisfied by the data
+	// before trusting them to size the map.
+	if count > uint64(len(rest))/2 {
+		return 0, nil, errBinaryTruncated
+	}
+	return count, rest, nil
+}
+
+// checkBinaryHeader validates the magic number and version in the fixed-size
+// portion of the header of a binary encoding of a Map.
+func checkBinaryHeader(header []byte, magic string) error {
+	if string(header[:len(magic)]) != magic {
+		return errors.New("swiss: binary encoding has invalid magic number")
+	}
+	if v := header[len(magic)]; v != binaryVersion {
+		return fmt.Errorf("swiss: unsupported binary encoding version %d", v)
+	}
+	return nil
+}
+
+// decodeBinaryField decodes a uvarint length prefixed field, returning the
+// field and the remaining data.
+func decodeBinaryField(data []byte) (field, rest []byte, err error) {
+	n, k := binary.Uvarint(data)
+	if k <= 0 || n > uint64(len(data)-k) {
+		return nil, nil, errBinaryTruncated
+	}
+	data = data[k:]
+	return data[:n], data[n:], nil
+}
+
+// binaryReader wraps the io.Reader a binary encoding is read from, counting
+// the number of bytes read. It implements io.ByteReader without buffering,
+// using the reader's ReadByte method if it has one, so that no data beyond
+// the end of the encoding is consumed.
+type binaryReader struct {
+	r  io.Reader
+	br io.ByteReader
+	n  int64
+	b  [1]byte
+}
+
+func (r *binaryReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (r *binaryReader) ReadByte() (byte, error) {
+	if r.br != nil {
+		c, err := r.br.ReadByte()
+		if err == nil {
+			r.n++
+		}
+		return c, err
+	}
+	_, err := io.ReadFull(r, r.b[:])
+	return r.b[0], err
+}
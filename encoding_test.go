@@ -0,0 +1,393 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestJSON(t *testing.T) {
+	t.Run("string-keys", func(t *testing.T) {
+		m := New[string, int](0)
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, `{}`, string(data))
+
+		e := make(map[string]int)
+		for i := 0; i < 100; i++ {
+			k := fmt.Sprint(i)
+			m.Put(k, i)
+			e[k] = i
+		}
+
+		// The encoding is identical to a builtin map.
+		data, err = json.Marshal(m)
+		require.NoError(t, err)
+		expected, err := json.Marshal(e)
+		require.NoError(t, err)
+		require.Equal(t, string(expected), string(data))
+
+		var r Map[string, int]
+		require.NoError(t, json.Unmarshal(data, &r))
+		require.Equal(t, e, r.toBuiltinMap())
+	})
+
+	t.Run("named-string-keys", func(t *testing.T) {
+		type name string
+		m := New[name, []int](0)
+		m.Put("a", []int{1})
+		m.Put("b", []int{2, 3})
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, `{"a":[1],"b":[2,3]}`, string(data))
+
+		r := New[name, []int](0)
+		require.NoError(t, json.Unmarshal(data, r))
+		require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+	})
+
+	t.Run("pair-keys", func(t *testing.T) {
+		type point struct{ X, Y int }
+		m := New[point, string](0)
+		data, err := json.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, `[]`, string(data))
+
+		m.Put(point{1, 2}, "a")
+		data, err = json.Marshal(m)
+		require.NoError(t, err)
+		require.Equal(t, `[{"key":{"X":1,"Y":2},"value":"a"}]`, string(data))
+
+		for i := 0; i < 100; i++ {
+			m.Put(point{i, -i}, fmt.Sprint(i))
+		}
+		data, err = json.Marshal(m)
+		require.NoError(t, err)
+
+		r := New[point, string](0)
+		require.NoError(t, json.Unmarshal(data, r))
+		require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var v struct {
+			M *Map[int, int]
+		}
+		data, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.Equal(t, `{"M":null}`, string(data))
+
+		require.NoError(t, json.Unmarshal(data, &v))
+		require.Nil(t, v.M)
+
+		require.NoError(t, json.Unmarshal([]byte(`{"M":[{"key":1,"value":2}]}`), &v))
+		require.Equal(t, map[int]int{1: 2}, v.M.toBuiltinMap())
+	})
+
+	t.Run("merge", func(t *testing.T) {
+		m := New[string, int](0)
+		m.Put("a", 1)
+		m.Put("b", 2)
+		require.NoError(t, json.Unmarshal([]byte(`{"b":3,"c":4}`), m))
+		require.Equal(t, map[string]int{"a": 1, "b": 3, "c": 4}, m.toBuiltinMap())
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		require.Error(t, json.Unmarshal([]byte(`[1,2]`), New[string, int](0)))
+		require.Error(t, json.Unmarshal([]byte(`{"a":1}`), New[int, int](0)))
+	})
+}
+
+func TestGob(t *testing.T) {
+	type point struct{ X, Y int }
+
+	m := New[point, []string](0)
+	for i := 0; i < 1000; i++ {
+		m.Put(point{i, -i}, []string{fmt.Sprint(i), fmt.Sprint(-i)})
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(m))
+
+	var r Map[point, []string]
+	require.NoError(t, gob.NewDecoder(&buf).Decode(&r))
+	require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+
+	// Decoding into a pre-configured map preserves its options.
+	a := &countingAllocator[point, []string]{}
+	c := New[point, []string](0, WithAllocator[point, []string](a))
+	data, err := m.GobEncode()
+	require.NoError(t, err)
+	require.NoError(t, c.GobDecode(data))
+	require.Equal(t, m.toBuiltinMap(), c.toBuiltinMap())
+	require.Greater(t, a.alloc, 0)
+	c.Close()
+	require.EqualValues(t, a.alloc, a.free)
+
+	// An empty map round-trips.
+	e := New[point, []string](0)
+	data, err = e.GobEncode()
+	require.NoError(t, err)
+	var re Map[point, []string]
+	require.NoError(t, re.GobDecode(data))
+	require.EqualValues(t, 0, re.Len())
+
+	require.Error(t, re.GobDecode([]byte("garbage")))
+}
+
+// testCodec encodes int keys as varints and string values as their bytes.
+type testCodec struct{}
+
+func (testCodec) AppendKey(buf []byte, key int) ([]byte, error) {
+	return binary.AppendVarint(buf, int64(key)), nil
+}
+
+func (testCodec) AppendValue(buf []byte, value string) ([]byte, error) {
+	return append(buf, value...), nil
+}
+
+func (testCodec) DecodeKey(data []byte) (int, error) {
+	v, n := binary.Varint(data)
+	if n != len(data) {
+		return 0, errors.New("invalid key")
+	}
+	return int(v), nil
+}
+
+func (testCodec) DecodeValue(data []byte) (string, error) {
+	return string(data), nil
+}
+
+func TestBinary(t *testing.T) {
+	m := New[int, string](0, WithCodec[int, string](testCodec{}))
+	for i := 0; i < 1000; i++ {
+		m.Put(i, fmt.Sprint(i))
+	}
+	data, err := m.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, binaryMagic, string(data[:len(binaryMagic)]))
+	require.EqualValues(t, binaryVersion, data[len(binaryMagic)])
+
+	r := New[int, string](0, WithCodec[int, string](testCodec{}))
+	require.NoError(t, r.UnmarshalBinary(data))
+	require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+
+	// An empty map round-trips.
+	e := New[int, string](0, WithCodec[int, string](testCodec{}))
+	edata, err := e.MarshalBinary()
+	require.NoError(t, err)
+	require.NoError(t, r.UnmarshalBinary(edata))
+	require.EqualValues(t, 1000, r.Len())
+
+	// A codec is required.
+	_, err = New[int, string](0).MarshalBinary()
+	require.ErrorIs(t, err, errNoCodec)
+	require.ErrorIs(t, New[int, string](0).UnmarshalBinary(data), errNoCodec)
+
+	// Truncated input is rejected and leaves the map unmodified.
+	for _, n := range []int{0, 3, binaryHeaderLen, binaryHeaderLen + 1, len(data) / 2, len(data) - 1} {
+		r := New[int, string](0, WithCodec[int, string](testCodec{}))
+		require.ErrorIs(t, r.UnmarshalBinary(data[:n]), errBinaryTruncated, "n=%d", n)
+		require.EqualValues(t, 0, r.Len())
+	}
+
+	// Invalid headers and trailing data are rejected.
+	bad := append([]byte(nil), data...)
+	bad[0] = 'X'
+	require.ErrorContains(t, r.UnmarshalBinary(bad), "invalid magic number")
+	bad = append([]byte(nil), data...)
+	bad[len(binaryMagic)] = binaryVersion + 1
+	require.ErrorContains(t, r.UnmarshalBinary(bad), "unsupported binary encoding version")
+	require.ErrorContains(t, r.UnmarshalBinary(append(data, 0)), "trailing data")
+
+	// The codec is preserved by Clone.
+	cdata, err := m.Clone().MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, len(data), len(cdata))
+}
+
+func TestWriteToReadFrom(t *testing.T) {
+	var _ io.WriterTo = (*Map[int, string])(nil)
+	var _ io.ReaderFrom = (*Map[int, string])(nil)
+
+	m := New[int, string](0, WithCodec[int, string](testCodec{}))
+	for i := 0; i < 10000; i++ {
+		m.Put(i, fmt.Sprint(i))
+	}
+
+	// The streamed encoding is accepted by UnmarshalBinary.
+	var buf bytes.Buffer
+	n, err := m.WriteTo(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+	data := append([]byte(nil), buf.Bytes()...)
+	u := New[int, string](0, WithCodec[int, string](testCodec{}))
+	require.NoError(t, u.UnmarshalBinary(data))
+	require.Equal(t, m.toBuiltinMap(), u.toBuiltinMap())
+
+	// Trailing data following the encoding is not counted.
+	buf.WriteString("trailer")
+	r := New[int, string](0, WithCodec[int, string](testCodec{}))
+	n, err = r.ReadFrom(&buf)
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), n)
+	require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+	require.Equal(t, "trailer", buf.String())
+
+	// Consecutive encodings are read exactly, whether or not the reader
+	// implements io.ByteReader.
+	e := New[int, string](0, WithCodec[int, string](testCodec{}))
+	e.Put(-1, "x")
+	var edata bytes.Buffer
+	_, err = e.WriteTo(&edata)
+	require.NoError(t, err)
+	stream := append(append(append([]byte(nil), data...), edata.Bytes()...), data...)
+	for _, rd := range []io.Reader{bytes.NewReader(stream), struct{ io.Reader }{bytes.NewReader(stream)}} {
+		var total int64
+		for i, want := range []*Map[int, string]{m, e, m} {
+			r := New[int, string](0, WithCodec[int, string](testCodec{}))
+			n, err := r.ReadFrom(rd)
+			require.NoError(t, err, "i=%d", i)
+			require.Equal(t, want.toBuiltinMap(), r.toBuiltinMap(), "i=%d", i)
+			total += n
+		}
+		require.EqualValues(t, len(stream), total)
+		k, err := rd.Read(make([]byte, 1))
+		require.Equal(t, 0, k)
+		require.Equal(t, io.EOF, err)
+	}
+
+	// The encoding produced by MarshalBinary is accepted by ReadFrom.
+	mdata, err := m.MarshalBinary()
+	require.NoError(t, err)
+	r = New[int, string](0, WithCodec[int, string](testCodec{}))
+	_, err = r.ReadFrom(bytes.NewReader(mdata))
+	require.NoError(t, err)
+	require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+
+	// Truncated streams are rejected.
+	for _, n := range []int{0, 3, binaryHeaderLen, len(data) / 2, len(data) - 1} {
+		r := New[int, string](0, WithCodec[int, string](testCodec{}))
+		_, err := r.ReadFrom(bytes.NewReader(data[:n]))
+		require.ErrorIs(t, err, errBinaryTruncated, "n=%d", n)
+	}
+
+	// Malformed field lengths are rejected without allocating the claimed
+	// length.
+	for _, c := range []struct {
+		length uint64
+		err    error
+	}{
+		{1 << 62, errBinaryTruncated},
+		{math.MaxUint64, errBinaryFieldLength},
+	} {
+		bad := m.appendBinaryHeader(nil, binaryMagic)
+		bad = binary.AppendUvarint(bad, c.length)
+		bad = append(bad, "key"...)
+		r := New[int, string](0, WithCodec[int, string](testCodec{}))
+		_, err := r.ReadFrom(bytes.NewReader(bad))
+		require.ErrorIs(t, err, c.err, "length=%d", c.length)
+		bad[len(binaryMagic)-1] = binaryFuncMagic[len(binaryFuncMagic)-1]
+		_, err = r.ReadFromFunc(bytes.NewReader(bad), func([]byte) (int, string, error) {
+			return 0, "", nil
+		})
+		require.ErrorIs(t, err, c.err, "length=%d", c.length)
+	}
+
+	// Write errors are propagated.
+	_, err = m.WriteTo(&failingWriter{limit: 1000})
+	require.ErrorIs(t, err, errWriteFailed)
+}
+
+func TestWriteToFuncReadFromFunc(t *testing.T) {
+	enc := func(key int, value string) ([]byte, error) {
+		return append(binary.AppendVarint(nil, int64(key)), value...), nil
+	}
+	dec := func(data []byte) (int, string, error) {
+		v, n := binary.Varint(data)
+		if n <= 0 {
+			return 0, "", errors.New("invalid key")
+		}
+		return int(v), string(data[n:]), nil
+	}
+
+	m := New[int, string](0)
+	for i := 0; i < 10000; i++ {
+		m.Put(i, fmt.Sprint(i))
+	}
+	var buf bytes.Buffer
+	n, err := m.WriteToFunc(&buf, enc)
+	require.NoError(t, err)
+	require.EqualValues(t, buf.Len(), n)
+	data := append([]byte(nil), buf.Bytes()...)
+	require.Equal(t, binaryFuncMagic, string(data[:len(binaryFuncMagic)]))
+
+	buf.WriteString("trailer")
+	r := New[int, string](0)
+	n, err = r.ReadFromFunc(&buf, dec)
+	require.NoError(t, err)
+	require.EqualValues(t, len(data), n)
+	require.Equal(t, m.toBuiltinMap(), r.toBuiltinMap())
+	require.Equal(t, "trailer", buf.String())
+
+	// The encodings produced with and without a Codec are not confused.
+	c := New[int, string](0, WithCodec[int, string](testCodec{}))
+	_, err = c.ReadFrom(bytes.NewReader(data))
+	require.ErrorContains(t, err, "invalid magic number")
+
+	// Truncated streams are rejected.
+	for _, n := range []int{0, 3, binaryHeaderLen, len(data) / 2, len(data) - 1} {
+		r := New[int, string](0)
+		_, err := r.ReadFromFunc(bytes.NewReader(data[:n]), dec)
+		require.ErrorIs(t, err, errBinaryTruncated, "n=%d", n)
+	}
+
+	// Encoding and decoding errors are propagated.
+	_, err = m.WriteToFunc(io.Discard, func(int, string) ([]byte, error) {
+		return nil, errWriteFailed
+	})
+	require.ErrorIs(t, err, errWriteFailed)
+	_, err = New[int, string](0).ReadFromFunc(bytes.NewReader(data), func([]byte) (int, string, error) {
+		return 0, "", errWriteFailed
+	})
+	require.ErrorIs(t, err, errWriteFailed)
+}
+
+var errWriteFailed = errors.New("write failed")
+
+// failingWriter fails writes once more than limit bytes have been written.
+type failingWriter struct {
+	limit int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n := w.limit
+		w.limit = 0
+		return n, errWriteFailed
+	}
+	w.limit -= len(p)
+	return len(p), nil
+}
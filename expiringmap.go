@@ -0,0 +1,151 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"time"
+)
+
+// ExpiringMap is a Map whose entries expire a time-to-live (TTL) after they
+// are inserted, for use as a cache. Expired entries are treated as absent:
+// Get lazily deletes an expired entry when it encounters one, and Purge
+// deletes all of the expired entries. Expired entries which have not been
+// deleted continue to occupy memory, so a map which is not read regularly
+// should be purged periodically.
+//
+// An ExpiringMap is not safe for concurrent use. Note that Get may delete an
+// expired entry and is therefore a mutation.
+type ExpiringMap[K comparable, V any] struct {
+	m   Map[K, expiringEntry[V]]
+	ttl time.Duration
+	// now returns the current time. It is overridden by tests.
+	now func() time.Time
+}
+
+// expiringEntry is the value stored in the underlying Map of an ExpiringMap.
+type expiringEntry[V any] struct {
+	value V
+	// expiry is the time at which the entry expires in nanoseconds since the
+	// Unix epoch, or zero if the entry never expires.
+	expiry int64
+}
+
+// NewExpiringMap constructs a new ExpiringMap with the specified initial
+// capacity and options. The default TTL of the entries is specified by
+// WithTTL. The remaining options are applied to the underlying map, with the
+// exception of the options which depend on the value type (WithAllocator,
+// WithSmallAllocator and WithCodec) which are ignored. See New for details.
+func NewExpiringMap[K comparable, V any](
+	initialCapacity int, options ...option[K, V],
+) *ExpiringMap[K, V] {
+	e := &ExpiringMap[K, V]{now: time.Now}
+	mapOptions := make([]option[K, V], 0, len(options))
+	for _, op := range options {
+		if t, ok := op.(ttlOption[K, V]); ok {
+			e.ttl = t.ttl
+		} else {
+			mapOptions = append(mapOptions, op)
+		}
+	}
+	var opts Map[K, V]
+	opts.initOptions(mapOptions...)
+	initKeyOptionsLike(&e.m, &opts)
+	e.m.initBuckets(initialCapacity)
+	return e
+}
+
+// expired returns true if the entry has expired as of now, specified in
+// nanoseconds since the Unix epoch.
+func (ent *expiringEntry[V]) expired(now int64) bool {
+	return ent.expiry != 0 && ent.expiry <= now
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present or its entry has expired. An expired
+// entry is deleted.
+func (e *ExpiringMap[K, V]) Get(key K) (value V, ok bool) {
+	ent := e.m.GetPtr(key)
+	if ent == nil {
+		return value, false
+	}
+	if ent.expired(e.now().UnixNano()) {
+		e.m.Delete(key)
+		return value, false
+	}
+	return ent.value, true
+}
+
+// Put inserts an entry into the map which expires after the default TTL (see
+// WithTTL), overwriting an existing value and expiry if an entry with the same
+// key already exists.
+func (e *ExpiringMap[K, V]) Put(key K, value V) {
+	e.put(key, value, e.ttl)
+}
+
+// PutWithTTL inserts an entry into the map which expires after ttl,
+// overriding the default TTL. A ttl of zero means the entry never expires.
+// An existing value and expiry for the key are overwritten. PutWithTTL panics
+// if ttl is negative.
+func (e *ExpiringMap[K, V]) PutWithTTL(key K, value V, ttl time.Duration) {
+	if ttl < 0 {
+		panic(fmt.Sprintf("swiss: PutWithTTL: invalid TTL %s", ttl))
+	}
+	e.put(key, value, ttl)
+}
+
+func (e *ExpiringMap[K, V]) put(key K, value V, ttl time.Duration) {
+	var expiry int64
+	if ttl != 0 {
+		expiry = e.now().Add(ttl).UnixNano()
+	}
+	e.m.Put(key, expiringEntry[V]{value: value, expiry: expiry})
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (e *ExpiringMap[K, V]) Delete(key K) {
+	e.m.Delete(key)
+}
+
+// Purge deletes all of the expired entries from the map, returning the
+// number of entries deleted.
+func (e *ExpiringMap[K, V]) Purge() int {
+	now := e.now().UnixNano()
+	n := e.m.Len()
+	e.m.DeleteFunc(func(_ K, ent expiringEntry[V]) bool {
+		return ent.expired(now)
+	})
+	return n - e.m.Len()
+}
+
+// Len returns the number of entries in the map, including expired entries
+// which have not yet been deleted by Get or Purge.
+func (e *ExpiringMap[K, V]) Len() int {
+	return e.m.Len()
+}
+
+// All calls yield sequentially for each key and value present in the map
+// which has not expired. If yield returns false, range stops the iteration.
+// See Map.All for the semantics of mutating the map during iteration.
+func (e *ExpiringMap[K, V]) All(yield func(key K, value V) bool) {
+	now := e.now().UnixNano()
+	e.m.All(func(key K, ent expiringEntry[V]) bool {
+		if ent.expired(now) {
+			return true
+		}
+		return yield(key, ent.value)
+	})
+}
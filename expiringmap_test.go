@@ -0,0 +1,92 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpiringMap(t *testing.T) {
+	now := time.Unix(1000, 0)
+	e := NewExpiringMap[int, int](0, WithTTL[int, int](time.Minute),
+		WithMaxBucketCapacity[int, int](64))
+	e.now = func() time.Time { return now }
+
+	// Entries 0-99 use the default TTL, 100-199 a shorter TTL and 200-299
+	// never expire.
+	for i := 0; i < 100; i++ {
+		e.Put(i, i)
+		e.PutWithTTL(i+100, i+100, time.Second)
+		e.PutWithTTL(i+200, i+200, 0)
+	}
+	require.EqualValues(t, 300, e.Len())
+
+	count := func() int {
+		var n int
+		e.All(func(k, v int) bool {
+			require.EqualValues(t, k, v)
+			n++
+			return true
+		})
+		return n
+	}
+	require.EqualValues(t, 300, count())
+
+	now = now.Add(time.Second)
+	require.EqualValues(t, 200, count())
+	// Expired entries are deleted lazily by Get.
+	for i := 100; i < 150; i++ {
+		_, ok := e.Get(i)
+		require.False(t, ok)
+	}
+	require.EqualValues(t, 250, e.Len())
+	require.EqualValues(t, 50, e.Purge())
+	require.EqualValues(t, 200, e.Len())
+
+	// Overwriting an entry resets its expiry.
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 10; i++ {
+		e.Put(i, i)
+	}
+	now = now.Add(30 * time.Second)
+	for i := 0; i < 100; i++ {
+		_, ok := e.Get(i)
+		require.Equal(t, i < 10, ok)
+	}
+	require.EqualValues(t, 0, e.Purge())
+	require.EqualValues(t, 110, e.Len())
+
+	now = now.Add(time.Hour)
+	require.EqualValues(t, 10, e.Purge())
+	require.EqualValues(t, 100, e.Len())
+	require.EqualValues(t, 100, count())
+	for i := 200; i < 300; i++ {
+		v, ok := e.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i, v)
+	}
+
+	e.Delete(200)
+	require.EqualValues(t, 99, e.Len())
+
+	// The options other than the TTL are applied to the underlying map.
+	require.EqualValues(t, 63, e.m.maxBucketCapacity)
+	require.Panics(t, func() { WithTTL[int, int](-time.Second) })
+	require.Panics(t, func() { New[int, int](0, WithTTL[int, int](time.Second)) })
+	require.Panics(t, func() { e.PutWithTTL(1, 1, -time.Second) })
+}
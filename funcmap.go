@@ -0,0 +1,190 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// FuncMap is a map whose keys are compared using a user-provided equality
+// function rather than Go's == operator, which allows keys which are not
+// comparable (e.g. structs containing slices) or whose notion of equality
+// differs from == (e.g. case-insensitive strings).
+//
+// Map does not offer a pluggable equality function (e.g. a WithKeyEqual
+// option) for two reasons. Allowing keys which are not comparable would
+// require relaxing the constraint on Map's key type from comparable to any,
+// which is a breaking change for every generic function and type built on
+// Map. It would also route every key comparison in the probe loops through an
+// indirect call which the compiler cannot inline, slowing down lookups and
+// insertions of maps which use ==. FuncMap instead builds on an unmodified
+// Map, so only maps which need custom equality pay for it.
+//
+// A FuncMap is implemented as a Map keyed by the hash of each key, with the
+// entries for distinct keys which have the same hash chained together. The
+// hash function must be consistent with the equality function: equal keys
+// must have equal hashes. Distinct keys which have the same hash are handled
+// correctly, but a hash function which produces many collisions degrades the
+// map to a linear search of the colliding keys.
+//
+// A FuncMap is NOT goroutine-safe.
+type FuncMap[K any, V any] struct {
+	hash func(key *K, seed uintptr) uintptr
+	eq   func(a, b K) bool
+	seed uintptr
+	used int
+	m    Map[uintptr, funcChain[K, V]]
+}
+
+// funcChain holds the entries of a FuncMap whose keys have the same hash. The
+// first entry is stored inline as collisions are rare.
+type funcChain[K any, V any] struct {
+	key      K
+	value    V
+	overflow []funcEntry[K, V]
+}
+
+// funcEntry is an entry of a funcChain other than the first.
+type funcEntry[K any, V any] struct {
+	key   K
+	value V
+}
+
+// NewFunc constructs a new FuncMap with the specified initial capacity, which
+// hashes keys using hash and compares them using eq. See FuncMap for the
+// requirements of hash and eq.
+func NewFunc[K any, V any](
+	initialCapacity int, hash func(key *K, seed uintptr) uintptr, eq func(a, b K) bool,
+) *FuncMap[K, V] {
+	f := &FuncMap[K, V]{
+		hash: hash,
+		eq:   eq,
+		seed: uintptr(fastrand64()),
+	}
+	f.m.Init(initialCapacity)
+	return f
+}
+
+// chain returns the chain of entries for the keys with hash h, or nil if
+// there are none. The returned pointer is invalidated by any subsequent
+// insertion into or deletion from f.m.
+func (f *FuncMap[K, V]) chain(h uintptr) *funcChain[K, V] {
+	b, i, found := f.m.find(f.m.hash(noescape(unsafe.Pointer(&h)), f.m.seed), h)
+	if !found {
+		return nil
+	}
+	return &b.slots.At(i).value
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present.
+func (f *FuncMap[K, V]) Get(key K) (value V, ok bool) {
+	c := f.chain(f.hash(&key, f.seed))
+	if c == nil {
+		return value, false
+	}
+	if f.eq(c.key, key) {
+		return c.value, true
+	}
+	for i := range c.overflow {
+		if f.eq(c.overflow[i].key, key) {
+			return c.overflow[i].value, true
+		}
+	}
+	return value, false
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with an equal key already exists. The existing key is retained.
+func (f *FuncMap[K, V]) Put(key K, value V) {
+	h := f.hash(&key, f.seed)
+	c := f.chain(h)
+	if c == nil {
+		f.m.Put(h, funcChain[K, V]{key: key, value: value})
+		f.used++
+		return
+	}
+	if f.eq(c.key, key) {
+		c.value = value
+		return
+	}
+	for i := range c.overflow {
+		if f.eq(c.overflow[i].key, key) {
+			c.overflow[i].value = value
+			return
+		}
+	}
+	c.overflow = append(c.overflow, funcEntry[K, V]{key: key, value: value})
+	f.used++
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (f *FuncMap[K, V]) Delete(key K) {
+	h := f.hash(&key, f.seed)
+	c := f.chain(h)
+	if c == nil {
+		return
+	}
+	if f.eq(c.key, key) {
+		if len(c.overflow) == 0 {
+			f.m.Delete(h)
+		} else {
+			// Promote the last overflow entry to the head of the chain.
+			last := len(c.overflow) - 1
+			c.key, c.value = c.overflow[last].key, c.overflow[last].value
+			c.overflow[last] = funcEntry[K, V]{}
+			c.overflow = c.overflow[:last]
+		}
+		f.used--
+		return
+	}
+	for i := range c.overflow {
+		if f.eq(c.overflow[i].key, key) {
+			last := len(c.overflow) - 1
+			c.overflow[i] = c.overflow[last]
+			c.overflow[last] = funcEntry[K, V]{}
+			c.overflow = c.overflow[:last]
+			f.used--
+			return
+		}
+	}
+}
+
+// Len returns the number of entries in the map.
+func (f *FuncMap[K, V]) Len() int {
+	return f.used
+}
+
+// Clear deletes all entries from the map resulting in an empty map.
+func (f *FuncMap[K, V]) Clear() {
+	f.m.Clear()
+	f.used = 0
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, range stops the iteration. The map must not be mutated
+// during iteration.
+func (f *FuncMap[K, V]) All(yield func(key K, value V) bool) {
+	f.m.All(func(_ uintptr, c funcChain[K, V]) bool {
+		if !yield(c.key, c.value) {
+			return false
+		}
+		for i := range c.overflow {
+			if !yield(c.overflow[i].key, c.overflow[i].value) {
+				return false
+			}
+		}
+		return true
+	})
+}
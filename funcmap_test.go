@@ -0,0 +1,118 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFuncMap(t *testing.T) {
+	// sliceKey is not comparable.
+	type sliceKey struct {
+		name string
+		tags []string
+	}
+	eq := func(a, b sliceKey) bool {
+		return a.name == b.name && slices.Equal(a.tags, b.tags)
+	}
+	// fnv hashes the strings of a key using FNV-1a.
+	fnv := func(key *sliceKey, seed uintptr) uintptr {
+		h := uint64(14695981039346656037) ^ uint64(seed)
+		for _, s := range append([]string{key.name}, key.tags...) {
+			for i := 0; i < len(s); i++ {
+				h = (h ^ uint64(s[i])) * 1099511628211
+			}
+			h = (h ^ 0xff) * 1099511628211
+		}
+		return uintptr(h)
+	}
+	makeKey := func(i int) sliceKey {
+		return sliceKey{name: strconv.Itoa(i), tags: []string{"a", strconv.Itoa(i % 7)}}
+	}
+
+	testCases := []struct {
+		name string
+		hash func(key *sliceKey, seed uintptr) uintptr
+	}{
+		{"fnv", fnv},
+		// Every key collides.
+		{"degenerate", func(key *sliceKey, seed uintptr) uintptr { return 0 }},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			const count = 200
+			f := NewFunc[sliceKey, int](0, c.hash, eq)
+			for i := 0; i < count; i++ {
+				f.Put(makeKey(i), i)
+				// A distinct but equal key overwrites the entry.
+				f.Put(makeKey(i), i+count)
+				require.EqualValues(t, i+1, f.Len())
+			}
+			for i := 0; i < count; i++ {
+				v, ok := f.Get(makeKey(i))
+				require.True(t, ok)
+				require.EqualValues(t, i+count, v)
+			}
+			_, ok := f.Get(sliceKey{name: "0"})
+			require.False(t, ok)
+
+			seen := make(map[string]int)
+			f.All(func(k sliceKey, v int) bool {
+				require.True(t, eq(makeKey(v-count), k))
+				seen[k.name]++
+				return true
+			})
+			require.Len(t, seen, count)
+
+			for i := 0; i < count; i += 2 {
+				f.Delete(makeKey(i))
+			}
+			f.Delete(makeKey(-1))
+			require.EqualValues(t, count/2, f.Len())
+			for i := 0; i < count; i++ {
+				_, ok := f.Get(makeKey(i))
+				require.Equal(t, i%2 == 1, ok)
+			}
+
+			f.Clear()
+			require.EqualValues(t, 0, f.Len())
+			_, ok = f.Get(makeKey(1))
+			require.False(t, ok)
+		})
+	}
+
+	// Keys which are comparable but with a different notion of equality.
+	f := NewFunc[string, int](0,
+		func(key *string, seed uintptr) uintptr {
+			return uintptr(len(*key)) ^ seed
+		},
+		strings.EqualFold)
+	f.Put("Hello", 1)
+	f.Put("HELLO", 2)
+	require.EqualValues(t, 1, f.Len())
+	v, ok := f.Get("hello")
+	require.True(t, ok)
+	require.EqualValues(t, 2, v)
+	f.All(func(k string, _ int) bool {
+		// The existing key is retained.
+		require.Equal(t, "Hello", k)
+		return true
+	})
+}
@@ -0,0 +1,103 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_group32
+
+package swiss
+
+import (
+	"math/bits"
+	"strings"
+)
+
+// The swiss_group32 build tag widens groups from 8 to 32 control bytes. A
+// probe examines 32 slots at once which reduces the number of probe steps in
+// large buckets, at the cost of a larger minimum bucket capacity (31 slots).
+// Wide groups are intended for use with vector compare instructions: on
+// amd64 with GOAMD64=v3 or higher the matching routines use AVX2 (see
+// match_group32_amd64.s), and elsewhere the portable SWAR routines are
+// applied to each 8 byte word of the group.
+
+const (
+	// groupSize is the number of control bytes examined at once by a probe.
+	groupSize       = 32
+	maxAvgGroupLoad = 28
+)
+
+// bitset represents a set of slots within a group.
+//
+// Unlike the 8-wide groups of group8.go, the 32 bytes of a group do not fit
+// in a machine word and the underlying representation uses one bit per slot:
+// bit i is set iff the slot at relative index i is part of the set. This is
+// the representation produced by vector byte compares (e.g. VPMOVMSKB).
+type bitset uint32
+
+// first returns the relative index of the first slot in the set.
+//
+// Returns groupSize if the bitset is empty.
+func (b bitset) first() uintptr {
+	return uintptr(bits.TrailingZeros32(uint32(b)))
+}
+
+// Returns the maximal number of contiguous slots at the beginning of the group
+// that are NOT in the set.
+func (b bitset) absentAtStart() uintptr {
+	return b.first()
+}
+
+// Returns the maximal number of contiguous slots at the end of the group that
+// are NOT in the set.
+func (b bitset) absentAtEnd() uintptr {
+	return uintptr(bits.LeadingZeros32(uint32(b)))
+}
+
+// remove removes the slot with the given relative index.
+func (b bitset) remove(i uintptr) bitset {
+	return b &^ slotBitset(i)
+}
+
+// slotBitset returns the bitset containing only the slot with the given
+// relative index.
+func slotBitset(i uintptr) bitset {
+	return bitset(1) << i
+}
+
+func (b bitset) String() string {
+	var buf strings.Builder
+	buf.Grow(groupSize)
+	for i := uintptr(0); i < groupSize; i++ {
+		if (b & slotBitset(i)) != 0 {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	return buf.String()
+}
+
+// ctrlGroup contains a group of 32 control bytes as 4 little-endian words.
+// Note that a group can start at any control byte (not just those that are
+// aligned).
+type ctrlGroup [groupSize / 8]uint64
+
+// convertNonFullToEmptyAndFullToDeleted converts deleted or sentinel control
+// bytes in a group to empty control bytes, and control bytes indicating full
+// slots to deleted control bytes. See group8.go for an explanation of the
+// arithmetic, which is applied to each word of the group.
+func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
+	for i := range g {
+		v := g[i] & bitsetMSB
+		g[i] = (^v + (v >> 7)) &^ bitsetLSB
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_group32
+
+package swiss
+
+import (
+	"math/bits"
+	"strings"
+)
+
+const (
+	// groupSize is the number of control bytes examined at once by a probe.
+	// See group32.go for the wider groups enabled by the swiss_group32 build
+	// tag.
+	groupSize       = 8
+	maxAvgGroupLoad = 7
+)
+
+// bitset represents a set of slots within a group.
+//
+// The underlying representation uses one byte per slot, where each byte is
+// either 0x80 if the slot is part of the set or 0x00 otherwise. This makes it
+// convenient to calculate for an entire group at once (e.g. see matchEmpty).
+type bitset uint64
+
+// first assumes that only the MSB of each control byte can be set (e.g. bitset
+// is the result of matchEmpty or similar) and returns the relative index of the
+// first control byte in the group that has the MSB set.
+//
+// Returns groupSize if the bitset is empty.
+func (b bitset) first() uintptr {
+	return uintptr(bits.TrailingZeros64(uint64(b))) >> 3
+}
+
+// Returns the maximal number of contiguous slots at the beginning of the group
+// that are NOT in the set.
+func (b bitset) absentAtStart() uintptr {
+	return b.first()
+}
+
+// Returns the maximal number of contiguous slots at the end of the group that
+// are NOT in the set.
+func (b bitset) absentAtEnd() uintptr {
+	return uintptr(bits.LeadingZeros64(uint64(b))) >> 3
+}
+
+// remove removes the slot with the given relative index.
+func (b bitset) remove(i uintptr) bitset {
+	return b &^ slotBitset(i)
+}
+
+// slotBitset returns the bitset containing only the slot with the given
+// relative index.
+func slotBitset(i uintptr) bitset {
+	return bitset(0x80) << (i << 3)
+}
+
+func (b bitset) String() string {
+	var buf strings.Builder
+	buf.Grow(groupSize)
+	for i := uintptr(0); i < groupSize; i++ {
+		if (b & slotBitset(i)) != 0 {
+			buf.WriteString("1")
+		} else {
+			buf.WriteString("0")
+		}
+	}
+	return buf.String()
+}
+
+// ctrlGroup contains a group of 8 control bytes (in little-endian). Note that a
+// group can start at any control byte (not just those that are 8-byte aligned).
+type ctrlGroup uint64
+
+// convertNonFullToEmptyAndFullToDeleted converts deleted or sentinel control
+// bytes in a group to empty control bytes, and control bytes indicating full
+// slots to deleted control bytes.
+func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
+	// An empty slot is     1000 0000
+	// A deleted slot is    1111 1110
+	// The sentinel slot is 1111 1111
+	// A full slot is       0??? ????
+	//
+	// We select the MSB, invert, add 1 if the MSB was set and zero out the low
+	// bit.
+	//
+	//  - if the MSB was set (i.e. slot was empty, deleted, or sentinel):
+	//     v:             1000 0000
+	//     ^v:            0111 1111
+	//     ^v + (v >> 7): 1000 0000
+	//     &^ bitsetLSB:  1000 0000 = empty slot.
+	//
+	// - if the MSB was not set (i.e. full slot):
+	//     v:             0000 0000
+	//     ^v:            1111 1111
+	//     ^v + (v >> 7): 1111 1111
+	//     &^ bitsetLSB:  1111 1110 = deleted slot.
+	//
+	v := uint64(*g) & bitsetMSB
+	*g = ctrlGroup((^v + (v >> 7)) &^ bitsetLSB)
+}
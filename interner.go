@@ -0,0 +1,77 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import "unsafe"
+
+// Interner deduplicates keys, retaining a single canonical copy of each
+// distinct key. Interning a key returns the canonical copy, which for keys
+// containing pointers (e.g. strings) allows equal keys to share the memory
+// they reference. An Interner wraps a Map[K, struct{}] which stores the
+// canonical copies as its keys, and accepts the same options as New. The zero
+// value of an Interner is ready to use.
+//
+// An Interner is NOT goroutine-safe.
+type Interner[K comparable] struct {
+	m Map[K, struct{}]
+}
+
+// NewInterner constructs a new Interner with the specified initial capacity
+// and options. See New for details.
+func NewInterner[K comparable](initialCapacity int, options ...option[K, struct{}]) *Interner[K] {
+	in := &Interner[K]{}
+	in.m.Init(initialCapacity, options...)
+	return in
+}
+
+// Intern returns the canonical copy of key: the copy stored by the first call
+// to Intern with a key equal to key, inserting key if there is no such copy.
+// A key which is present is found with a single probe of the map, and the
+// same probe locates the slot into which a new key is inserted, unless the
+// map must grow to make room for it, in which case the key is inserted by
+// probing the grown map.
+func (in *Interner[K]) Intern(key K) K {
+	m := &in.m
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		return b.slots.At(i).key
+	}
+	m.insertAt(h, b, i, key, &struct{}{})
+	return key
+}
+
+// Contains returns true if a copy of key has been interned.
+func (in *Interner[K]) Contains(key K) bool {
+	return in.m.Contains(key)
+}
+
+// Len returns the number of distinct keys interned.
+func (in *Interner[K]) Len() int {
+	return in.m.Len()
+}
+
+// Clear forgets all of the interned keys.
+func (in *Interner[K]) Clear() {
+	in.m.Clear()
+}
+
+// Close closes the interner, releasing any memory back to its configured
+// allocator. See Map.Close.
+func (in *Interner[K]) Close() {
+	in.m.Close()
+}
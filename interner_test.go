@@ -0,0 +1,62 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"strconv"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterner(t *testing.T) {
+	in := NewInterner[string](0)
+	const count = 1000
+
+	canonical := make([]string, count)
+	for i := 0; i < count; i++ {
+		s := "key-" + strconv.Itoa(i)
+		canonical[i] = in.Intern(s)
+		require.Equal(t, s, canonical[i])
+		require.Same(t, unsafe.StringData(s), unsafe.StringData(canonical[i]))
+	}
+	require.EqualValues(t, count, in.Len())
+
+	// Interning an equal string returns the canonical copy, sharing its
+	// memory rather than that of the string being interned.
+	for i := 0; i < count; i++ {
+		s := "key-" + strconv.Itoa(i)
+		require.True(t, in.Contains(s))
+		c := in.Intern(s)
+		require.Equal(t, s, c)
+		require.Same(t, unsafe.StringData(canonical[i]), unsafe.StringData(c))
+		require.NotSame(t, unsafe.StringData(s), unsafe.StringData(c))
+	}
+	require.EqualValues(t, count, in.Len())
+
+	in.Clear()
+	require.EqualValues(t, 0, in.Len())
+	require.False(t, in.Contains("key-1"))
+
+	// Keys without pointers are interned by value, and the zero value
+	// Interner is ready to use.
+	type point struct{ x, y int }
+	var pts Interner[point]
+	require.Equal(t, point{1, 2}, pts.Intern(point{1, 2}))
+	require.Equal(t, point{1, 2}, pts.Intern(point{1, 2}))
+	require.EqualValues(t, 1, pts.Len())
+	pts.Close()
+}
@@ -18,3 +18,15 @@ package swiss
 
 // invariants is false if we were not built with the "swiss_invariants" build tags.
 const invariants = false
+
+// sliceLen is empty when built without "swiss_invariants" so that accesses
+// through an unsafeSlice are not bounds checked.
+type sliceLen struct{}
+
+func makeSliceLen(n int) sliceLen {
+	return sliceLen{}
+}
+
+func (l sliceLen) checkIndex(i uintptr) {}
+
+func (l sliceLen) checkRange(start, end uintptr) {}
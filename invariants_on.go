@@ -16,5 +16,31 @@
 
 package swiss
 
+import "fmt"
+
 // invariants is true if we were built with the "swiss_invariants".
 const invariants = true
+
+// sliceLen records the length of an unsafeSlice so that accesses can be
+// bounds checked. It is empty when built without "swiss_invariants".
+type sliceLen struct {
+	n uintptr
+}
+
+func makeSliceLen(n int) sliceLen {
+	return sliceLen{n: uintptr(n)}
+}
+
+// checkIndex panics if i is not a valid index.
+func (l sliceLen) checkIndex(i uintptr) {
+	if i >= l.n {
+		panic(fmt.Sprintf("invariant failed: index %d out of range [0:%d]", i, l.n))
+	}
+}
+
+// checkRange panics if [start:end] is not a valid range.
+func (l sliceLen) checkRange(start, end uintptr) {
+	if start > end || end > l.n {
+		panic(fmt.Sprintf("invariant failed: slice bounds [%d:%d] out of range [0:%d]", start, end, l.n))
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.23
+
+package swiss
+
+import (
+	"iter"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Verify that the iteration methods conform to the iter package types.
+var (
+	_ iter.Seq2[int, string] = (*Map[int, string])(nil).All
+	_ iter.Seq[int]          = (*Map[int, string])(nil).AllKeys
+	_ iter.Seq[string]       = (*Map[int, string])(nil).AllValues
+)
+
+func TestRangeFunc(t *testing.T) {
+	m := New[int, int](0)
+	e := make(map[int]int)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i+100)
+		e[i] = i + 100
+	}
+
+	r := make(map[int]int)
+	for k, v := range m.All {
+		r[k] = v
+	}
+	require.Equal(t, e, r)
+
+	keys := make(map[int]bool)
+	for k := range m.AllKeys {
+		keys[k] = true
+	}
+	require.Len(t, keys, len(e))
+
+	values := make(map[int]bool)
+	for v := range m.AllValues {
+		values[v] = true
+	}
+	require.Len(t, values, len(e))
+
+	// Breaking out of the loop stops iteration.
+	var n int
+	for range m.All {
+		n++
+		if n == 10 {
+			break
+		}
+	}
+	require.EqualValues(t, 10, n)
+
+	// Iteration remains valid if the map is resized during iteration.
+	r = make(map[int]int)
+	for k, v := range m.All {
+		if (k % 10) == 0 {
+			m.bucket0.resize(m, 2*m.bucket0.capacity+1)
+		}
+		r[k] = v
+	}
+	require.Equal(t, e, r)
+}
@@ -167,17 +167,24 @@
 package swiss
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"math/bits"
+	"math/rand"
+	"reflect"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"unsafe"
 )
 
 const (
-	groupSize       = 8
-	maxAvgGroupLoad = 7
-
 	ctrlEmpty    ctrl = 0b10000000
 	ctrlDeleted  ctrl = 0b11111110
 	ctrlSentinel ctrl = 0b11111111
@@ -187,14 +194,59 @@ const (
 	bitsetEmpty   = bitsetLSB * uint64(ctrlEmpty)
 	bitsetDeleted = bitsetLSB * uint64(ctrlDeleted)
 
-	minBucketCapacity        uintptr = 7
+	minBucketCapacity        uintptr = groupSize - 1
 	defaultMaxBucketCapacity uintptr = 4095
+
+	// maxAlloc is a conservative bound on the size of the largest allocation
+	// that can succeed (cf. maxAlloc in the runtime). An initial capacity
+	// requiring larger tables is ignored rather than overflowing the sizing
+	// arithmetic.
+	maxAlloc = min(1<<47, math.MaxInt)
+
+	// The maximum load factor of a bucket is represented as a fixed point
+	// fraction with loadFactorShift bits of precision. The default maximum
+	// load factor is maxAvgGroupLoad/groupSize (7/8). See WithMaxLoadFactor.
+	loadFactorShift          = 10
+	defaultMaxLoad   uintptr = (maxAvgGroupLoad << loadFactorShift) / groupSize
+	minMaxLoadFactor         = 0.25
+	maxMaxLoadFactor         = 0.9375
+	minAutoCompact           = 0.0625
+
+	// maxStringEntries is the maximum number of entries included by
+	// Map.String.
+	maxStringEntries = 32
+
+	// migrateSlots is the number of slots of a bucket's old table which are
+	// migrated by each insertion or deletion while an incremental resize of
+	// the bucket is in progress. A resize doubles the capacity of a bucket so
+	// migrating at least 1/maxLoad slots per insertion guarantees the
+	// migration completes before the new table fills up. Buckets with a capacity
+	// smaller than migrateSlots are always resized synchronously.
+	migrateSlots = 128
+
+	// resetBucketCapacity is the largest bucket capacity retained by
+	// Map.Reset.
+	resetBucketCapacity uintptr = 63
 )
 
 // Slot holds a key and value.
 type Slot[K comparable, V any] struct {
-	key   K
+	// NB: value is placed before key so that a zero-sized value (e.g. the
+	// struct{} values of a Set) occupies no space. Go pads a struct whose
+	// final field is zero-sized so that a pointer to that field does not
+	// point past the end of the struct.
 	value V
+	key   K
+}
+
+// Key returns the key of the slot.
+func (s Slot[K, V]) Key() K {
+	return s.key
+}
+
+// Value returns the value of the slot.
+func (s Slot[K, V]) Value() V {
+	return s.value
 }
 
 // bucket implements Google's Swiss Tables hash table design. A Map is
@@ -233,6 +285,18 @@ type bucket[K comparable, V any] struct {
 	// this bucket and the following 1<<(globalDepth-localDepth) entries will
 	// also point to this bucket.
 	index uintptr
+	// old is the bucket's previous table while an incremental resize of the
+	// bucket is in progress (see WithIncrementalResize), and nil otherwise.
+	// Entries which are not found in the bucket's table must also be looked
+	// for in old, and used does not include the entries in old.
+	old *bucket[K, V]
+	// migrated is the number of slots at the start of an old table whose
+	// entries have been migrated to the new table. The control bytes of
+	// migrated slots are left intact so that the old table remains valid for
+	// iteration by All, and lookups ignore matches at index < migrated. The
+	// used count of an old table is the number of entries not yet migrated.
+	// Always zero for a bucket which is not an old table.
+	migrated uintptr
 }
 
 // Map is an unordered map from keys to values with Put, Get, Delete, and All
@@ -241,12 +305,19 @@ type bucket[K comparable, V any] struct {
 // Map[K,V] uses the same hash function as Go's builtin map[K]V, though a
 // different hash function can be specified using the WithHash option.
 //
+// The zero value for a Map is an empty map with the default options which is
+// initialized on the first insertion. Lookups, deletions, and iteration are
+// supported on a zero value Map and do not initialize it.
+//
 // A Map is NOT goroutine-safe.
 type Map[K comparable, V any] struct {
 	// The hash function to each keys of type K. The hash function is
 	// extracted from the Go runtime's implementation of map[K]struct{}.
 	hash hashFn
 	seed uintptr
+	// fixedSeed is true if the seed was specified by WithSeed, in which case
+	// the seed is not randomized when the map is cleared.
+	fixedSeed bool
 	// The allocator to use for the ctrls and slots slices.
 	allocator Allocator[K, V]
 	// bucket0 is always present and inlined in the Map to avoid a pointer
@@ -268,6 +339,72 @@ type Map[K comparable, V any] struct {
 	// The maximum capacity a bucket is allowed to grow to before it will be
 	// split.
 	maxBucketCapacity uintptr
+	// The codec used for the binary encoding of the map. Nil if no codec was
+	// specified.
+	codec Codec[K, V]
+	// The hash function for values used by Fingerprint. Nil if no value hash
+	// was specified.
+	valueHash func(value *V, seed uintptr) uintptr
+	// autoReseed is the probe length (in groups) which, if exceeded by a Put,
+	// triggers reseeding of the map. Zero if auto-reseeding is disabled.
+	autoReseed uintptr
+	// autoReseedUsed is the number of entries in the map when it was last
+	// automatically reseeded.
+	autoReseedUsed int
+	// incrementalResize is true if buckets are resized incrementally. See
+	// WithIncrementalResize.
+	incrementalResize bool
+	// maxLoad is the maximum load factor of a bucket as a fixed point
+	// fraction with loadFactorShift bits of precision.
+	maxLoad uintptr
+	// initialBuckets is the minimum number of buckets the map is split into
+	// when it is initialized. See WithInitialBuckets.
+	initialBuckets uintptr
+	// autoCompact is the fraction of a bucket's capacity occupied by
+	// tombstones at which a full bucket is rehashed in place rather than
+	// resized or split, as a fixed point fraction with loadFactorShift bits
+	// of precision. Zero if the default threshold is used. See
+	// WithAutoCompact.
+	autoCompact uintptr
+	// closed is true if the map has been closed. See Close.
+	closed bool
+	// inCallback is true in invariants builds while a callback which must
+	// not modify the map is running. See enterCallback.
+	inCallback bool
+	// shared is true if the map's buckets are shared with a snapshot, in which
+	// case they must be copied before the map is mutated. See Snapshot.
+	shared bool
+	// snapshot is true if the map is a snapshot, which may not be mutated.
+	snapshot bool
+	// deterministicIteration is true if All iterates in a fixed order. See
+	// WithDeterministicIteration.
+	deterministicIteration bool
+	// stableIteration is true if All randomizes the iteration order using
+	// iterationSeed, chosen when the map is initialized, rather than a new
+	// random value on each call. See WithStableRandomIteration.
+	stableIteration bool
+	iterationSeed   uintptr
+	// Counters of the resizes and splits of buckets and the calls to the
+	// allocator over the lifetime of the map. See Stats.
+	resizes int
+	splits  int
+	allocs  int
+	frees   int
+	// iterators is the number of calls to All in progress. It is updated
+	// atomically as All may be called concurrently with other reads of the
+	// map. A table freed while an iteration is in progress may still be read
+	// by the iteration (see bucketAll), so its release to the allocator is
+	// deferred to deferredFrees until the last iteration finishes.
+	iterators     int32
+	deferredFrees []deferredFree[K, V]
+}
+
+// deferredFree is a table whose release to allocator has been deferred until
+// no iteration of the map is in progress.
+type deferredFree[K comparable, V any] struct {
+	allocator Allocator[K, V]
+	ctrls     []uint8
+	slots     []Slot[K, V]
 }
 
 func normalizeCapacity(capacity uintptr) uintptr {
@@ -276,21 +413,81 @@ func normalizeCapacity(capacity uintptr) uintptr {
 
 // New constructs a new Map with the specified initial capacity. If
 // initialCapacity is 0 the map will start out with zero capacity and will
-// grow on the first insert. The zero value for a Map is not usable.
+// grow on the first insert. As with the size hint passed to the builtin make,
+// an initialCapacity too large to be allocated is ignored.
 func New[K comparable, V any](initialCapacity int, options ...option[K, V]) *Map[K, V] {
 	m := &Map[K, V]{}
 	m.Init(initialCapacity, options...)
 	return m
 }
 
+// FromGoMap constructs a new Map containing the entries of the builtin map m,
+// configured with the specified options. The Map is created with an initial
+// capacity of len(m) so that it does not need to grow while the entries are
+// inserted.
+func FromGoMap[K comparable, V any](m map[K]V, options ...option[K, V]) *Map[K, V] {
+	r := New[K, V](len(m), options...)
+	for k, v := range m {
+		r.Put(k, v)
+	}
+	return r
+}
+
+// NewFromSlices constructs a new Map containing the entries keys[i]:values[i],
+// configured with the specified options. The Map is created with an initial
+// capacity of len(keys) so that it does not need to grow while the entries
+// are inserted. If a key is repeated the last of its values is retained.
+// NewFromSlices returns an error if keys and values have different lengths.
+func NewFromSlices[K comparable, V any](
+	keys []K, values []V, options ...option[K, V],
+) (*Map[K, V], error) {
+	if len(keys) != len(values) {
+		return nil, fmt.Errorf("swiss: NewFromSlices: mismatched key and value counts: %d != %d",
+			len(keys), len(values))
+	}
+	m := New[K, V](len(keys), options...)
+	for i := range keys {
+		m.Put(keys[i], values[i])
+	}
+	return m, nil
+}
+
+// SizeFor returns the total capacity (the number of slots across all
+// buckets, as reported by Map.Cap) and the number of buckets of a map
+// constructed by New with an initial capacity of n and a max bucket capacity
+// of maxBucketCapacity (see WithMaxBucketCapacity), with the remaining
+// options at their defaults. This allows the memory used by a map to be
+// predicted, and maxBucketCapacity to be chosen, before the map is allocated.
+func SizeFor(n int, maxBucketCapacity uintptr) (capacity int, buckets uintptr) {
+	var m Map[struct{}, struct{}]
+	m.initOptions(WithMaxBucketCapacity[struct{}, struct{}](maxBucketCapacity))
+	bucketCapacity, globalDepth := m.initialSize(n)
+	buckets = uintptr(1) << globalDepth
+	return int(bucketCapacity * buckets), buckets
+}
+
 // Init initializes a Map with the specified initial capacity. If
 // initialCapacity is 0 the map will start out with zero capacity and will
-// grow on the first insert. The zero value for a Map is not usable and Init
-// must be called before using the map.
+// grow on the first insert. An initialCapacity too large to be allocated is
+// ignored. A zero value Map is initialized with the default
+// options on its first insertion (see Map), so Init only needs to be called in
+// order to specify an initial capacity or options.
 //
 // Init is intended for usage when a Map is embedded by value in another
 // structure.
 func (m *Map[K, V]) Init(initialCapacity int, options ...option[K, V]) {
+	m.initOptions(options...)
+	m.initBuckets(initialCapacity)
+
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.checkInvariants(m)
+		return true
+	})
+}
+
+// initOptions initializes the receiver as an empty map with no buckets
+// allocated, applying the specified options. See Init.
+func (m *Map[K, V]) initOptions(options ...option[K, V]) {
 	// The ctrls for an empty map points to emptyCtrls which simplifies
 	// probing in Get, Put, and Delete. The emptyCtrls never match a probe
 	// operation, but because growthLeft == 0 if we try to insert we'll
@@ -303,6 +500,7 @@ func (m *Map[K, V]) Init(initialCapacity int, options ...option[K, V]) {
 			ctrls: emptyCtrls,
 		},
 		maxBucketCapacity: defaultMaxBucketCapacity,
+		maxLoad:           defaultMaxLoad,
 	}
 
 	for _, op := range options {
@@ -313,44 +511,165 @@ func (m *Map[K, V]) Init(initialCapacity int, options ...option[K, V]) {
 		m.maxBucketCapacity = minBucketCapacity
 	}
 	m.maxBucketCapacity = normalizeCapacity(m.maxBucketCapacity)
+}
 
-	if initialCapacity > 0 {
-		// We consider initialCapacity to be an indication from the caller
-		// about the number of records the map should hold. The realized
-		// capacity of a map is 7/8 of the number of slots, so we set the
-		// target capacity to initialCapacity*8/7.
-		targetCapacity := uintptr((initialCapacity * groupSize) / maxAvgGroupLoad)
-		if targetCapacity <= m.maxBucketCapacity {
-			// Normalize targetCapacity to the smallest value of the form 2^k-1.
-			m.bucket0.init(m, normalizeCapacity(targetCapacity))
-		} else {
-			// If targetCapacity is larger than maxBucketCapacity we need to
-			// size the directory appropriately. We'll size each bucket to
-			// maxBucketCapacity and create enough buckets to hold
-			// initialCapacity.
-			nBuckets := (targetCapacity + m.maxBucketCapacity - 1) / m.maxBucketCapacity
-			globalDepth := uint(bits.Len64(uint64(nBuckets) - 1))
-			m.growDirectory(globalDepth)
-
-			n := m.bucketCount()
-			buckets := make([]bucket[K, V], n)
-
-			*m.dir.At(0) = &m.bucket0
-			for i := uintptr(1); i < n; i++ {
-				*m.dir.At(i) = &buckets[i]
-			}
+// lazyInit initializes a zero value Map with the default options. It is
+// called by operations which may insert into the map.
+func (m *Map[K, V]) lazyInit() {
+	if m.hash == nil {
+		m.Init(0)
+	}
+}
 
-			for i := uintptr(0); i < n; i++ {
-				b := *m.dir.At(i)
-				b.init(m, m.maxBucketCapacity)
-				b.localDepth = globalDepth
-				b.index = i
-			}
+// initialSize returns the capacity of each bucket and the global depth of the
+// directory that initBuckets uses for a map with the specified initial
+// capacity. A bucket capacity of 0 indicates that no buckets are allocated.
+func (m *Map[K, V]) initialSize(capacity int) (bucketCapacity uintptr, globalDepth uint) {
+	// A capacity for which the map cannot be allocated is ignored, as is the
+	// size hint passed to the builtin make.
+	if capacity > maxAlloc {
+		capacity = 0
+	}
+	if capacity <= 0 && m.initialBuckets <= 1 {
+		return 0, 0
+	}
+
+	// We consider capacity to be an indication from the caller
+	// about the number of records the map should hold. The realized
+	// capacity of a map is maxLoad (by default 7/8) of the number of slots,
+	// so we set the target capacity to capacity/maxLoad. The target is
+	// computed in 64 bits, which cannot overflow as capacity <= maxAlloc.
+	var targetCapacity uintptr
+	if capacity > 0 {
+		t := (uint64(capacity) << loadFactorShift) / uint64(m.maxLoad)
+		if t > maxAlloc {
+			return m.initialSize(0)
+		}
+		targetCapacity = uintptr(t)
+	}
+	if targetCapacity <= m.maxBucketCapacity && m.initialBuckets <= 1 {
+		// Normalize targetCapacity to the smallest value of the form 2^k-1,
+		// but no smaller than the minimum bucket capacity.
+		bucketCapacity = normalizeCapacity(max(targetCapacity, minBucketCapacity))
+		if !m.canAllocate(bucketCapacity, 0) {
+			return m.initialSize(0)
+		}
+		return bucketCapacity, 0
+	}
+
+	// If targetCapacity is larger than maxBucketCapacity we need to size the
+	// directory appropriately. We'll size each bucket to maxBucketCapacity
+	// and create enough buckets to hold capacity entries. Otherwise the map
+	// is being split into initialBuckets buckets and the target capacity is
+	// divided evenly between them.
+	nBuckets := max(m.initialBuckets, 1)
+	bucketCapacity = m.maxBucketCapacity
+	if targetCapacity > m.maxBucketCapacity {
+		nBuckets = max(nBuckets, (targetCapacity+m.maxBucketCapacity-1)/m.maxBucketCapacity)
+	}
+	globalDepth = uint(bits.Len64(uint64(nBuckets) - 1))
+
+	n := uintptr(1) << globalDepth
+	if targetCapacity <= m.maxBucketCapacity {
+		bucketCapacity = normalizeCapacity(max((targetCapacity+n-1)/n, minBucketCapacity))
+	}
+	if !m.canAllocate(bucketCapacity, globalDepth) {
+		return m.initialSize(0)
+	}
+	return bucketCapacity, globalDepth
+}
+
+// canAllocate returns true if 1<<globalDepth buckets with the specified
+// capacity fit within maxAlloc.
+func (m *Map[K, V]) canAllocate(bucketCapacity uintptr, globalDepth uint) bool {
+	var s Slot[K, V]
+	slotSize := unsafe.Sizeof(s) + 1 // including the control byte
+	return globalDepth < 64 && bucketCapacity <= (maxAlloc/slotSize)>>globalDepth
+}
+
+// initBuckets sizes an empty map so that it can hold capacity entries
+// without needing to grow. If capacity exceeds maxBucketCapacity the
+// directory is sized so that every bucket has maxBucketCapacity. The map is
+// split into at least initialBuckets buckets (see WithInitialBuckets).
+func (m *Map[K, V]) initBuckets(capacity int) {
+	bucketCapacity, globalDepth := m.initialSize(capacity)
+	if bucketCapacity == 0 {
+		return
+	}
+	if globalDepth == 0 {
+		m.bucket0.init(m, bucketCapacity)
+		return
+	}
+
+	m.growDirectory(globalDepth)
+	n := m.bucketCount()
+	buckets := make([]bucket[K, V], n)
+
+	*m.dir.At(0) = &m.bucket0
+	for i := uintptr(1); i < n; i++ {
+		*m.dir.At(i) = &buckets[i]
+	}
+
+	for i := uintptr(0); i < n; i++ {
+		b := *m.dir.At(i)
+		b.init(m, bucketCapacity)
+		b.localDepth = globalDepth
+		b.index = i
+	}
+
+	m.checkInvariants()
+}
+
+// resetBuckets resets the map to the empty, single bucket state. The caller
+// is responsible for releasing the memory of the existing buckets.
+func (m *Map[K, V]) resetBuckets() {
+	m.bucket0 = bucket[K, V]{
+		ctrls: emptyCtrls,
+	}
+	m.dir = makeUnsafeSlice([]*bucket[K, V](nil))
+	m.globalShift = 0
+}
+
+// rebuild reallocates the map so that it is laid out as if it had been
+// created with New(capacity), reinserting every entry into the new buckets and
+// releasing the old buckets back to the allocator.
+func (m *Map[K, V]) rebuild(capacity int) {
+	m.unshare()
+	// Snapshot the existing buckets by value. bucket0 is embedded in the Map
+	// and is reset below.
+	var old []bucket[K, V]
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.completeResize(m)
+		old = append(old, *b)
+		return true
+	})
 
-			m.checkInvariants()
+	m.resetBuckets()
+	m.initBuckets(capacity)
+
+	for i := range old {
+		ob := &old[i]
+		for j := uintptr(0); j < ob.capacity; j++ {
+			c := ob.ctrls.Get(j)
+			if c == ctrlEmpty || c == ctrlDeleted {
+				continue
+			}
+			slot := ob.slots.At(j)
+			h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
+			b := m.bucket(h)
+			if b.growthLeft == 0 {
+				// The entries may not be evenly distributed across the
+				// buckets sized by initBuckets.
+				b.rehash(m)
+				b = m.bucket(h)
+			}
+			b.uncheckedPut(h, slot.key, &slot.value)
+			b.used++
 		}
+		ob.close(m)
 	}
 
+	m.checkInvariants()
 	m.buckets(0, func(b *bucket[K, V]) bool {
 		b.checkInvariants(m)
 		return true
@@ -360,25 +679,286 @@ func (m *Map[K, V]) Init(initialCapacity int, options ...option[K, V]) {
 // Close closes the map, releasing any memory back to its configured
 // allocator. It is unnecessary to close a map using the default allocator. It
 // is invalid to use a Map after it has been closed, though Close itself is
-// idempotent.
+// idempotent. A closed map does not retain references to the released memory
+// or to the allocator: a closed map behaves as if it were empty, and memory
+// for entries inserted into it is allocated by the default allocator rather
+// than the configured one. Builds with the swiss_invariants tag panic on any
+// use of a closed map.
 func (m *Map[K, V]) Close() {
+	m.checkNotInCallback()
+	if m.closed {
+		return
+	}
+	// Memory shared with a snapshot is not released as it is still in use.
+	if !m.shared {
+		m.buckets(0, func(b *bucket[K, V]) bool {
+			b.close(m)
+			return true
+		})
+	}
+	m.resetBuckets()
+	m.used = 0
+	m.closed = true
+	m.shared = false
+	m.allocator = defaultAllocator[K, V]{}
+}
+
+// Clone returns a copy of the map. The copy has the same capacity, bucket
+// layout, and options (hash function, allocator, max bucket capacity, and
+// codec) as the original, but does not share any memory with it: the copy's
+// backing arrays are freshly allocated from the map's allocator. Mutating or
+// closing either map does not affect the other.
+func (m *Map[K, V]) Clone() *Map[K, V] {
+	c := &Map[K, V]{}
+	m.cloneInto(c)
+	return c
+}
+
+// cloneInto initializes c as a copy of the map. See Clone.
+func (m *Map[K, V]) cloneInto(c *Map[K, V]) {
+	c.initOptionsLike(m)
+	c.seed = m.seed
+	c.used = m.used
+	c.globalShift = m.globalShift
+
+	if m.globalShift == 0 {
+		c.bucket0 = m.bucket0.clone(c)
+		return
+	}
+
+	// Copy the directory, mapping each of the source buckets to its clone.
+	// Note that bucket0 is embedded in the Map and its clone must be embedded
+	// in the cloned Map.
+	c.dir = makeUnsafeSlice(make([]*bucket[K, V], m.bucketCount()))
+	var last, lastClone *bucket[K, V]
+	i := uintptr(0)
+	m.dirEntries(func(b *bucket[K, V]) bool {
+		if b != last {
+			last = b
+			if b == &m.bucket0 {
+				lastClone = &c.bucket0
+			} else {
+				lastClone = &bucket[K, V]{}
+			}
+			*lastClone = b.clone(c)
+		}
+		*c.dir.At(i) = lastClone
+		i++
+		return true
+	})
+
+	c.checkInvariants()
+}
+
+// CopyInto replaces the contents of dst with the entries of the map. dst is
+// cleared, retaining its capacity and options, and grown if it does not have
+// room for the entries. Copying into a reused dst of sufficient capacity
+// does not allocate, unlike Clone. Copying a map into itself is a noop.
+func (m *Map[K, V]) CopyInto(dst *Map[K, V]) {
+	if dst == m {
+		return
+	}
+	dst.Clear()
+	dst.Grow(m.Len())
+	m.All(func(key K, value V) bool {
+		dst.Put(key, value)
+		return true
+	})
+}
+
+// Snapshot returns an immutable snapshot of the map which may be read
+// concurrently with further mutation of the map, without locking. The
+// snapshot shares the backing arrays of the map, and the map makes itself a
+// private copy of them when it is next mutated. Only the bucket directory and
+// the small per-bucket headers are copied by Snapshot, so its cost is
+// proportional to the number of buckets rather than the number of entries. A
+// map which is repeatedly snapshotted and mutated copies its entries once per
+// snapshot, so snapshots are best suited to read-mostly maps.
+//
+// Mutating the snapshot panics, though it may be closed in order to drop its
+// references to the shared memory. Reads of the snapshot may be performed
+// concurrently with one another and with mutations of the map, but Snapshot
+// itself is a mutation of the map. Memory shared with a snapshot is never
+// released to the map's allocator.
+func (m *Map[K, V]) Snapshot() *Map[K, V] {
+	m.lazyInit()
+	s := &Map[K, V]{}
+	*s = *m
+	s.shared = true
+	s.snapshot = true
+	s.iterators = 0
+	s.deferredFrees = nil
+	if m.globalShift != 0 {
+		// The map continues to mutate its bucket headers in place (see
+		// unshareSlow), so the snapshot needs its own copies.
+		s.dir = makeUnsafeSlice(make([]*bucket[K, V], m.bucketCount()))
+		var last, lastCopy *bucket[K, V]
+		i := uintptr(0)
+		m.dirEntries(func(b *bucket[K, V]) bool {
+			if b != last {
+				last = b
+				if b == &m.bucket0 {
+					lastCopy = &s.bucket0
+				} else {
+					lastCopy = &bucket[K, V]{}
+					*lastCopy = *b
+				}
+			}
+			*s.dir.At(i) = lastCopy
+			i++
+			return true
+		})
+	}
+	m.shared = true
+	return s
+}
+
+// unshare copies the backing arrays of the map if they are shared with a
+// snapshot. It must be called before mutating the map.
+func (m *Map[K, V]) unshare() {
+	m.checkNotInCallback()
+	if m.shared {
+		m.unshareSlow()
+	}
+}
+
+// unshareSlow gives every bucket of the map its own copy of its ctrls and
+// slots, leaving the originals to the snapshots. The bucket headers are
+// updated in place as an iteration over the map may be in progress. See
+// unshare.
+func (m *Map[K, V]) unshareSlow() {
+	if m.snapshot {
+		panic("swiss: mutation of Map snapshot")
+	}
+	m.shared = false
 	m.buckets(0, func(b *bucket[K, V]) bool {
-		b.close(m.allocator)
+		*b = b.clone(m)
 		return true
 	})
+}
+
+// initLike initializes the receiver as an empty map with the same hash
+// function, allocator, and options as src, sized to hold capacity entries.
+// The receiver uses a new random seed unless src's seed was specified by
+// WithSeed.
+func (m *Map[K, V]) initLike(src *Map[K, V], capacity int) {
+	m.initOptionsLike(src)
+	m.initBuckets(capacity)
+}
+
+// initOptionsLike initializes the receiver as an empty map with no buckets
+// allocated and the same hash function, allocator, and options as src. See
+// initLike.
+func (m *Map[K, V]) initOptionsLike(src *Map[K, V]) {
+	*m = Map[K, V]{
+		hash:                   src.hash,
+		seed:                   src.seed,
+		fixedSeed:              src.fixedSeed,
+		autoReseed:             src.autoReseed,
+		incrementalResize:      src.incrementalResize,
+		deterministicIteration: src.deterministicIteration,
+		stableIteration:        src.stableIteration,
+		allocator:              src.allocator,
+		maxBucketCapacity:      src.maxBucketCapacity,
+		maxLoad:                src.maxLoad,
+		initialBuckets:         src.initialBuckets,
+		autoCompact:            src.autoCompact,
+		codec:                  src.codec,
+		valueHash:              src.valueHash,
+		bucket0: bucket[K, V]{
+			ctrls: emptyCtrls,
+		},
+	}
+	if !m.fixedSeed {
+		m.seed = uintptr(fastrand64())
+	}
+	if m.stableIteration {
+		m.iterationSeed = uintptr(fastrand64())
+	}
+}
 
-	m.allocator = nil
+// initKeyOptionsLike initializes dst as an empty map with no buckets
+// allocated and the same hash function and options as src, except for the
+// options which depend on the value type: dst uses the default allocator and
+// no codec. See MapValues.
+func initKeyOptionsLike[K comparable, V1, V2 any](dst *Map[K, V2], src *Map[K, V1]) {
+	*dst = Map[K, V2]{
+		hash:                   src.hash,
+		seed:                   src.seed,
+		fixedSeed:              src.fixedSeed,
+		autoReseed:             src.autoReseed,
+		incrementalResize:      src.incrementalResize,
+		deterministicIteration: src.deterministicIteration,
+		stableIteration:        src.stableIteration,
+		allocator:              defaultAllocator[K, V2]{},
+		maxBucketCapacity:      src.maxBucketCapacity,
+		maxLoad:                src.maxLoad,
+		initialBuckets:         src.initialBuckets,
+		autoCompact:            src.autoCompact,
+		bucket0: bucket[K, V2]{
+			ctrls: emptyCtrls,
+		},
+	}
+	if !dst.fixedSeed {
+		dst.seed = uintptr(fastrand64())
+	}
+	if dst.stableIteration {
+		dst.iterationSeed = uintptr(fastrand64())
+	}
 }
 
 // Put inserts an entry into the map, overwriting an existing value if an
-// entry with the same key already exists.
+// entry with the same key already exists. The value is copied into the map
+// once, directly into the slot which holds the entry; thereafter an entry is
+// copied once each time it is moved to a new table as the map grows. See
+// PutPtr for avoiding the copy of a large value passed to Put.
 func (m *Map[K, V]) Put(key K, value V) {
-	// Put is find composed with uncheckedPut. We perform find to see if the
+	m.lazyInit()
+	m.unshare()
+	m.put(key, m.hash(noescape(unsafe.Pointer(&key)), m.seed), &value)
+}
+
+// PutPtr is equivalent to Put(key, *value), but copies the value from *value
+// directly into the map rather than first copying it to pass it to Put, which
+// avoids a copy when V is a large struct. The map does not retain value.
+func (m *Map[K, V]) PutPtr(key K, value *V) {
+	m.lazyInit()
+	m.unshare()
+	m.put(key, m.hash(noescape(unsafe.Pointer(&key)), m.seed), value)
+}
+
+// Hash returns the hash of key under the map's hash function and seed. The
+// hash may be passed to PutHashed and GetHashed in order to avoid hashing the
+// key for each operation, such as when the same key is stored in several maps
+// which share a seed (see WithSeed). The hash remains valid for the map until
+// its seed changes, which happens on Clear, ClearAndShrink, Reset, and
+// Reseed unless the seed was specified by WithSeed, and on automatic
+// reseeding (see WithAutoReseed). Hash initializes a zero value Map.
+func (m *Map[K, V]) Hash(key K) uintptr {
+	m.lazyInit()
+	return m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+}
+
+// PutHashed is equivalent to Put, but uses h, which must be the value of
+// Hash(key), rather than hashing key. Passing any other hash corrupts the
+// map: the entry is stored where lookups of key will not find it, and key
+// may end up present in the map more than once.
+func (m *Map[K, V]) PutHashed(key K, h uintptr, value V) {
+	m.lazyInit()
+	m.unshare()
+	if invariants && h != m.Hash(key) {
+		panic(fmt.Sprintf("invariant failed: hash %#x does not match key %v", h, key))
+	}
+	m.put(key, h, &value)
+}
+
+// put implements Put for the key with hash h, copying the value from *value.
+func (m *Map[K, V]) put(key K, h uintptr, value *V) {
+	// put is find composed with uncheckedPut. We perform find to see if the
 	// key is already present. If it is, we're done and overwrite the existing
 	// value. If the value isn't present we perform an uncheckedPut which
 	// inserts an entry known not to be in the table (violating this
 	// requirement will cause the table to behave erratically).
-	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
 	b := m.bucket(h)
 
 	// NB: Unlike the abseil swiss table implementation which uses a common
@@ -396,7 +976,7 @@ func (m *Map[K, V]) Put(key K, value V) {
 			i := seq.offsetAt(slotIdx)
 			slot := b.slots.At(i)
 			if key == slot.key {
-				slot.value = value
+				slot.value = *value
 				b.checkInvariants(m)
 				return
 			}
@@ -408,13 +988,20 @@ func (m *Map[K, V]) Put(key K, value V) {
 			// Finding an empty slot means we've reached the end of the probe
 			// sequence.
 
+			// If the bucket is being incrementally resized, the key may be
+			// present in the old table.
+			if b.old != nil {
+				m.putMigrating(h, key, value)
+				return
+			}
+
 			// If there is room left to grow in the bucket and we're at the
 			// start of the probe sequence we can just insert the new entry.
 			if b.growthLeft > 0 && seq.offset == startOffset {
 				i := seq.offsetAt(match.first())
 				slot := b.slots.At(i)
 				slot.key = key
-				slot.value = value
+				slot.value = *value
 				b.setCtrl(i, ctrl(h2(h)))
 				b.growthLeft--
 				b.used++
@@ -423,6 +1010,10 @@ func (m *Map[K, V]) Put(key K, value V) {
 				return
 			}
 
+			// The number of groups examined before reaching the end of the
+			// probe sequence.
+			probeLen := seq.index/groupSize + 1
+
 			// Find the first empty or deleted slot in the key's probe
 			// sequence.
 			seq := makeProbeSeq(h1(h), b.capacity)
@@ -438,7 +1029,7 @@ func (m *Map[K, V]) Put(key K, value V) {
 					if b.growthLeft > 0 || b.ctrls.Get(i) == ctrlDeleted {
 						slot := b.slots.At(i)
 						slot.key = key
-						slot.value = value
+						slot.value = *value
 						if b.ctrls.Get(i) == ctrlEmpty {
 							b.growthLeft--
 						}
@@ -446,6 +1037,7 @@ func (m *Map[K, V]) Put(key K, value V) {
 						b.used++
 						m.used++
 						b.checkInvariants(m)
+						m.maybeReseed(probeLen)
 						return
 					}
 					break
@@ -470,6 +1062,7 @@ func (m *Map[K, V]) Put(key K, value V) {
 			b.used++
 			m.used++
 			b.checkInvariants(m)
+			m.maybeReseed(probeLen)
 			return
 		}
 	}
@@ -478,7 +1071,27 @@ func (m *Map[K, V]) Put(key K, value V) {
 // Get retrieves the value from the map for the specified key, returning
 // ok=false if the key is not present.
 func (m *Map[K, V]) Get(key K) (value V, ok bool) {
-	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	if m.hash == nil {
+		return value, false
+	}
+	return m.get(key, m.hash(noescape(unsafe.Pointer(&key)), m.seed))
+}
+
+// GetHashed is equivalent to Get, but uses h, which must be the value of
+// Hash(key), rather than hashing key. If h is not the hash of key, GetHashed
+// may report that key is not present when it is.
+func (m *Map[K, V]) GetHashed(key K, h uintptr) (value V, ok bool) {
+	if m.hash == nil {
+		return value, false
+	}
+	if invariants && h != m.Hash(key) {
+		panic(fmt.Sprintf("invariant failed: hash %#x does not match key %v", h, key))
+	}
+	return m.get(key, h)
+}
+
+// get implements Get for the key with hash h.
+func (m *Map[K, V]) get(key K, h uintptr) (value V, ok bool) {
 	b := m.bucket(h)
 
 	// NB: Unlike the abseil swiss table implementation which uses a common
@@ -528,22 +1141,37 @@ func (m *Map[K, V]) Get(key K) (value V, ok bool) {
 
 		match = g.matchEmpty()
 		if match != 0 {
+			if b.old != nil {
+				if i, ok := b.old.findOld(h, key); ok {
+					return b.old.slots.At(i).value, true
+				}
+			}
 			return value, false
 		}
 	}
 }
 
-// Delete deletes the entry corresponding to the specified key from the map.
-// It is a noop to delete a non-existent key.
-func (m *Map[K, V]) Delete(key K) {
-	// Delete is find composed with "deleted at": we perform find(key), and
-	// then delete at the resulting slot if found.
+// GetOrDefault returns the value stored for the key, or def if the key is not
+// present in the map.
+func (m *Map[K, V]) GetOrDefault(key K, def V) V {
+	if v, ok := m.Get(key); ok {
+		return v
+	}
+	return def
+}
+
+// Contains returns true if the key is present in the map. Unlike Get,
+// Contains never loads the value stored for the key which avoids copying large
+// values.
+func (m *Map[K, V]) Contains(key K) bool {
+	if m.hash == nil {
+		return false
+	}
 	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
 	b := m.bucket(h)
 
-	// NB: Unlike the abseil swiss table implementation which uses a common
-	// find routine for Get, Put, and Delete, we have to manually inline the
-	// find routine for performance.
+	// NB: This is the same probe loop as Get, except that we return before
+	// loading the slot's value.
 	seq := makeProbeSeq(h1(h), b.capacity)
 	for ; ; seq = seq.next() {
 		g := b.ctrls.GroupAt(seq.offset)
@@ -552,104 +1180,1469 @@ func (m *Map[K, V]) Delete(key K) {
 		for match != 0 {
 			slotIdx := match.first()
 			i := seq.offsetAt(slotIdx)
-			s := b.slots.At(i)
-			if key == s.key {
-				b.used--
-				m.used--
-				*s = Slot[K, V]{}
-
-				// Given an offset to delete we simply create a tombstone and
-				// destroy its contents and mark the ctrl as deleted. If we
-				// can prove that the slot would not appear in a probe
-				// sequence we can mark the slot as empty instead. We can
-				// prove this by checking to see if the slot is part of any
-				// group that could have been full (assuming we never create
-				// an empty slot in a group with no empties which this
-				// heuristic guarantees we never do). If the slot is always
-				// parts of groups that could never have been full then find
-				// would stop at this slot since we do not probe beyond groups
-				// with empties.
-				if b.wasNeverFull(i) {
-					b.setCtrl(i, ctrlEmpty)
-					b.growthLeft++
-				} else {
-					b.setCtrl(i, ctrlDeleted)
-				}
-				b.checkInvariants(m)
-				return
+			if key == b.slots.At(i).key {
+				return true
 			}
 			match = match.remove(slotIdx)
 		}
 
 		match = g.matchEmpty()
 		if match != 0 {
-			b.checkInvariants(m)
-			return
+			if b.old != nil {
+				_, ok := b.old.findOld(h, key)
+				return ok
+			}
+			return false
 		}
 	}
 }
 
-// Clear deletes all entries from the map resulting in an empty map.
-func (m *Map[K, V]) Clear() {
-	m.buckets(0, func(b *bucket[K, V]) bool {
-		for i := uintptr(0); i < b.capacity; i++ {
-			b.setCtrl(i, ctrlEmpty)
-			*b.slots.At(i) = Slot[K, V]{}
+// GetPtr returns a pointer to the value stored for the key, or nil if the key
+// is not present. The pointer allows the value to be mutated in place without
+// a Get/Put round trip:
+//
+//	if p := m.GetPtr(k); p != nil {
+//		*p++
+//	}
+//
+// The returned pointer refers directly to the map's internal storage and is
+// invalidated by any subsequent mutation of the map (Put, Delete, Clear, etc.)
+// as the mutation may move entries within or between the map's backing
+// arrays. An invalidated pointer may refer to a different entry or to memory
+// no longer used by the map: the backing arrays released by a resize are
+// returned to the map's allocator (once any iteration via All in progress
+// finishes), which may reuse them. In invariants builds, released backing
+// arrays left to the garbage collector are poisoned, so that reading through
+// an invalidated pointer yields a recognizably bad value.
+func (m *Map[K, V]) GetPtr(key K) *V {
+	if slot := m.getSlot(key); slot != nil {
+		return &slot.value
+	}
+	return nil
+}
+
+// GetEntry returns pointers to the key and value stored for the key, or
+// ok=false if the key is not present. The stored key is equal to key, but
+// need not be the same copy, which allows the map to serve as the source of
+// truth for canonical copies of keys when interning or deduplicating large
+// keys. The stored key must not be modified via the returned pointer, while
+// the value may be mutated in place as with GetPtr. The returned pointers are
+// invalidated by any subsequent mutation of the map. See GetPtr.
+func (m *Map[K, V]) GetEntry(key K) (storedKey *K, value *V, ok bool) {
+	if slot := m.getSlot(key); slot != nil {
+		return &slot.key, &slot.value, true
+	}
+	return nil, nil, false
+}
+
+// getSlot returns a pointer to the slot storing the key, or nil if the key is
+// not present. See GetPtr.
+func (m *Map[K, V]) getSlot(key K) *Slot[K, V] {
+	if m.hash == nil {
+		return nil
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b := m.bucket(h)
+
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for ; ; seq = seq.next() {
+		g := b.ctrls.GroupAt(seq.offset)
+		match := g.matchH2(h2(h))
+
+		for match != 0 {
+			slotIdx := match.first()
+			i := seq.offsetAt(slotIdx)
+			slot := b.slots.At(i)
+			if key == slot.key {
+				return slot
+			}
+			match = match.remove(slotIdx)
 		}
 
-		b.used = 0
-		b.resetGrowthLeft()
-		return true
-	})
+		match = g.matchEmpty()
+		if match != 0 {
+			if b.old != nil {
+				if i, ok := b.old.findOld(h, key); ok {
+					return b.old.slots.At(i)
+				}
+			}
+			return nil
+		}
+	}
+}
 
-	// Reset the hash seed to make it more difficult for attackers to
-	// repeatedly trigger hash collisions. See issue
-	// https://github.com/golang/go/issues/25237.
-	m.seed = uintptr(fastrand64())
-	m.used = 0
+// GetOrPut returns the existing value for the key if present. Otherwise, it
+// inserts the given value. The loaded result is true if the value was loaded,
+// false if inserted. GetOrPut performs a single probe of the map regardless of
+// whether the key is present.
+func (m *Map[K, V]) GetOrPut(key K, value V) (actual V, loaded bool) {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		return b.slots.At(i).value, true
+	}
+	m.insertAt(h, b, i, key, &value)
+	return value, false
 }
 
-// All calls yield sequentially for each key and value present in the map. If
-// yield returns false, range stops the iteration. The map can be mutated
-// during iteration, though there is no guarantee that the mutations will be
-// visible to the iteration.
+// GetOrCompute returns the existing value for the key if present. Otherwise,
+// it calls fn to compute a value and inserts it. The loaded result is true if
+// the value was loaded, false if computed and inserted. fn is only called if
+// the key is not present. If fn panics the map is left unmodified.
+//
+// fn must not modify the map, including by a nested call to GetOrCompute: the
+// entry is inserted into the slot located before fn is called, which a
+// modification may move or reuse, corrupting the map. In invariants builds a
+// modification of the map by fn panics.
+func (m *Map[K, V]) GetOrCompute(key K, fn func() V) (actual V, loaded bool) {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		return b.slots.At(i).value, true
+	}
+	// NB: find has located the slot to insert into, but has not modified the
+	// map, so a panic in fn leaves the map untouched.
+	if invariants {
+		defer m.enterCallback()()
+	}
+	value := fn()
+	m.insertAt(h, b, i, key, &value)
+	return value, false
+}
+
+// Swap stores the value for the key and returns the previous value if any.
+// The loaded result reports whether the key was present. If the key was not
+// present, previous is the zero value.
+func (m *Map[K, V]) Swap(key K, value V) (previous V, loaded bool) {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		slot := b.slots.At(i)
+		previous, slot.value = slot.value, value
+		return previous, true
+	}
+	m.insertAt(h, b, i, key, &value)
+	return previous, false
+}
+
+// PutReturningInserted inserts an entry into the map, overwriting an existing
+// value if an entry with the same key already exists, and reports whether the
+// key was newly inserted. The map is probed once regardless of the result.
+func (m *Map[K, V]) PutReturningInserted(key K, value V) (inserted bool) {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		b.slots.At(i).value = value
+		return false
+	}
+	m.insertAt(h, b, i, key, &value)
+	return true
+}
+
+// CompareAndSwap stores new for key if key is present in the map and its
+// current value is equal to old. It reports whether the swap was performed.
+// The comparison and store are performed with a single probe of the map.
+// CompareAndSwap is a function rather than a method because it requires V to
+// be comparable.
+func CompareAndSwap[K comparable, V comparable](m *Map[K, V], key K, old, new V) (swapped bool) {
+	if m.hash == nil {
+		return false
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if !found {
+		return false
+	}
+	slot := b.slots.At(i)
+	if slot.value != old {
+		return false
+	}
+	slot.value = new
+	return true
+}
+
+// Update applies fn to the value stored for the key and stores the result,
+// returning true. If the key is not present, fn is not called and Update
+// returns false. If fn panics the stored value is left unmodified.
+//
+// fn must not modify the map: the result is stored in the slot located before
+// fn is called, which a modification may move or reuse, corrupting the map.
+// In invariants builds a modification of the map by fn panics.
+func (m *Map[K, V]) Update(key K, fn func(old V) V) bool {
+	if m.hash == nil {
+		return false
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if !found {
+		return false
+	}
+	if invariants {
+		defer m.enterCallback()()
+	}
+	slot := b.slots.At(i)
+	slot.value = fn(slot.value)
+	return true
+}
+
+// Accumulate stores add(existing, delta) for the key if it is present in the
+// map, and otherwise inserts delta, returning the value stored. It is useful
+// for aggregations such as counting, which would otherwise require a Get
+// followed by a Put:
 //
-// TODO(peter): The naming of All and its signature are meant to conform to
-// the range-over-function Go proposal. When that proposal is accepted (which
-// seems likely), we'll be able to iterate over the map by doing:
+//	m.Accumulate(word, 1, func(a, b int) int { return a + b })
 //
-//	for k, v := range m.All {
-//	  fmt.Printf("%v: %v\n", k, v)
-//	}
+// Accumulate performs a single probe of the map regardless of whether the key
+// is present. If add panics the stored value is left unmodified.
 //
-// See https://github.com/golang/go/issues/61897.
-func (m *Map[K, V]) All(yield func(key K, value V) bool) {
-	// Randomize iteration order by starting iteration at a random bucket and
-	// within each bucket at a random offset.
-	offset := uintptr(fastrand64())
-	m.buckets(offset>>32, func(b *bucket[K, V]) bool {
+// add must not modify the map: the result is stored in the slot located
+// before add is called, which a modification may move or reuse, corrupting
+// the map. In invariants builds a modification of the map by add panics.
+func (m *Map[K, V]) Accumulate(key K, delta V, add func(a, b V) V) V {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		if invariants {
+			defer m.enterCallback()()
+		}
+		slot := b.slots.At(i)
+		slot.value = add(slot.value, delta)
+		return slot.value
+	}
+	m.insertAt(h, b, i, key, &delta)
+	return delta
+}
+
+// Append appends elems to the slice stored for the key, inserting a new slice
+// containing elems if the key is not present, and returns the resulting slice.
+// It is equivalent to:
+//
+//	v, _ := m.Get(key)
+//	m.Put(key, append(v, elems...))
+//
+// but performs a single probe of the map and appends to the stored slice in
+// place. Append is a function rather than a method because it requires the
+// values to be slices.
+func Append[K comparable, E any](m *Map[K, []E], key K, elems ...E) []E {
+	m.lazyInit()
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if found {
+		slot := b.slots.At(i)
+		slot.value = append(slot.value, elems...)
+		return slot.value
+	}
+	value := append([]E(nil), elems...)
+	return m.insertAt(h, b, i, key, &value).value
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key. The key and value of the deleted
+// entry are cleared from their slot, so the map does not keep objects they
+// reference alive. This applies to all of the ways of deleting entries, with
+// one exception: while a bucket is being incrementally resized (see
+// WithIncrementalResize), its old table retains entries which have been
+// migrated until the resize of the bucket completes.
+func (m *Map[K, V]) Delete(key K) {
+	// Delete is find composed with deleteAt: we perform find(key), and then
+	// delete at the resulting slot if found.
+	if m.hash == nil {
+		return
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b := m.bucket(h)
+
+	// NB: Unlike the abseil swiss table implementation which uses a common
+	// find routine for Get, Put, and Delete, we have to manually inline the
+	// find routine for performance.
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for ; ; seq = seq.next() {
+		g := b.ctrls.GroupAt(seq.offset)
+		match := g.matchH2(h2(h))
+
+		for match != 0 {
+			slotIdx := match.first()
+			i := seq.offsetAt(slotIdx)
+			s := b.slots.At(i)
+			if key == s.key {
+				b.deleteAt(m, i)
+				if b.old != nil {
+					b.migrate(m, migrateSlots)
+				}
+				return
+			}
+			match = match.remove(slotIdx)
+		}
+
+		match = g.matchEmpty()
+		if match != 0 {
+			if b.old != nil {
+				if i, ok := b.old.findOld(h, key); ok {
+					b.old.deleteAt(m, i)
+				}
+				b.migrate(m, migrateSlots)
+			}
+			b.checkInvariants(m)
+			return
+		}
+	}
+}
+
+// Pop deletes the entry corresponding to the specified key from the map,
+// returning the deleted value and ok=true if the key was present.
+func (m *Map[K, V]) Pop(key K) (value V, ok bool) {
+	if m.hash == nil {
+		return value, false
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if !found {
+		return value, false
+	}
+	value = b.slots.At(i).value
+	b.deleteAt(m, i)
+	return value, true
+}
+
+// PopAny deletes an arbitrary entry from the map, returning the deleted key
+// and value and ok=true if the map was not empty. The entry chosen is not
+// uniformly random (see RandomElement for that). PopAny is useful for
+// draining a map used as a work list:
+//
+//	for k, v, ok := m.PopAny(); ok; k, v, ok = m.PopAny() {
+//	  ...
+//	}
+func (m *Map[K, V]) PopAny() (key K, value V, ok bool) {
+	if m.used == 0 {
+		return key, value, false
+	}
+	m.unshare()
+
+	// Start the search at a random bucket and within the bucket at a random
+	// slot so that the slots emptied by previous calls do not need to be
+	// scanned over and over again.
+	offset := uintptr(fastrand64())
+	m.buckets(offset>>32, func(b *bucket[K, V]) bool {
+		if b.old != nil && b.old.used > 0 {
+			b = b.old
+		} else if b.used == 0 {
+			return true
+		}
+		n := b.capacity - b.migrated
+		for k := uintptr(0); k < n; k++ {
+			i := b.migrated + (offset+k)%n
+			if (b.ctrls.Get(i) & ctrlEmpty) != ctrlEmpty {
+				s := b.slots.At(i)
+				key, value, ok = s.key, s.value, true
+				b.deleteAt(m, i)
+				return false
+			}
+		}
+		panic(fmt.Sprintf("bucket %d: found no entries", b.index))
+	})
+	return key, value, ok
+}
+
+// CompareAndDelete deletes the entry for key if key is present in the map and
+// its current value is equal to old. It reports whether the entry was deleted.
+// Like CompareAndSwap, CompareAndDelete is a function rather than a method
+// because it requires V to be comparable.
+func CompareAndDelete[K comparable, V comparable](m *Map[K, V], key K, old V) (deleted bool) {
+	if m.hash == nil {
+		return false
+	}
+	m.unshare()
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b, i, found := m.find(h, key)
+	if !found || b.slots.At(i).value != old {
+		return false
+	}
+	b.deleteAt(m, i)
+	return true
+}
+
+// DeleteAll deletes the entries corresponding to each of the specified keys
+// from the map, returning the number of entries deleted. Keys which are not
+// present are ignored.
+func (m *Map[K, V]) DeleteAll(keys ...K) int {
+	n := m.used
+	for _, key := range keys {
+		m.Delete(key)
+	}
+	return n - m.used
+}
+
+// DeleteAllAndCompact is like DeleteAll, but additionally compacts each
+// bucket in which the deletions leave enough tombstones that an insertion
+// into the full bucket would compact it (see WithAutoCompact). This restores
+// the probe lengths of lookups after a large batch of deletions without
+// waiting for insertions to fill the buckets, and without paying to compact
+// buckets with few tombstones as Compact does.
+func (m *Map[K, V]) DeleteAllAndCompact(keys ...K) int {
+	n := m.DeleteAll(keys...)
+	if n == 0 {
+		return 0
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		// See Stats for the computation of the number of tombstones.
+		tombstones := b.tombstones(m) - uintptr(b.growthLeft)
+		if tombstones > 0 && tombstones >= m.compactThreshold(b.capacity) {
+			b.completeResize(m)
+			b.rehashInPlace(m)
+		}
+		return true
+	})
+	return n
+}
+
+// DeleteFunc deletes every entry from the map for which del returns true. The
+// deletion is performed in a single pass over the map. del must not mutate the
+// map.
+func (m *Map[K, V]) DeleteFunc(del func(key K, value V) bool) {
+	m.unshare()
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.completeResize(m)
+
+		// Deleting an entry only changes the control byte of the deleted slot
+		// (to empty or deleted) and never moves other entries, so we can walk
+		// the live control bytes directly.
+		for i := uintptr(0); i < b.capacity && b.used > 0; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			s := b.slots.At(i)
+			if del(s.key, s.value) {
+				b.deleteAt(m, i)
+			}
+		}
+		return true
+	})
+}
+
+// Action specifies what AllMutable does with an entry after visiting it.
+type Action int
+
+const (
+	// ActionKeep keeps the entry, including any modification of its value,
+	// and continues iteration.
+	ActionKeep Action = iota
+	// ActionDelete deletes the entry and continues iteration.
+	ActionDelete
+	// ActionStop keeps the entry, including any modification of its value,
+	// and stops iteration.
+	ActionStop
+)
+
+// AllMutable calls fn sequentially for each key and value present in the
+// map, passing a pointer to the value which may be used to modify it in
+// place. The Action returned by fn determines whether the entry is kept or
+// deleted and whether iteration continues. Every entry present when
+// AllMutable is called is visited exactly once unless iteration is stopped.
+// fn must not mutate the map other than through the value pointer.
+func (m *Map[K, V]) AllMutable(fn func(key K, value *V) Action) {
+	m.unshare()
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.completeResize(m)
+
+		// As in DeleteFunc, deleting an entry only changes the control byte
+		// of the deleted slot and never moves other entries, so we can walk
+		// the live control bytes directly.
+		for i := uintptr(0); i < b.capacity && b.used > 0; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			s := b.slots.At(i)
+			switch fn(s.key, &s.value) {
+			case ActionDelete:
+				b.deleteAt(m, i)
+			case ActionStop:
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// Filter returns a new map containing the entries of the map for which keep
+// returns true. The map itself is not modified. The returned map has the same
+// options as the map and its memory is allocated from the map's allocator.
+// Since the number of entries kept is not known in advance, the returned map
+// is initially sized to hold half of the map's entries. keep must not mutate
+// the map.
+func (m *Map[K, V]) Filter(keep func(key K, value V) bool) *Map[K, V] {
+	r := &Map[K, V]{}
+	r.initLike(m, m.Len()/2)
+	m.All(func(key K, value V) bool {
+		if keep(key, value) {
+			r.Put(key, value)
+		}
+		return true
+	})
+	return r
+}
+
+// CountFunc returns the number of entries in the map for which pred returns
+// true. The entries are visited in a single iteration and no intermediate
+// slice or map is built. The map must not be mutated by pred.
+func (m *Map[K, V]) CountFunc(pred func(key K, value V) bool) int {
+	var n int
+	m.All(func(key K, value V) bool {
+		if pred(key, value) {
+			n++
+		}
+		return true
+	})
+	return n
+}
+
+// Any returns true if pred returns true for any entry in the map. Iteration
+// stops at the first such entry. Any returns false for an empty map. The map
+// must not be mutated by pred.
+func (m *Map[K, V]) Any(pred func(key K, value V) bool) bool {
+	var found bool
+	m.All(func(key K, value V) bool {
+		found = pred(key, value)
+		return !found
+	})
+	return found
+}
+
+// Every returns true if pred returns true for every entry in the map.
+// Iteration stops at the first entry for which pred returns false. Every
+// returns true for an empty map. The map must not be mutated by pred.
+func (m *Map[K, V]) Every(pred func(key K, value V) bool) bool {
+	every := true
+	m.All(func(key K, value V) bool {
+		every = pred(key, value)
+		return every
+	})
+	return every
+}
+
+// MapValues returns a new map with the same keys as src, where the value for
+// each key is the result of calling f with the key and its value in src. f is
+// called exactly once per entry. The returned map is sized to hold src.Len()
+// entries so that it does not need to grow while it is populated.
+//
+// The returned map uses the same hash function and the options of src which
+// do not depend on the value type (seed, max bucket capacity, max load
+// factor, initial buckets, auto-reseeding, auto-compaction, incremental
+// resizing, and deterministic and stable random iteration). Since the
+// allocator and codec are specific to the value type, the returned map uses
+// the default allocator and no codec. MapValues is a function rather than a
+// method because methods cannot have type parameters.
+func MapValues[K comparable, V1, V2 any](src *Map[K, V1], f func(key K, value V1) V2) *Map[K, V2] {
+	dst := &Map[K, V2]{}
+	initKeyOptionsLike(dst, src)
+	dst.initBuckets(src.Len())
+
+	src.All(func(key K, value V1) bool {
+		dst.Put(key, f(key, value))
+		return true
+	})
+	return dst
+}
+
+// Equal reports whether m and other contain the same keys mapped to equal
+// values. Equal is a function rather than a method because it requires V to
+// be comparable. See Map.EqualFunc for maps with non-comparable values.
+func Equal[K comparable, V comparable](m, other *Map[K, V]) bool {
+	return m.EqualFunc(other, func(a, b V) bool {
+		return a == b
+	})
+}
+
+// EqualFunc reports whether the map and other contain the same keys mapped to
+// values for which eq returns true. The maps are first compared by length,
+// and then the entries of the map are looked up in other. EqualFunc does not
+// allocate.
+func (m *Map[K, V]) EqualFunc(other *Map[K, V], eq func(a, b V) bool) bool {
+	if m == other {
+		return true
+	}
+	if m.Len() != other.Len() {
+		return false
+	}
+	equal := true
+	m.All(func(key K, value V) bool {
+		v, ok := other.Get(key)
+		equal = ok && eq(value, v)
+		return equal
+	})
+	return equal
+}
+
+// Fingerprint returns an order-independent hash of the entries in the map,
+// combining the hash of each key (under the map's hash function) with the
+// hash of its value (under the function specified by WithValueHash). Maps
+// with the same hash functions and equal entries have equal fingerprints,
+// regardless of their seeds, capacities, bucket layouts, and the order in
+// which the entries were inserted, so the fingerprint can be used to detect
+// whether a map has changed without retaining a copy of it. Distinct maps
+// may collide, with a probability determined by the quality of the hash
+// functions. Fingerprint visits every entry and panics if no value hash was
+// specified.
+func (m *Map[K, V]) Fingerprint() uint64 {
+	if m.valueHash == nil {
+		panic("swiss: Fingerprint: no value hash specified (see WithValueHash)")
+	}
+	// The sum of the mixed hashes of the entries is independent of the order
+	// in which they are visited. A fixed seed is used so that the result does
+	// not depend on the map's seed.
+	const seed = 0
+	var sum uint64
+	m.All(func(key K, value V) bool {
+		kh := uint64(m.hash(noescape(unsafe.Pointer(&key)), seed))
+		vh := uint64(m.valueHash(&value, seed))
+		sum += mix64(mix64(kh) + vh)
+		return true
+	})
+	return sum
+}
+
+// mix64 is the finalizer of the splitmix64 generator, a bijection on uint64
+// which distributes the bits of its input across the result.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// Merge inserts every entry from other into the map, overwriting the value of
+// any key present in both maps. Merging a map into itself is a noop. Room for
+// other.Len() additional entries is reserved before the entries are inserted
+// (see Grow), so that the map grows at most once. This over-reserves if the
+// keys of the two maps overlap.
+func (m *Map[K, V]) Merge(other *Map[K, V]) {
+	if other == m {
+		return
+	}
+	m.Grow(other.Len())
+	other.All(func(key K, value V) bool {
+		m.Put(key, value)
+		return true
+	})
+}
+
+// MergeFunc inserts every entry from other into the map. For keys present in
+// both maps, combine is called with the key, the existing value, and the
+// incoming value from other, and the result is stored. combine is only called
+// for such collisions. Merging a map into itself calls combine for every entry
+// with identical existing and incoming values. As with Merge, room for
+// other.Len() additional entries is reserved before merging a distinct map.
+func (m *Map[K, V]) MergeFunc(other *Map[K, V], combine func(key K, existing, incoming V) V) {
+	m.unshare()
+	if other == m {
+		// Every key collides with itself. Update the values in place which
+		// does not alter the structure of the map.
+		m.buckets(0, func(b *bucket[K, V]) bool {
+			b.completeResize(m)
+			for i := uintptr(0); i < b.capacity; i++ {
+				if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+					continue
+				}
+				s := b.slots.At(i)
+				s.value = combine(s.key, s.value, s.value)
+			}
+			return true
+		})
+		return
+	}
+
+	m.lazyInit()
+	m.Grow(other.Len())
+	other.All(func(key K, value V) bool {
+		h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+		b, i, found := m.find(h, key)
+		if found {
+			s := b.slots.At(i)
+			s.value = combine(key, s.value, value)
+		} else {
+			m.insertAt(h, b, i, key, &value)
+		}
+		return true
+	})
+}
+
+// Difference returns a new map containing the entries of a whose keys are not
+// present in b. The new map has the same options as a. If b is the smaller of
+// the two maps, a is cloned and the keys of b are deleted from the clone, so
+// that only the smaller map is probed against the larger; the result then has
+// the capacity of a.
+func Difference[K comparable, V any](a, b *Map[K, V]) *Map[K, V] {
+	a.lazyInit()
+	b.lazyInit()
+	if b.Len() < a.Len() {
+		r := a.Clone()
+		b.AllKeys(func(key K) bool {
+			r.Delete(key)
+			return true
+		})
+		return r
+	}
+	r := &Map[K, V]{}
+	r.initLike(a, a.Len())
+	a.All(func(key K, value V) bool {
+		if !b.Contains(key) {
+			r.Put(key, value)
+		}
+		return true
+	})
+	return r
+}
+
+// SymmetricDifference returns a new map containing the entries of a and of b
+// whose keys are present in exactly one of the two maps. The new map has the
+// same options as a. If b is no larger than a, a is cloned and each entry of b
+// is either deleted from or inserted into the clone, so that only the smaller
+// map is probed against the larger.
+func SymmetricDifference[K comparable, V any](a, b *Map[K, V]) *Map[K, V] {
+	a.lazyInit()
+	b.lazyInit()
+	if b.Len() <= a.Len() {
+		r := a.Clone()
+		b.All(func(key K, value V) bool {
+			if a.Contains(key) {
+				r.Delete(key)
+			} else {
+				r.Put(key, value)
+			}
+			return true
+		})
+		return r
+	}
+	r := &Map[K, V]{}
+	r.initLike(a, a.Len()+b.Len())
+	a.All(func(key K, value V) bool {
+		if !b.Contains(key) {
+			r.Put(key, value)
+		}
+		return true
+	})
+	b.All(func(key K, value V) bool {
+		if !a.Contains(key) {
+			r.Put(key, value)
+		}
+		return true
+	})
+	return r
+}
+
+// Clear deletes all entries from the map resulting in an empty map.
+func (m *Map[K, V]) Clear() {
+	m.unshare()
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.old != nil {
+			b.old.close(m)
+			b.old = nil
+		}
+		for i := uintptr(0); i < b.capacity; i++ {
+			b.setCtrl(i, ctrlEmpty)
+			*b.slots.At(i) = Slot[K, V]{}
+		}
+
+		b.used = 0
+		b.resetGrowthLeft(m)
+		return true
+	})
+
+	// Reset the hash seed to make it more difficult for attackers to
+	// repeatedly trigger hash collisions. See issue
+	// https://github.com/golang/go/issues/25237. A seed specified by WithSeed
+	// is retained.
+	if !m.fixedSeed {
+		m.seed = uintptr(fastrand64())
+	}
+	m.used = 0
+}
+
+// Grow ensures the map has room for n more entries beyond its current Len()
+// without needing to grow, sizing the map in the same manner as New does for
+// an initial capacity of Len()+n. Grow is a no-op if the map already has room
+// for n more entries. Note that when the map contains multiple buckets, room
+// is accounted for across all of the buckets and inserting n entries may
+// still cause an individual bucket to split if the entries are not evenly
+// distributed. Like an initial capacity, an n too large to be allocated is
+// ignored.
+func (m *Map[K, V]) Grow(n int) {
+	if n <= 0 || n > maxAlloc-m.used {
+		return
+	}
+	m.lazyInit()
+	m.unshare()
+
+	var growthLeft int
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		growthLeft += b.growthLeft
+		if b.old != nil {
+			// Room is reserved for the entries yet to be migrated.
+			growthLeft -= b.old.used
+		}
+		return true
+	})
+	if growthLeft >= n {
+		return
+	}
+
+	m.rebuild(m.used + n)
+}
+
+// Reseed picks a new random seed for the map's hash function and rehashes
+// every entry into its position for the new seed. The entries and the
+// capacity of the map are preserved. Reseeding defends against hash flooding:
+// an attacker who has constructed keys which collide under the current seed
+// loses that ability. Note that Reseed replaces a seed specified by WithSeed.
+func (m *Map[K, V]) Reseed() {
+	// Size the rebuilt map to hold as many entries as the existing buckets
+	// can hold at the maximum load factor which preserves the capacity of the
+	// map. Note that maxGrowth is not used as it allows a bucket which fits
+	// in a single group to be filled beyond the maximum load factor.
+	var capacity int
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		capacity += int((b.capacity * m.maxLoad) >> loadFactorShift)
+		return true
+	})
+
+	m.seed = uintptr(fastrand64())
+	m.rebuild(capacity)
+}
+
+// maybeReseed reseeds the map if auto-reseeding is enabled and probeLen, the
+// probe length of an insertion, exceeds the threshold. In order to bound the
+// cost of reseeding when the collisions are not caused by the seed (e.g. a
+// degenerate hash function), the map is not automatically reseeded again
+// until its size has doubled.
+func (m *Map[K, V]) maybeReseed(probeLen uintptr) {
+	if m.autoReseed == 0 || probeLen <= m.autoReseed || m.used < 2*m.autoReseedUsed {
+		return
+	}
+	m.autoReseedUsed = m.used
+	m.Reseed()
+}
+
+// Shrink reduces the memory used by the map to the smallest capacity that can
+// hold the current Len() entries, sized in the same manner as New. Live
+// entries are migrated into freshly allocated buckets and tombstones are
+// discarded. The old backing arrays are released to the map's allocator.
+// Shrink is the inverse of Grow and is useful after deleting a large fraction
+// of the entries in a map.
+func (m *Map[K, V]) Shrink() {
+	m.rebuild(m.used)
+}
+
+// Compact removes the deletion tombstones from the map's buckets, rehashing
+// the entries of each bucket containing tombstones in place. Tombstones
+// lengthen the probe sequences of lookups, so compacting a map after deleting
+// many of its entries can speed up subsequent lookups. Unlike Shrink, Compact
+// retains the capacity of the map and does not allocate. An incremental resize
+// in progress is completed.
+func (m *Map[K, V]) Compact() {
+	m.unshare()
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.completeResize(m)
+		// See Stats for the computation of the number of tombstones.
+		if b.tombstones(m) > uintptr(b.growthLeft) {
+			b.rehashInPlace(m)
+		}
+		return true
+	})
+}
+
+// ClearAndShrink deletes all entries from the map and releases the map's
+// backing memory to its allocator, returning the map to the state of a map
+// created with an initial capacity of 0. Unlike Clear, the capacity of the map
+// is not retained and a subsequent Put will allocate anew.
+func (m *Map[K, V]) ClearAndShrink() {
+	m.unshare()
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		b.close(m)
+		return true
+	})
+	m.resetBuckets()
+
+	// Reset the hash seed for the same reason as Clear.
+	if !m.fixedSeed {
+		m.seed = uintptr(fastrand64())
+	}
+	m.used = 0
+
+	m.checkInvariants()
+}
+
+// Reset deletes all entries from the map and returns it to a small baseline
+// capacity, making it suitable for reuse via a sync.Pool. A map with a single
+// bucket with a capacity of at most 63 slots keeps its backing arrays.
+// Otherwise the map's backing memory is released to its allocator and
+// replaced by a single bucket with a capacity of 63 slots (or the max bucket
+// capacity if smaller). A map with zero capacity is left as is.
+// Reset sits between Clear, which retains all of the map's capacity, and
+// ClearAndShrink, which retains none of it.
+func (m *Map[K, V]) Reset() {
+	m.unshare()
+	capacity := min(resetBucketCapacity, m.maxBucketCapacity)
+	var keep bucket[K, V]
+	var release bool
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.old != nil {
+			b.old.close(m)
+			b.old = nil
+		}
+		if m.globalShift == 0 && b.capacity <= capacity {
+			keep = *b
+			return true
+		}
+		b.close(m)
+		release = true
+		return true
+	})
+	m.resetBuckets()
+
+	if keep.capacity > 0 {
+		m.bucket0.ctrls = keep.ctrls
+		m.bucket0.slots = keep.slots
+		m.bucket0.capacity = keep.capacity
+		for i := uintptr(0); i < keep.capacity; i++ {
+			m.bucket0.setCtrl(i, ctrlEmpty)
+			*m.bucket0.slots.At(i) = Slot[K, V]{}
+		}
+		m.bucket0.resetGrowthLeft(m)
+	} else if release {
+		m.bucket0.init(m, capacity)
+	}
+
+	// Reset the hash seed for the same reason as Clear.
+	if !m.fixedSeed {
+		m.seed = uintptr(fastrand64())
+	}
+	m.used = 0
+
+	m.checkInvariants()
+	m.bucket0.checkInvariants(m)
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, range stops the iteration. The map can be mutated
+// during iteration, though there is no guarantee that the mutations will be
+// visible to the iteration.
+//
+// The signature of All conforms to iter.Seq2[K,V] which allows iterating over
+// the map using range-over-func (Go 1.23+):
+//
+//	for k, v := range m.All {
+//	  fmt.Printf("%v: %v\n", k, v)
+//	}
+//
+// See https://github.com/golang/go/issues/61897.
+func (m *Map[K, V]) All(yield func(key K, value V) bool) {
+	atomic.AddInt32(&m.iterators, 1)
+	defer m.endIteration()
+
+	// Randomize iteration order by starting iteration at a random bucket and
+	// within each bucket at a random offset.
+	offset := m.iterationOffset()
+	m.buckets(offset>>32, func(b *bucket[K, V]) bool {
+		return m.bucketAll(b, offset, yield)
+	})
+}
+
+// endIteration ends an iteration started by All. The tables freed during
+// iteration are released to the allocator once no iteration is in progress.
+func (m *Map[K, V]) endIteration() {
+	if atomic.AddInt32(&m.iterators, -1) > 0 || len(m.deferredFrees) == 0 {
+		return
+	}
+	for i := range m.deferredFrees {
+		d := &m.deferredFrees[i]
+		releaseTable(d.allocator, d.ctrls, d.slots)
+		m.frees++
+	}
+	clear(m.deferredFrees)
+	m.deferredFrees = m.deferredFrees[:0]
+}
+
+// ForEachBucket calls fn sequentially for each bucket in the map, passing the
+// ordinal of the bucket and an iterator over the bucket's entries. The
+// iterators of distinct buckets visit disjoint sets of entries and, as long
+// as the map is not mutated, may be invoked concurrently from different
+// goroutines, including after ForEachBucket returns. This allows a large map
+// to be scanned in parallel:
+//
+//	var wg sync.WaitGroup
+//	m.ForEachBucket(func(i int, all func(yield func(K, V) bool)) {
+//	  wg.Add(1)
+//	  go func() {
+//	    defer wg.Done()
+//	    for k, v := range all {
+//	      ...
+//	    }
+//	  }()
+//	})
+//	wg.Wait()
+//
+// Mutating the map while any of the iterators may be running, including from
+// within fn or yield, is a data race.
+func (m *Map[K, V]) ForEachBucket(fn func(bucketIndex int, all func(yield func(key K, value V) bool))) {
+	offset := m.iterationOffset()
+	var n int
+	m.buckets(offset>>32, func(b *bucket[K, V]) bool {
+		fn(n, func(yield func(key K, value V) bool) {
+			m.bucketAll(b, offset, yield)
+		})
+		n++
+		return true
+	})
+}
+
+// BucketIndex returns the index of the bucket which key belongs to: the high
+// bits of Hash(key) which index the map's directory of buckets. See
+// LoadBuckets. The index is only valid until the map is split, cleared,
+// rebuilt or reseeded.
+func (m *Map[K, V]) BucketIndex(key K) int {
+	h := m.Hash(key)
+	if m.globalShift == 0 {
+		return 0
+	}
+	return int(h >> (m.globalShift & shiftMask))
+}
+
+// LoadBuckets inserts entries into the map from several goroutines in
+// parallel, such as when populating a map created with WithInitialBuckets.
+// load is called once for each bucket index in [0, n), where n is the size of
+// the map's directory of buckets (equal to BucketCount for a map created with
+// WithInitialBuckets which has not been split), passing the index and a put
+// function which inserts an entry as Put does. The key of each entry passed
+// to put must belong to the bucket with that index (see BucketIndex), and put
+// panics if it does not. A loader typically partitions its input by
+// BucketIndex and then inserts each partition in the call to load for its
+// index.
+//
+// The calls to load for distinct buckets are made concurrently from up to
+// GOMAXPROCS goroutines, and LoadBuckets returns once they have all
+// returned. Buckets are never split while they are loaded in parallel: a
+// bucket which fills up is resized, even beyond the max bucket capacity (see
+// WithMaxBucketCapacity), and is split by a later insertion once it is full.
+// A map with a single bucket is loaded by a single call to load on the
+// calling goroutine, in which put may split the bucket as Put does.
+// Calls to the Alloc and Free methods of a custom allocator (see
+// WithAllocator) are serialized, and the hash function may be called
+// concurrently. load must not access the map other than through put. If a
+// call to load panics, LoadBuckets panics with the same value once the other
+// calls have returned, and the map contains the entries inserted before the
+// panic.
+func (m *Map[K, V]) LoadBuckets(load func(bucketIndex int, put func(key K, value V))) {
+	m.lazyInit()
+	m.unshare()
+
+	if m.globalShift == 0 {
+		// A single bucket is loaded directly, with no need to coordinate
+		// with other goroutines.
+		load(0, m.Put)
+		return
+	}
+
+	var buckets []*bucket[K, V]
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		buckets = append(buckets, b)
+		return true
+	})
+
+	// Each goroutine inserts using its own copy of the map so that the
+	// counters updated by insertion are not shared. The copies never split a
+	// bucket or reseed the map, which would mutate state shared by all of
+	// the buckets.
+	base := *m
+	base.maxBucketCapacity = ^uintptr(0)
+	base.autoReseed = 0
+	base.deferredFrees = nil
+	switch m.allocator.(type) {
+	case defaultAllocator[K, V], paddedAllocator[K, V]:
+	default:
+		base.allocator = &lockedAllocator[K, V]{allocator: m.allocator}
+	}
+
+	workers := make([]Map[K, V], min(runtime.GOMAXPROCS(0), len(buckets)))
+	var next atomic.Int64
+	var panicked atomic.Pointer[any]
+	var wg sync.WaitGroup
+	for w := range workers {
+		lm := &workers[w]
+		*lm = base
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					panicked.CompareAndSwap(nil, &r)
+				}
+			}()
+			for {
+				j := int(next.Add(1)) - 1
+				if j >= len(buckets) || panicked.Load() != nil {
+					return
+				}
+				b := buckets[j]
+				for i, n := b.index, b.index+bucketStep(m.globalDepth(), b.localDepth); i < n; i++ {
+					index := int(i)
+					load(index, func(key K, value V) {
+						h := lm.hash(noescape(unsafe.Pointer(&key)), lm.seed)
+						if lm.bucket(h) != b {
+							panic(fmt.Sprintf("swiss: LoadBuckets: key %v does not belong to bucket %d", key, index))
+						}
+						lm.put(key, h, &value)
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i := range workers {
+		lm := &workers[i]
+		m.used += lm.used - base.used
+		m.resizes += lm.resizes - base.resizes
+		m.allocs += lm.allocs - base.allocs
+		m.frees += lm.frees - base.frees
+		m.deferredFrees = append(m.deferredFrees, lm.deferredFrees...)
+	}
+	m.checkInvariants()
+	if r := panicked.Load(); r != nil {
+		panic(*r)
+	}
+}
+
+// lockedAllocator serializes the calls to an Allocator which is shared by the
+// goroutines of LoadBuckets.
+type lockedAllocator[K comparable, V any] struct {
+	mu        sync.Mutex
+	allocator Allocator[K, V]
+}
+
+func (a *lockedAllocator[K, V]) Alloc(ctrls, slots int) ([]uint8, []Slot[K, V]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.allocator.Alloc(ctrls, slots)
+}
+
+func (a *lockedAllocator[K, V]) Free(ctrls []uint8, slots []Slot[K, V]) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allocator.Free(ctrls, slots)
+}
+
+// iterationOffset returns the offset at which to start iteration. See
+// WithDeterministicIteration and WithStableRandomIteration.
+func (m *Map[K, V]) iterationOffset() uintptr {
+	switch {
+	case m.deterministicIteration:
+		return 0
+	case m.stableIteration:
+		return m.iterationSeed
+	default:
+		return uintptr(fastrand64())
+	}
+}
+
+// bucketAll calls yield sequentially for each key and value present in the
+// bucket, starting at the specified offset. It returns false if yield
+// returned false.
+func (m *Map[K, V]) bucketAll(b *bucket[K, V], offset uintptr, yield func(key K, value V) bool) bool {
+	if b.used == 0 && b.old == nil {
+		return true
+	}
+
+	// Snapshot the capacity, controls, and slots so that iteration remains
+	// valid if the map is resized during iteration.
+	capacity := b.capacity
+	ctrls := b.ctrls
+	slots := b.slots
+
+	// If the bucket is being incrementally resized, also snapshot the old
+	// table, including the number of migrated slots, and the seed. Iteration
+	// does not migrate entries itself, but entries may be migrated by
+	// mutations performed during iteration. Such entries are skipped in
+	// the new table and visited in the old table instead so that they are
+	// not visited twice.
+	var old bucket[K, V]
+	migrating := b.old != nil
+	if migrating {
+		old = *b.old
+	}
+	seed := m.seed
+
+	for i := uintptr(0); i <= capacity; i++ {
+		// Match full entries which have a high-bit of zero.
+		j := (i + offset) & capacity
+		if (ctrls.Get(j) & ctrlEmpty) != ctrlEmpty {
+			s := slots.At(j)
+			if migrating {
+				h := m.hash(noescape(unsafe.Pointer(&s.key)), seed)
+				if _, ok := old.findOld(h, s.key); ok {
+					continue
+				}
+			}
+			if !yield(s.key, s.value) {
+				return false
+			}
+		}
+	}
+
+	if migrating {
+		for i := uintptr(0); i <= old.capacity; i++ {
+			j := (i + offset) & old.capacity
+			if j >= old.migrated && (old.ctrls.Get(j)&ctrlEmpty) != ctrlEmpty {
+				s := old.slots.At(j)
+				if !yield(s.key, s.value) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// AllSorted calls yield sequentially for each key and value present in the
+// map in the order specified by less. If yield returns false, iteration
+// stops. AllSorted snapshots the entries in the map and sorts them before
+// calling yield. The map can be mutated during iteration, though the mutations
+// will not be visible to the iteration.
+func (m *Map[K, V]) AllSorted(less func(a, b K) bool, yield func(key K, value V) bool) {
+	entries := make([]Slot[K, V], 0, m.used)
+	m.All(func(key K, value V) bool {
+		entries = append(entries, Slot[K, V]{key: key, value: value})
+		return true
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return less(entries[i].key, entries[j].key)
+	})
+	for i := range entries {
+		if !yield(entries[i].key, entries[i].value) {
+			return
+		}
+	}
+}
+
+// AllOrdered calls yield sequentially for each key and value present in the
+// map in ascending key order. It is equivalent to AllSorted with cmp.Less as
+// the ordering, and has the same semantics. Like CompareAndSwap, AllOrdered
+// is a function rather than a method because it requires K to be ordered.
+func AllOrdered[K cmp.Ordered, V any](m *Map[K, V], yield func(key K, value V) bool) {
+	entries := make([]Slot[K, V], 0, m.used)
+	m.All(func(key K, value V) bool {
+		entries = append(entries, Slot[K, V]{key: key, value: value})
+		return true
+	})
+	slices.SortFunc(entries, func(a, b Slot[K, V]) int {
+		return cmp.Compare(a.key, b.key)
+	})
+	for i := range entries {
+		if !yield(entries[i].key, entries[i].value) {
+			return
+		}
+	}
+}
+
+// AllKeys calls yield sequentially for each key present in the map. If yield
+// returns false, range stops the iteration. AllKeys has the same iteration
+// semantics as All and its signature conforms to iter.Seq[K]:
+//
+//	for k := range m.AllKeys {
+//	  fmt.Printf("%v\n", k)
+//	}
+func (m *Map[K, V]) AllKeys(yield func(key K) bool) {
+	m.All(func(key K, _ V) bool {
+		return yield(key)
+	})
+}
+
+// AllValues calls yield sequentially for each value present in the map. If
+// yield returns false, range stops the iteration. AllValues has the same
+// iteration semantics as All and its signature conforms to iter.Seq[V]:
+//
+//	for v := range m.AllValues {
+//	  fmt.Printf("%v\n", v)
+//	}
+func (m *Map[K, V]) AllValues(yield func(value V) bool) {
+	m.All(func(_ K, value V) bool {
+		return yield(value)
+	})
+}
+
+// AllErr calls fn sequentially for each key and value present in the map,
+// stopping at the first call which returns a non-nil error and returning that
+// error. AllErr returns nil if fn returns nil for every entry. AllErr has the
+// same iteration semantics as All.
+func (m *Map[K, V]) AllErr(fn func(key K, value V) error) error {
+	var err error
+	m.All(func(key K, value V) bool {
+		err = fn(key, value)
+		return err == nil
+	})
+	return err
+}
+
+// RandomElement returns a uniformly random entry from the map using r as the
+// source of randomness, or ok=false if the map is empty. Each entry present in
+// the map has equal probability of being selected. RandomElement selects an
+// index in [0,Len()) and then locates the corresponding entry, skipping over
+// entire buckets using their entry counts, so its cost is proportional to the
+// number of buckets plus the capacity of a single bucket.
+func (m *Map[K, V]) RandomElement(r *rand.Rand) (key K, value V, ok bool) {
+	if m.used == 0 {
+		return key, value, false
+	}
+	j := r.Intn(m.used)
+	// pick returns true if the j-th entry resides in the bucket b (which may
+	// be the old table of an incremental resize), setting key and value.
+	// Otherwise j is adjusted by the number of entries in b.
+	pick := func(b *bucket[K, V]) bool {
+		if j >= b.used {
+			j -= b.used
+			return false
+		}
+		for i := b.migrated; i < b.capacity; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			if j == 0 {
+				s := b.slots.At(i)
+				key, value, ok = s.key, s.value, true
+				return true
+			}
+			j--
+		}
+		panic(fmt.Sprintf("bucket %d: found fewer than %d entries", b.index, b.used))
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if pick(b) {
+			return false
+		}
+		return b.old == nil || !pick(b.old)
+	})
+	return key, value, ok
+}
+
+// randomSlot returns the slot of an entry selected at random, or nil if the
+// map is empty. Unlike RandomElement the selection is not uniform: a bucket is
+// selected by a random directory index and the first entry at or after a
+// random slot of the bucket is returned, which favors buckets with a low local
+// depth and entries following runs of empty slots. In return the cost is
+// independent of the size of the map, which makes randomSlot suitable for
+// sampling candidates for eviction (see BoundedMap).
+func (m *Map[K, V]) randomSlot() *Slot[K, V] {
+	if m.used == 0 {
+		return nil
+	}
+	for {
+		b := m.bucket(uintptr(fastrand64()))
+		if b.old != nil && uintptr(fastrand64())%uintptr(b.used+b.old.used) < uintptr(b.old.used) {
+			b = b.old
+		}
 		if b.used == 0 {
-			return true
+			continue
 		}
+		n := b.capacity - b.migrated
+		start := uintptr(fastrand64()) % n
+		for k := uintptr(0); k < n; k++ {
+			i := b.migrated + (start+k)%n
+			if (b.ctrls.Get(i) & ctrlEmpty) != ctrlEmpty {
+				return b.slots.At(i)
+			}
+		}
+		panic(fmt.Sprintf("bucket %d: found no entries", b.index))
+	}
+}
 
-		// Snapshot the capacity, controls, and slots so that iteration remains
-		// valid if the map is resized during iteration.
-		capacity := b.capacity
-		ctrls := b.ctrls
-		slots := b.slots
-
-		for i := uintptr(0); i <= capacity; i++ {
-			// Match full entries which have a high-bit of zero.
-			j := (i + offset) & capacity
-			if (ctrls.Get(j) & ctrlEmpty) != ctrlEmpty {
-				s := slots.At(j)
-				if !yield(s.key, s.value) {
-					return false
-				}
+// Sample returns min(n, Len()) distinct entries selected uniformly at random
+// from the map using r as the source of randomness. The keys and values of the
+// selected entries are returned in parallel slices. Sample performs a single
+// pass over the map using reservoir sampling and allocates only the returned
+// slices.
+func (m *Map[K, V]) Sample(r *rand.Rand, n int) (keys []K, values []V) {
+	if n > m.used {
+		n = m.used
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	keys = make([]K, 0, n)
+	values = make([]V, 0, n)
+
+	var seen int
+	sample := func(b *bucket[K, V]) {
+		for i := b.migrated; i < b.capacity; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+				continue
 			}
+			s := b.slots.At(i)
+			if seen < n {
+				keys = append(keys, s.key)
+				values = append(values, s.value)
+			} else if j := r.Intn(seen + 1); j < n {
+				keys[j], values[j] = s.key, s.value
+			}
+			seen++
+		}
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		sample(b)
+		if b.old != nil {
+			sample(b.old)
 		}
 		return true
 	})
+	return keys, values
+}
+
+// Keys returns a slice containing the keys present in the map. The order of
+// the keys is the same randomized order used by All.
+func (m *Map[K, V]) Keys() []K {
+	keys := make([]K, 0, m.used)
+	m.All(func(key K, _ V) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+// Values returns a slice containing the values present in the map. The order
+// of the values is the same randomized order used by All.
+func (m *Map[K, V]) Values() []V {
+	values := make([]V, 0, m.used)
+	m.All(func(_ K, value V) bool {
+		values = append(values, value)
+		return true
+	})
+	return values
+}
+
+// Entries returns a slice containing the entries present in the map. The
+// order of the entries is the same randomized order used by All.
+func (m *Map[K, V]) Entries() []Slot[K, V] {
+	entries := make([]Slot[K, V], 0, m.used)
+	m.All(func(key K, value V) bool {
+		entries = append(entries, Slot[K, V]{key: key, value: value})
+		return true
+	})
+	return entries
 }
 
 // GoString implements the fmt.GoStringer interface which is used when
@@ -665,13 +2658,43 @@ func (m *Map[K, V]) GoString() string {
 	return buf.String()
 }
 
+// String implements the fmt.Stringer interface. The output includes the
+// map's length, capacity, and number of buckets followed by the entries in
+// the order of All. At most maxStringEntries entries are included so that
+// printing a large map produces bounded output.
+func (m *Map[K, V]) String() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "swiss.Map[%s,%s]{len:%d cap:%d buckets:%d [",
+		reflect.TypeOf((*K)(nil)).Elem(), reflect.TypeOf((*V)(nil)).Elem(),
+		m.used, m.Cap(), m.bucketCount())
+	n := 0
+	m.All(func(key K, value V) bool {
+		if n == maxStringEntries {
+			buf.WriteString(" ...")
+			return false
+		}
+		if n > 0 {
+			buf.WriteByte(' ')
+		}
+		fmt.Fprintf(&buf, "%v:%v", key, value)
+		n++
+		return true
+	})
+	buf.WriteString("]}")
+	return buf.String()
+}
+
 // Len returns the number of entries in the map.
 func (m *Map[K, V]) Len() int {
 	return m.used
 }
 
-// capacity returns the total capacity of all map buckets.
-func (m *Map[K, V]) capacity() int {
+// Cap returns the total number of slots across all of the map's buckets.
+// Note that a bucket grows before all of its slots are filled (see
+// WithMaxLoadFactor), so the number of entries which can be inserted without
+// growing the map is less than Cap() - Len(). Comparing Cap() to Len() is
+// useful for deciding whether to Shrink the map.
+func (m *Map[K, V]) Cap() int {
 	var capacity int
 	m.buckets(0, func(b *bucket[K, V]) bool {
 		capacity += int(b.capacity)
@@ -680,6 +2703,109 @@ func (m *Map[K, V]) capacity() int {
 	return capacity
 }
 
+// find looks up the key with hash h. If the key is present, find returns the
+// bucket containing it and the index of its slot with found=true. If the key
+// is present in the old table of a bucket being incrementally resized, the
+// returned bucket is the old table. Otherwise,
+// find returns the bucket the key belongs in along with the index of the first
+// empty or deleted slot in the key's probe sequence which is where the key
+// would be inserted by Put. The returned index should be passed to insertAt.
+//
+// Put, Get, and Delete manually inline the find routine for performance. find
+// is used by the less performance sensitive operations.
+func (m *Map[K, V]) find(h uintptr, key K) (b *bucket[K, V], i uintptr, found bool) {
+	b = m.bucket(h)
+
+	insertIdx := ^uintptr(0)
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for ; ; seq = seq.next() {
+		g := b.ctrls.GroupAt(seq.offset)
+		match := g.matchH2(h2(h))
+
+		for match != 0 {
+			slotIdx := match.first()
+			i := seq.offsetAt(slotIdx)
+			if key == b.slots.At(i).key {
+				return b, i, true
+			}
+			match = match.remove(slotIdx)
+		}
+
+		if insertIdx == ^uintptr(0) {
+			if match := g.matchEmptyOrDeleted(); match != 0 {
+				insertIdx = seq.offsetAt(match.first())
+			}
+		}
+
+		if g.matchEmpty() != 0 {
+			// Finding an empty slot means we've reached the end of the probe
+			// sequence. Note that the group containing the empty slot will
+			// have set insertIdx if it wasn't already set.
+			if b.old != nil {
+				if i, ok := b.old.findOld(h, key); ok {
+					return b.old, i, true
+				}
+			}
+			return b, insertIdx, false
+		}
+	}
+}
+
+// insertAt inserts an entry known not to be in the map into bucket b at slot
+// index i where b and i were returned by an unsuccessful call to find. The
+// growthLeft accounting mirrors Put: if there is no room left to grow in the
+// bucket and slot i is not a tombstone, the bucket is rehashed (which may
+// resize or split it) and the entry is inserted via uncheckedPut. If the
+// bucket is being incrementally resized, insertAt migrates a chunk of entries
+// from the old table. The value is copied from *value. insertAt returns a
+// pointer to the slot holding the inserted entry.
+func (m *Map[K, V]) insertAt(h uintptr, b *bucket[K, V], i uintptr, key K, value *V) *Slot[K, V] {
+	if b.growthLeft > 0 || b.ctrls.Get(i) == ctrlDeleted {
+		slot := b.slots.At(i)
+		slot.key = key
+		slot.value = *value
+		if b.ctrls.Get(i) == ctrlEmpty {
+			b.growthLeft--
+		}
+		b.setCtrl(i, ctrl(h2(h)))
+		b.used++
+		m.used++
+		if b.old != nil {
+			b.migrate(m, migrateSlots)
+		}
+		b.checkInvariants(m)
+		return slot
+	}
+
+	if invariants && b.growthLeft != 0 {
+		panic(fmt.Sprintf("invariant failed: growthLeft is unexpectedly non-zero: %d", b.growthLeft))
+	}
+
+	b.rehash(m)
+
+	// We may have split the bucket in which case we have to re-determine
+	// which bucket the key resides on.
+	b = m.bucket(h)
+	i = b.uncheckedPut(h, key, value)
+	b.used++
+	m.used++
+	b.checkInvariants(m)
+	return b.slots.At(i)
+}
+
+// putMigrating implements Put for a key with hash h which is not present in
+// the table of its bucket when the bucket is being incrementally resized. If
+// the key is present in the old table its value is overwritten in place,
+// otherwise the entry is inserted into the new table.
+func (m *Map[K, V]) putMigrating(h uintptr, key K, value *V) {
+	b, i, found := m.find(h, key)
+	if found {
+		b.slots.At(i).value = *value
+		return
+	}
+	m.insertAt(h, b, i, key, value)
+}
+
 const (
 	// ptrSize and shiftMask are used to optimize code generation for
 	// Map.bucket(), Map.bucketCount(), and bucketStep(). This technique was
@@ -691,6 +2817,7 @@ const (
 
 // bucket returns the bucket corresponding to hash value h.
 func (m *Map[K, V]) bucket(h uintptr) *bucket[K, V] {
+	m.checkClosed()
 	// NB: It is faster to check for the single bucket case using a
 	// conditional than to to index into the directory.
 	if m.globalShift == 0 {
@@ -706,6 +2833,7 @@ func (m *Map[K, V]) bucket(h uintptr) *bucket[K, V] {
 // returns false, iteration stops. Offset specifies the bucket to start
 // iteration at (used to randomize iteration order).
 func (m *Map[K, V]) buckets(offset uintptr, yield func(b *bucket[K, V]) bool) {
+	m.checkClosed()
 	if m.globalShift == 0 {
 		yield(&m.bucket0)
 		return
@@ -795,7 +2923,9 @@ func (m *Map[K, V]) dirEntries(yield func(b *bucket[K, V]) bool) {
 	}
 
 	for i, n := uintptr(0), m.bucketCount(); i < n; i++ {
-		yield(*m.dir.At(i))
+		if !yield(*m.dir.At(i)) {
+			return
+		}
 	}
 }
 
@@ -808,11 +2938,42 @@ func (m *Map[K, V]) globalDepth() uint {
 	return 64 - m.globalShift
 }
 
-// bucketCount returns the number of buckets in the buckets directory.
+// bucketCount returns the number of entries in the buckets directory. Note
+// that this may be larger than the number of distinct buckets (see
+// BucketCount).
 func (m *Map[K, V]) bucketCount() uintptr {
 	return uintptr(1) << (m.globalDepth() & shiftMask)
 }
 
+// enterCallback marks the map as running a callback which must not modify
+// it, such as the fn passed to GetOrCompute, returning a function which
+// removes the mark. It is only used in invariants builds, in which modifying
+// the map while it is marked panics (see checkNotInCallback).
+func (m *Map[K, V]) enterCallback() (exit func()) {
+	prev := m.inCallback
+	m.inCallback = true
+	return func() { m.inCallback = prev }
+}
+
+// checkNotInCallback panics if the map is being modified by a callback which
+// must not modify it (see enterCallback). The check is only performed in
+// invariants builds. Every method which modifies the map performs the check,
+// via unshare if not directly.
+func (m *Map[K, V]) checkNotInCallback() {
+	if invariants && m.inCallback {
+		panic("invariant failed: Map modified by callback")
+	}
+}
+
+// checkClosed panics if the map has been closed. The check is only performed
+// in invariants builds. In other builds a closed map behaves as an empty map
+// (see Close).
+func (m *Map[K, V]) checkClosed() {
+	if invariants && m.closed {
+		panic("invariant failed: use of closed Map")
+	}
+}
+
 // bucketStep is the number of buckets to step over in the buckets directory
 // to reach the next different bucket. A bucket occupies 1 or more contiguous
 // entries in the buckets directory specified by the range:
@@ -871,44 +3032,95 @@ func (m *Map[K, V]) growDirectory(newGlobalDepth uint) {
 	m.checkInvariants()
 }
 
+// Validate checks the internal consistency of the map, returning an error
+// describing the first inconsistency found or nil if there is none. It
+// verifies the bucket directory, that each entry is found in the slot it
+// occupies by probing for its key, that the control bytes (including the
+// sentinel and the cloned bytes) are well formed, and that the entry,
+// tombstone, and growth counts agree with the control bytes. Validate takes
+// time proportional to the capacity of the map and, unlike the checks enabled
+// by the swiss_invariants build tag, is available in all builds. It is
+// intended for checking a map built with a custom Allocator or after decoding.
+func (m *Map[K, V]) Validate() error {
+	if m.closed {
+		return errors.New("swiss: Validate: use of closed Map")
+	}
+	if err := m.validateDir(); err != nil {
+		return fmt.Errorf("swiss: Validate: %w", err)
+	}
+	var err error
+	var used int
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if err = b.validate(m); err != nil {
+			err = fmt.Errorf("swiss: Validate: bucket %d: %w", b.index, err)
+			return false
+		}
+		used += b.used
+		if b.old != nil {
+			used += b.old.used
+		}
+		return true
+	})
+	if err == nil && used != m.used {
+		err = fmt.Errorf("swiss: Validate: found %d entries, but Len is %d", used, m.used)
+	}
+	return err
+}
+
 // checkInvariants verifies the internal consistency of the map's structure,
 // checking conditions that should always be true for a correctly functioning
 // map. If any of these invariants are violated, it panics, indicating a bug
 // in the map implementation.
 func (m *Map[K, V]) checkInvariants() {
 	if invariants {
-		if m.globalShift == 0 {
-			if m.dir.ptr != nil {
-				panic("unexpectedly non-nil directory")
-			}
-			if m.bucket0.localDepth != 0 {
-				panic(fmt.Sprintf("expected local-depth=0, but found %d", m.bucket0.localDepth))
-			}
-		} else {
-			i := uintptr(0)
-			m.dirEntries(func(b *bucket[K, V]) bool {
-				if b == nil {
-					panic(fmt.Sprintf("dir[%d]: nil bucket", i))
-				}
-				if b.localDepth > m.globalDepth() {
-					panic(fmt.Sprintf("dir[%d]: local-depth=%d is greater than global-depth=%d",
-						i, b.localDepth, m.globalDepth()))
-				}
-				n := uintptr(1) << (m.globalDepth() - b.localDepth)
-				if i < b.index || i >= b.index+n {
-					panic(fmt.Sprintf("dir[%d]: out of expected range [%d,%d)", i, b.index, b.index+n))
-				}
-				i++
-				return true
-			})
+		if err := m.validateDir(); err != nil {
+			panic(fmt.Sprintf("invariant failed: %v", err))
+		}
+	}
+}
+
+// validateDir returns an error describing the first inconsistency found in
+// the bucket directory, or nil if it is consistent.
+func (m *Map[K, V]) validateDir() error {
+	if m.globalShift == 0 {
+		if m.dir.ptr != nil {
+			return errors.New("unexpectedly non-nil directory")
 		}
+		if m.bucket0.localDepth != 0 {
+			return fmt.Errorf("expected local-depth=0, but found %d", m.bucket0.localDepth)
+		}
+		return nil
 	}
+	var err error
+	i := uintptr(0)
+	m.dirEntries(func(b *bucket[K, V]) bool {
+		if b == nil {
+			err = fmt.Errorf("dir[%d]: nil bucket", i)
+			return false
+		}
+		if b.localDepth > m.globalDepth() {
+			err = fmt.Errorf("dir[%d]: local-depth=%d is greater than global-depth=%d",
+				i, b.localDepth, m.globalDepth())
+			return false
+		}
+		n := uintptr(1) << (m.globalDepth() - b.localDepth)
+		if i < b.index || i >= b.index+n {
+			err = fmt.Errorf("dir[%d]: out of expected range [%d,%d)", i, b.index, b.index+n)
+			return false
+		}
+		i++
+		return true
+	})
+	return err
 }
 
-func (b *bucket[K, V]) close(allocator Allocator[K, V]) {
+func (b *bucket[K, V]) close(m *Map[K, V]) {
+	if b.old != nil {
+		b.old.close(m)
+		b.old = nil
+	}
 	if b.capacity > 0 {
-		allocator.Free(unsafeConvertSlice[uint8](b.ctrls.Slice(0, b.capacity+groupSize)),
-			b.slots.Slice(0, b.capacity))
+		m.freeTable(b.ctrls, b.slots, b.capacity)
 		b.capacity = 0
 		b.used = 0
 	}
@@ -916,6 +3128,48 @@ func (b *bucket[K, V]) close(allocator Allocator[K, V]) {
 	b.slots = makeUnsafeSlice([]Slot[K, V](nil))
 }
 
+// clone returns a copy of the bucket with its own ctrls and slots allocated
+// from m's allocator, where m is the map the copy belongs to.
+func (b *bucket[K, V]) clone(m *Map[K, V]) bucket[K, V] {
+	c := *b
+	if b.capacity > 0 {
+		ctrls, slots := m.allocTable(b.capacity)
+		copy(ctrls, unsafeConvertSlice[uint8](b.ctrls.Slice(0, b.capacity+groupSize)))
+		copy(slots, b.slots.Slice(0, b.capacity))
+		c.ctrls = makeCtrlBytes(unsafeConvertSlice[ctrl](ctrls))
+		c.slots = makeUnsafeSlice(slots)
+	}
+	if b.old != nil {
+		old := b.old.clone(m)
+		c.old = &old
+	}
+	return c
+}
+
+// deleteAt deletes the entry at index i from the bucket.
+func (b *bucket[K, V]) deleteAt(m *Map[K, V], i uintptr) {
+	b.used--
+	m.used--
+	*b.slots.At(i) = Slot[K, V]{}
+
+	// Given an offset to delete we simply create a tombstone and destroy its
+	// contents and mark the ctrl as deleted. If we can prove that the slot
+	// would not appear in a probe sequence we can mark the slot as empty
+	// instead. We can prove this by checking to see if the slot is part of
+	// any group that could have been full (assuming we never create an empty
+	// slot in a group with no empties which this heuristic guarantees we
+	// never do). If the slot is always parts of groups that could never have
+	// been full then find would stop at this slot since we do not probe
+	// beyond groups with empties.
+	if b.wasNeverFull(i) {
+		b.setCtrl(i, ctrlEmpty)
+		b.growthLeft++
+	} else {
+		b.setCtrl(i, ctrlDeleted)
+	}
+	b.checkInvariants(m)
+}
+
 // setCtrl sets the control byte at index i, taking care to mirror the byte to
 // the end of the control bytes slice if i<groupSize.
 func (b *bucket[K, V]) setCtrl(i uintptr, v ctrl) {
@@ -930,13 +3184,13 @@ func (b *bucket[K, V]) setCtrl(i uintptr, v ctrl) {
 // tombstones returns the number of deleted (tombstone) entries in the bucket.
 // A tombstone is a slot that has been deleted but is still considered
 // occupied so as not to violate the probing invariant.
-func (b *bucket[K, V]) tombstones() uintptr {
-	return (b.capacity*maxAvgGroupLoad)/groupSize - uintptr(b.used)
+func (b *bucket[K, V]) tombstones(m *Map[K, V]) uintptr {
+	return m.maxGrowth(b.capacity) - uintptr(b.used)
 }
 
 // wasNeverFull returns true if index i was never part a full group. This
 // check allows an optimization during deletion whereby a deleted slot can be
-// converted to empty rather than a tombstone. See the comment in Delete for
+// converted to empty rather than a tombstone. See the comment in deleteAt for
 // further explanation.
 func (b *bucket[K, V]) wasNeverFull(i uintptr) bool {
 	if b.capacity < groupSize {
@@ -973,8 +3227,10 @@ func (b *bucket[K, V]) wasNeverFull(i uintptr) bool {
 
 // uncheckedPut inserts an entry known not to be in the table. Used by Put
 // after it has failed to find an existing entry to overwrite duration
-// insertion.
-func (b *bucket[K, V]) uncheckedPut(h uintptr, key K, value V) {
+// insertion. The value is copied from *value, which avoids copying a large
+// value twice when moving entries between tables. Returns the index of the
+// slot the entry was inserted into.
+func (b *bucket[K, V]) uncheckedPut(h uintptr, key K, value *V) uintptr {
 	if invariants && b.growthLeft == 0 {
 		panic("invariant failed: growthLeft is unexpectedly 0")
 	}
@@ -991,17 +3247,28 @@ func (b *bucket[K, V]) uncheckedPut(h uintptr, key K, value V) {
 			i := seq.offsetAt(match.first())
 			slot := b.slots.At(i)
 			slot.key = key
-			slot.value = value
+			slot.value = *value
 			if b.ctrls.Get(i) == ctrlEmpty {
 				b.growthLeft--
 			}
 			b.setCtrl(i, ctrl(h2(h)))
-			return
+			return i
 		}
 	}
 }
 
 func (b *bucket[K, V]) rehash(m *Map[K, V]) {
+	// Complete an in-progress incremental resize so that the bucket's entries
+	// all reside in its table. The new table always has room for the
+	// remaining entries (see migrateSlots), though the bucket may still be
+	// full afterwards.
+	if b.old != nil {
+		b.completeResize(m)
+		if b.growthLeft > 0 {
+			return
+		}
+	}
+
 	// Rehash in place if we can recover >= 1/3 of the capacity. Note that
 	// this heuristic differs from Abseil's and was experimentally determined
 	// to balance performance on the PutDelete benchmark vs achieving a
@@ -1015,7 +3282,14 @@ func (b *bucket[K, V]) rehash(m *Map[K, V]) {
 	// to reclaim because every tombstone will be dropped and we're only
 	// called if we've reached the thresold of capacity/8 empty slots. So the
 	// number of tomstones is capacity*7/8 - used.
-	if b.capacity > groupSize && b.tombstones() >= b.capacity/3 {
+	//
+	// The threshold is scaled by the maximum load factor (the above assumes
+	// the default of 7/8) so that a lower load factor does not prevent
+	// rehashing in place. WithAutoCompact replaces the threshold with a
+	// fraction of the capacity. The threshold is at least 1 so that we never
+	// rehash in place without reclaiming space. Note that rehashing in place
+	// returns without resizing or splitting the bucket.
+	if b.capacity > groupSize && b.tombstones(m) >= m.compactThreshold(b.capacity) {
 		b.rehashInPlace(m)
 		return
 	}
@@ -1029,15 +3303,111 @@ func (b *bucket[K, V]) rehash(m *Map[K, V]) {
 		return
 	}
 
+	if m.incrementalResize && b.capacity >= migrateSlots {
+		b.startResize(m, newCapacity)
+		return
+	}
 	b.resize(m, newCapacity)
 }
 
+// compactThreshold returns the number of tombstones at which a bucket with
+// the specified capacity is rehashed in place rather than resized or split
+// (see rehash).
+func (m *Map[K, V]) compactThreshold(capacity uintptr) uintptr {
+	if m.autoCompact != 0 {
+		return max((capacity*m.autoCompact)>>loadFactorShift, 1)
+	}
+	return (capacity * m.maxLoad) / (3 * defaultMaxLoad)
+}
+
+// allocTable allocates the ctrls and slots for a table with the specified
+// capacity from the map's allocator.
+func (m *Map[K, V]) allocTable(capacity uintptr) ([]uint8, []Slot[K, V]) {
+	m.checkClosed()
+	m.allocs++
+	return m.allocator.Alloc(int(capacity+groupSize), int(capacity))
+}
+
+// freeTable releases the ctrls and slots of a table with the specified
+// capacity to the map's allocator. If an iteration of the map is in progress
+// the release is deferred until it finishes (see All).
+func (m *Map[K, V]) freeTable(ctrls ctrlBytes, slots unsafeSlice[Slot[K, V]], capacity uintptr) {
+	c := unsafeConvertSlice[uint8](ctrls.Slice(0, capacity+groupSize))
+	s := slots.Slice(0, capacity)
+	if atomic.LoadInt32(&m.iterators) > 0 {
+		m.deferredFrees = append(m.deferredFrees, deferredFree[K, V]{m.allocator, c, s})
+		return
+	}
+	m.frees++
+	releaseTable(m.allocator, c, s)
+}
+
+// releaseTable passes the ctrls and slots of a table to the Free method of
+// allocator. Unless the allocator leaves the memory to the garbage collector,
+// the slots are cleared first so that memory reused by the allocator does not
+// keep the objects referenced by stale entries alive or expose their contents.
+// In invariants builds, memory left to the garbage collector is poisoned
+// instead (see poisonSlots).
+func releaseTable[K comparable, V any](allocator Allocator[K, V], ctrls []uint8, slots []Slot[K, V]) {
+	switch allocator.(type) {
+	case defaultAllocator[K, V], paddedAllocator[K, V]:
+		if invariants {
+			poisonSlots(slots)
+		}
+	default:
+		clear(slots)
+	}
+	allocator.Free(ctrls, slots)
+}
+
+// slotPoison is the byte written over released slots by poisonSlots.
+const slotPoison = 0xa5
+
+// poisonSlots overwrites the slots of a released table so that the use of a
+// pointer into the table after its release (see GetPtr) reads recognizably
+// bad values rather than the stale entries. Slots containing pointers are
+// cleared instead, as the garbage collector must not observe invalid
+// pointers.
+func poisonSlots[K comparable, V any](slots []Slot[K, V]) {
+	if len(slots) == 0 {
+		return
+	}
+	if hasPointers(reflect.TypeOf(slots).Elem()) {
+		clear(slots)
+		return
+	}
+	b := unsafe.Slice((*byte)(unsafe.Pointer(&slots[0])), uintptr(len(slots))*unsafe.Sizeof(slots[0]))
+	for i := range b {
+		b[i] = slotPoison
+	}
+}
+
+// hasPointers reports whether values of type t contain pointers.
+func hasPointers(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Array:
+		return t.Len() > 0 && hasPointers(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if hasPointers(t.Field(i).Type) {
+				return true
+			}
+		}
+		return false
+	case reflect.Chan, reflect.Func, reflect.Interface, reflect.Map, reflect.Pointer,
+		reflect.Slice, reflect.String, reflect.UnsafePointer:
+		return true
+	default:
+		return false
+	}
+}
+
 func (b *bucket[K, V]) init(m *Map[K, V], newCapacity uintptr) {
 	if (1 + newCapacity) < groupSize {
 		newCapacity = groupSize - 1
 	}
 
-	ctrls, slots := m.allocator.Alloc(int(newCapacity+groupSize), int(newCapacity))
+	ctrls, slots := m.allocTable(newCapacity)
 	b.ctrls = makeCtrlBytes(unsafeConvertSlice[ctrl](ctrls))
 	b.slots = makeUnsafeSlice(slots)
 
@@ -1048,7 +3418,7 @@ func (b *bucket[K, V]) init(m *Map[K, V], newCapacity uintptr) {
 
 	b.capacity = newCapacity
 
-	b.resetGrowthLeft()
+	b.resetGrowthLeft(m)
 }
 
 // resize the capacity of the table by allocating a bigger array and
@@ -1067,17 +3437,105 @@ func (b *bucket[K, V]) resize(m *Map[K, V], newCapacity uintptr) {
 		}
 		slot := oldSlots.At(i)
 		h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
-		b.uncheckedPut(h, slot.key, slot.value)
+		b.uncheckedPut(h, slot.key, &slot.value)
 	}
 
 	if oldCapacity > 0 {
-		m.allocator.Free(unsafeConvertSlice[uint8](oldCtrls.Slice(0, oldCapacity+groupSize)),
-			oldSlots.Slice(0, oldCapacity))
+		m.freeTable(oldCtrls, oldSlots, oldCapacity)
+	}
+	m.resizes++
+
+	b.checkInvariants(m)
+}
+
+// startResize begins an incremental resize of the bucket to newCapacity. The
+// bucket's current table becomes its old table and a new table is allocated.
+// The entries are migrated to the new table in chunks of migrateSlots slots
+// by subsequent insertions and deletions, starting with the first chunk here.
+func (b *bucket[K, V]) startResize(m *Map[K, V], newCapacity uintptr) {
+	if invariants && b.old != nil {
+		panic("invariant failed: incremental resize already in progress")
+	}
+	old := &bucket[K, V]{
+		ctrls:      b.ctrls,
+		slots:      b.slots,
+		capacity:   b.capacity,
+		used:       b.used,
+		growthLeft: b.growthLeft,
+	}
+	b.init(m, newCapacity)
+	b.used = 0
+	b.old = old
+	m.resizes++
+	b.migrate(m, migrateSlots)
+}
+
+// migrate moves the entries in up to n slots of the bucket's old table to the
+// bucket's table. When the last slot of the old table has been migrated the
+// old table is released back to the allocator.
+func (b *bucket[K, V]) migrate(m *Map[K, V], n uintptr) {
+	ob := b.old
+	end := min(ob.migrated+n, ob.capacity)
+	for i := ob.migrated; i < end; i++ {
+		c := ob.ctrls.Get(i)
+		if c == ctrlEmpty || c == ctrlDeleted {
+			continue
+		}
+		slot := ob.slots.At(i)
+		h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
+		b.uncheckedPut(h, slot.key, &slot.value)
+		b.used++
+		// The control byte of the migrated slot is left intact (see
+		// bucket.migrated), so the slot counts towards the old table's
+		// growthLeft in order to maintain its invariants.
+		ob.used--
+		ob.growthLeft++
+	}
+	ob.migrated = end
+
+	if ob.migrated == ob.capacity {
+		if invariants && ob.used != 0 {
+			panic(fmt.Sprintf("invariant failed: %d entries not migrated", ob.used))
+		}
+		ob.close(m)
+		b.old = nil
 	}
 
 	b.checkInvariants(m)
 }
 
+// completeResize migrates all of the remaining entries in the bucket's old
+// table if an incremental resize of the bucket is in progress.
+func (b *bucket[K, V]) completeResize(m *Map[K, V]) {
+	if b.old != nil {
+		b.migrate(m, b.old.capacity)
+	}
+}
+
+// findOld looks up the key with hash h in the receiver which is the old table
+// of a bucket being incrementally resized, ignoring the slots which have been
+// migrated.
+func (b *bucket[K, V]) findOld(h uintptr, key K) (i uintptr, found bool) {
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for ; ; seq = seq.next() {
+		g := b.ctrls.GroupAt(seq.offset)
+		match := g.matchH2(h2(h))
+
+		for match != 0 {
+			slotIdx := match.first()
+			i := seq.offsetAt(slotIdx)
+			if i >= b.migrated && key == b.slots.At(i).key {
+				return i, true
+			}
+			match = match.remove(slotIdx)
+		}
+
+		if g.matchEmpty() != 0 {
+			return 0, false
+		}
+	}
+}
+
 // split divides the entries in a bucket between the receiver and a new bucket
 // of the same size, and then installs the new bucket into the buckets
 // directory, growing the buckets directory if necessary.
@@ -1110,7 +3568,7 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 		}
 
 		// Insert the record into newb.
-		newb.uncheckedPut(h, slot.key, slot.value)
+		newb.uncheckedPut(h, slot.key, &slot.value)
 		newb.used++
 
 		// Delete the record from b.
@@ -1125,23 +3583,25 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 		b.used--
 	}
 
-	if uintptr(b.used) >= (b.capacity*maxAvgGroupLoad)/groupSize {
+	if uintptr(b.used) >= m.maxGrowth(b.capacity) {
 		// We didn't move any records to the new bucket. Either
 		// maxBucketCapacity is too small and we got unlucky, or we have a
 		// degenerate hash function (e.g. one that returns a constant in the
 		// high bits).
 		m.maxBucketCapacity = 2*m.maxBucketCapacity + 1
+		newb.close(m)
 		b.resize(m, 2*b.capacity+1)
 		return
 	}
 
-	if uintptr(newb.used) >= (newb.capacity*maxAvgGroupLoad)/groupSize || newb.growthLeft == 0 {
+	if uintptr(newb.used) >= m.maxGrowth(newb.capacity) || newb.growthLeft == 0 {
 		// We moved all of the records to the new bucket (note the two
 		// conditions are equivalent and both are present merely for clarity).
 		// Similar to the above, bump maxBucketCapacity and resize the bucket
 		// rather than splitting. We'll replace the old bucket with the new
 		// bucket in the directory.
 		m.maxBucketCapacity = 2*m.maxBucketCapacity + 1
+		b.close(m)
 		newb = m.installBucket(newb)
 		m.checkInvariants()
 		newb.resize(m, 2*newb.capacity+1)
@@ -1165,6 +3625,7 @@ func (b *bucket[K, V]) split(m *Map[K, V]) {
 	newb.localDepth++
 	newb.index = b.index + bucketStep(m.globalDepth(), b.localDepth)
 	m.installBucket(newb)
+	m.splits++
 
 	if invariants {
 		m.checkInvariants()
@@ -1259,80 +3720,117 @@ func (b *bucket[K, V]) rehashInPlace(m *Map[K, V]) {
 			target, b.ctrls.Get(target)))
 	}
 
-	b.resetGrowthLeft()
+	b.resetGrowthLeft(m)
 	b.growthLeft -= b.used
 
 	b.checkInvariants(m)
 }
 
-func (b *bucket[K, V]) resetGrowthLeft() {
-	if b.capacity < groupSize {
-		// If the map fits in a single group then we're able to fill all of
+func (b *bucket[K, V]) resetGrowthLeft(m *Map[K, V]) {
+	b.growthLeft = int(m.maxGrowth(b.capacity))
+}
+
+// maxGrowth returns the maximum number of entries a bucket with the specified
+// capacity can hold as determined by the map's maximum load factor.
+func (m *Map[K, V]) maxGrowth(capacity uintptr) uintptr {
+	if capacity < groupSize {
+		// If the bucket fits in a single group then we're able to fill all of
 		// the slots except 1 (an empty slot is needed to terminate find
 		// operations).
-		b.growthLeft = int(b.capacity - 1)
-	} else {
-		b.growthLeft = int((b.capacity * maxAvgGroupLoad) / groupSize)
-	}
-	if b.growthLeft < 0 {
-		b.growthLeft = 0
+		if capacity == 0 {
+			return 0
+		}
+		return capacity - 1
 	}
+	return (capacity * m.maxLoad) >> loadFactorShift
 }
 
 func (b *bucket[K, V]) checkInvariants(m *Map[K, V]) {
 	if invariants {
-		if b.capacity > 0 {
-			// Verify the cloned control bytes are good.
-			for i, n := uintptr(0), uintptr(groupSize-1); i < n; i++ {
-				j := ((i - (groupSize - 1)) & b.capacity) + (groupSize - 1)
-				ci := b.ctrls.Get(i)
-				cj := b.ctrls.Get(j)
-				if ci != cj {
-					panic(fmt.Sprintf("invariant failed: ctrl(%d)=%02x != ctrl(%d)=%02x\n%#v", i, ci, j, cj, b))
-				}
-			}
-			// Verify the sentinel is good.
-			if c := b.ctrls.Get(b.capacity); c != ctrlSentinel {
-				panic(fmt.Sprintf("invariant failed: ctrl(%d): expected sentinel, but found %02x\n%#v", b.capacity, c, b))
+		if err := b.validate(m); err != nil {
+			panic(fmt.Sprintf("invariant failed: %v\n%#v", err, b))
+		}
+	}
+}
+
+// validate returns an error describing the first inconsistency found in the
+// bucket, including its old table if it is being incrementally resized, or nil
+// if it is consistent.
+func (b *bucket[K, V]) validate(m *Map[K, V]) error {
+	if b.capacity > 0 {
+		// Verify the cloned control bytes are good.
+		for i, n := uintptr(0), uintptr(groupSize-1); i < n; i++ {
+			j := ((i - (groupSize - 1)) & b.capacity) + (groupSize - 1)
+			ci := b.ctrls.Get(i)
+			cj := b.ctrls.Get(j)
+			if ci != cj {
+				return fmt.Errorf("ctrl(%d)=%02x != ctrl(%d)=%02x", i, ci, j, cj)
 			}
 		}
+		// Verify the sentinel is good.
+		if c := b.ctrls.Get(b.capacity); c != ctrlSentinel {
+			return fmt.Errorf("ctrl(%d): expected sentinel, but found %02x", b.capacity, c)
+		}
+	}
 
-		// For every non-empty slot, verify we can retrieve the key using Get.
-		// Count the number of used and deleted slots.
-		var used int
-		var deleted int
-		var empty int
-		for i := uintptr(0); i < b.capacity; i++ {
-			c := b.ctrls.Get(i)
-			switch {
-			case c == ctrlDeleted:
+	// For every non-empty slot, verify that probing for the key finds it in
+	// this slot. Count the number of used and deleted slots.
+	var used int
+	var deleted int
+	for i := uintptr(0); i < b.capacity; i++ {
+		c := b.ctrls.Get(i)
+		switch {
+		case i < b.migrated:
+			// The entry has been migrated out of this old table. See
+			// bucket.migrated.
+			if c == ctrlDeleted {
 				deleted++
-			case c == ctrlEmpty:
-				empty++
-			case c == ctrlSentinel:
-				panic(fmt.Sprintf("invariant failed: ctrl(%d): unexpected sentinel", i))
-			default:
-				s := b.slots.At(i)
-				if _, ok := m.Get(s.key); !ok {
-					h := m.hash(noescape(unsafe.Pointer(&s.key)), m.seed)
-					panic(fmt.Sprintf("invariant failed: slot(%d): %v not found [h2=%02x h1=%07x]\n%#v",
-						i, s.key, h2(h), h1(h), b))
-				}
-				used++
+			}
+		case c == ctrlDeleted:
+			deleted++
+		case c == ctrlEmpty:
+		case c == ctrlSentinel:
+			return fmt.Errorf("ctrl(%d): unexpected sentinel", i)
+		default:
+			used++
+			s := b.slots.At(i)
+			if s.key != s.key {
+				// A key which is not equal to itself (i.e. NaN) can never be
+				// found.
+				continue
+			}
+			h := m.hash(noescape(unsafe.Pointer(&s.key)), m.seed)
+			fb, fi, ok := m.find(h, s.key)
+			if !ok {
+				return fmt.Errorf("slot(%d): %v not found [h2=%02x h1=%07x]",
+					i, s.key, h2(h), h1(h))
+			}
+			if fb != b || fi != i {
+				return fmt.Errorf("slot(%d): %v found in slot(%d) of bucket %d",
+					i, s.key, fi, fb.index)
 			}
 		}
+	}
 
-		if used != b.used {
-			panic(fmt.Sprintf("invariant failed: found %d used slots, but used count is %d\n%#v",
-				used, b.used, b))
-		}
+	if used != b.used {
+		return fmt.Errorf("found %d used slots, but used count is %d", used, b.used)
+	}
+
+	growthLeft := int(m.maxGrowth(b.capacity)-uintptr(b.used)) - deleted
+	if growthLeft != b.growthLeft {
+		return fmt.Errorf("found %d growthLeft, but expected %d", b.growthLeft, growthLeft)
+	}
 
-		growthLeft := int((b.capacity*maxAvgGroupLoad)/groupSize-uintptr(b.used)) - deleted
-		if growthLeft != b.growthLeft {
-			panic(fmt.Sprintf("invariant failed: found %d growthLeft, but expected %d\n%#v",
-				b.growthLeft, growthLeft, b))
+	if b.old != nil {
+		if b.growthLeft < b.old.used {
+			return fmt.Errorf("growthLeft=%d is less than the %d entries to migrate",
+				b.growthLeft, b.old.used)
+		}
+		if err := b.old.validate(m); err != nil {
+			return fmt.Errorf("old table: %w", err)
 		}
 	}
+	return nil
 }
 
 // GoString implements the fmt.GoStringer interface which is used when
@@ -1360,126 +3858,6 @@ func (b *bucket[K, V]) goFormat(w io.Writer) {
 	}
 }
 
-// bitset represents a set of slots within a group.
-//
-// The underlying representation uses one byte per slot, where each byte is
-// either 0x80 if the slot is part of the set or 0x00 otherwise. This makes it
-// convenient to calculate for an entire group at once (e.g. see matchEmpty).
-type bitset uint64
-
-// first assumes that only the MSB of each control byte can be set (e.g. bitset
-// is the result of matchEmpty or similar) and returns the relative index of the
-// first control byte in the group that has the MSB set.
-//
-// Returns 8 if the bitset is 0.
-// Returns groupSize if the bitset is empty.
-func (b bitset) first() uintptr {
-	return uintptr(bits.TrailingZeros64(uint64(b))) >> 3
-}
-
-// Returns the maximal number of contiguous slots at the beginning of the group
-// that are NOT in the set.
-func (b bitset) absentAtStart() uintptr {
-	return b.first()
-}
-
-// Returns the maximal number of contiguous slots at the end of the group that
-// are NOT in the set.
-func (b bitset) absentAtEnd() uintptr {
-	return uintptr(bits.LeadingZeros64(uint64(b))) >> 3
-}
-
-// remove removes the slot with the given relative index.
-func (b bitset) remove(i uintptr) bitset {
-	return b &^ (bitset(0x80) << (i << 3))
-}
-
-func (b bitset) String() string {
-	var buf strings.Builder
-	buf.Grow(groupSize)
-	for i := 0; i < groupSize; i++ {
-		if (b & (bitset(0x80) << (i << 3))) != 0 {
-			buf.WriteString("1")
-		} else {
-			buf.WriteString("0")
-		}
-	}
-	return buf.String()
-}
-
-// ctrlGroup contains a group of 8 control bytes (in little-endian). Note that a
-// group can start at any control byte (not just those that are 8-byte aligned).
-type ctrlGroup uint64
-
-// matchH2 returns the set of slots which are full and for which the 7-bit hash
-// matches the given value. May return false positives.
-func (g *ctrlGroup) matchH2(h uintptr) bitset {
-	// NB: This generic matching routine produces false positive matches when
-	// h is 2^N and the control bytes have a seq of 2^N followed by 2^N+1. For
-	// example: if ctrls==0x0302 and h=02, we'll compute v as 0x0100. When we
-	// subtract off 0x0101 the first 2 bytes we'll become 0xffff and both be
-	// considered matches of h. The false positive matches are not a problem,
-	// just a rare inefficiency. Note that they only occur if there is a real
-	// match and never occur on ctrlEmpty, ctrlDeleted, or ctrlSentinel. The
-	// subsequent key comparisons ensure that there is no correctness issue.
-	v := uint64(*g) ^ (bitsetLSB * uint64(h))
-	return bitset(((v - bitsetLSB) &^ v) & bitsetMSB)
-}
-
-// matchEmpty returns the set of slots in the group that are empty.
-func (g *ctrlGroup) matchEmpty() bitset {
-	// An empty slot is              1000 0000
-	// A deleted or sentinel slot is 1111 111?
-	// A full slot is                0??? ????
-	//
-	// A slot is empty iff bit 7 is set and bit 1 is not.
-	// We could select any of the other bits here (e.g. v << 1 would also
-	// work).
-	v := uint64(*g)
-	return bitset((v &^ (v << 6)) & bitsetMSB)
-}
-
-// matchEmptyOrDeleted returns the set of slots in the group that are empty or
-// deleted.
-func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
-	// An empty slot is  1000 0000.
-	// A deleted slot is 1111 1110.
-	// The sentinel is   1111 1111.
-	// A full slot is    0??? ????
-	//
-	// A slot is empty or deleted iff bit 7 is set and bit 0 is not.
-	v := uint64(*g)
-	return bitset((v &^ (v << 7)) & bitsetMSB)
-}
-
-// convertNonFullToEmptyAndFullToDeleted converts deleted or sentinel control
-// bytes in a group to empty control bytes, and control bytes indicating full
-// slots to deleted control bytes.
-func (g *ctrlGroup) convertNonFullToEmptyAndFullToDeleted() {
-	// An empty slot is     1000 0000
-	// A deleted slot is    1111 1110
-	// The sentinel slot is 1111 1111
-	// A full slot is       0??? ????
-	//
-	// We select the MSB, invert, add 1 if the MSB was set and zero out the low
-	// bit.
-	//
-	//  - if the MSB was set (i.e. slot was empty, deleted, or sentinel):
-	//     v:             1000 0000
-	//     ^v:            0111 1111
-	//     ^v + (v >> 7): 1000 0000
-	//     &^ bitsetLSB:  1000 0000 = empty slot.
-	//
-	// - if the MSB was not set (i.e. full slot):
-	//     v:             0000 0000
-	//     ^v:            1111 1111
-	//     ^v + (v >> 7): 1111 1111
-	//     &^ bitsetLSB:  1111 1110 = deleted slot.
-	//
-	v := uint64(*g) & bitsetMSB
-	*g = ctrlGroup((^v + (v >> 7)) &^ bitsetLSB)
-}
-
 // Each slot in the hash table has a control byte which can have one of four
 // states: empty, deleted, full and the sentinel. They have the following bit
 // patterns:
@@ -1501,13 +3879,15 @@ func makeCtrlBytes(s []ctrl) ctrlBytes {
 
 // Get returns the i-th control byte.
 func (cb ctrlBytes) Get(i uintptr) ctrl {
+	cb.checkIndex(i)
 	return *(*ctrl)(unsafe.Add(cb.ptr, i))
 }
 
 // GroupAt returns a pointer to the group that starts at i. The ctrlGroup
-// contains the values of control bytes i through i+7. A group can start at any
-// index (it does not have to be 8-byte aligned).
+// contains the values of control bytes i through i+groupSize-1. A group can
+// start at any index (it does not have to be aligned).
 func (cb ctrlBytes) GroupAt(i uintptr) *ctrlGroup {
+	cb.checkRange(i, i+groupSize)
 	return (*ctrlGroup)(unsafe.Add(cb.ptr, i))
 }
 
@@ -1593,23 +3973,33 @@ func noescape(p unsafe.Pointer) unsafe.Pointer {
 }
 
 // unsafeSlice provides semi-ergonomic limited slice-like functionality
-// without bounds checking for fixed sized slices.
+// without bounds checking for fixed sized slices. When built with
+// "swiss_invariants", accesses are bounds checked against the length of the
+// slice the unsafeSlice was made from.
 type unsafeSlice[T any] struct {
+	// sliceLen is zero-sized unless invariants are enabled. It precedes ptr
+	// so that it does not cause the struct to be padded.
+	sliceLen
 	ptr unsafe.Pointer
 }
 
 func makeUnsafeSlice[T any](s []T) unsafeSlice[T] {
-	return unsafeSlice[T]{ptr: unsafe.Pointer(unsafe.SliceData(s))}
+	return unsafeSlice[T]{
+		sliceLen: makeSliceLen(len(s)),
+		ptr:      unsafe.Pointer(unsafe.SliceData(s)),
+	}
 }
 
 // At returns a pointer to the element at index i.
 func (s unsafeSlice[T]) At(i uintptr) *T {
+	s.checkIndex(i)
 	var t T
 	return (*T)(unsafe.Add(s.ptr, unsafe.Sizeof(t)*i))
 }
 
 // Slice returns a Go slice akin to slice[start:end] for a Go builtin slice.
 func (s unsafeSlice[T]) Slice(start, end uintptr) []T {
+	s.checkRange(start, end)
 	return unsafe.Slice((*T)(s.ptr), end)[start:end]
 }
 
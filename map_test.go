@@ -15,10 +15,20 @@
 package swiss
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
 	"math"
+	"math/bits"
 	"math/rand"
+	"reflect"
+	"runtime"
+	"slices"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
@@ -26,10 +36,6 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-// TODO(peter):
-// - Add metamorphic tests that cross-check behavior at various bucket sizes.
-// - Add fuzz testing.
-
 // toBuiltinMap returns the elements as a map[K]V. Useful for testing.
 func (m *Map[K, V]) toBuiltinMap() map[K]V {
 	r := make(map[K]V)
@@ -40,10 +46,9 @@ func (m *Map[K, V]) toBuiltinMap() map[K]V {
 	return r
 }
 
-// TODO(peter): Extracting a random element might be generally useful. Should
-// this be promoted to the public API? Note that the elements are not selected
-// uniformly randomly. If we promote this method to the public API it should
-// take a rand.Rand.
+// randElement returns a random element from the map. Note that the elements
+// are not selected uniformly randomly. See RandomElement for a version which
+// selects elements uniformly.
 func (m *Map[K, V]) randElement() (key K, value V, ok bool) {
 	// Rely on random iteration order to give us a random element.
 	m.All(func(k K, v V) bool {
@@ -63,6 +68,28 @@ func TestLittleEndian(t *testing.T) {
 	require.EqualValues(t, 0x04030201, v)
 }
 
+func TestUnsafeSliceBounds(t *testing.T) {
+	s := makeUnsafeSlice(make([]int, 4))
+	cb := makeCtrlBytes(make([]ctrl, groupSize+1))
+	require.NotPanics(t, func() {
+		*s.At(3) = 1
+		_ = s.Slice(1, 4)
+		_ = cb.Get(groupSize)
+		_ = cb.GroupAt(1)
+	})
+	if !invariants {
+		// Without invariants the bounds are not checked, and tracking them
+		// must not make unsafeSlice any larger than a pointer.
+		require.EqualValues(t, unsafe.Sizeof(uintptr(0)), unsafe.Sizeof(s))
+		return
+	}
+	require.Panics(t, func() { s.At(4) })
+	require.Panics(t, func() { s.Slice(2, 5) })
+	require.Panics(t, func() { s.Slice(3, 2) })
+	require.Panics(t, func() { cb.Get(groupSize + 1) })
+	require.Panics(t, func() { cb.GroupAt(2) })
+}
+
 func TestProbeSeq(t *testing.T) {
 	genSeq := func(n int, hash, mask uintptr) []uintptr {
 		seq := makeProbeSeq(hash, mask)
@@ -85,26 +112,40 @@ func TestProbeSeq(t *testing.T) {
 	}
 
 	// The Abseil probeSeq test cases.
-	expected := []uintptr{0, 8, 24, 48, 80, 120, 40, 96, 32, 104, 56, 16, 112, 88, 72, 64}
-	require.Equal(t, expected, genSeq(16, 0, 127))
-	require.Equal(t, expected, genSeq(16, 128, 127))
+	if groupSize == 8 {
+		expected := []uintptr{0, 8, 24, 48, 80, 120, 40, 96, 32, 104, 56, 16, 112, 88, 72, 64}
+		require.Equal(t, expected, genSeq(16, 0, 127))
+		require.Equal(t, expected, genSeq(16, 128, 127))
+	}
 
 	// Verify that we touch all of the groups no matter what our start offset
 	// within the group is.
+	const n = 128 / groupSize
 	for i := uintptr(0); i < 128; i++ {
-		vals := genSeq(16, i, 127)
-		require.Equal(t, 16, len(vals))
+		vals := genSeq(n, i, 127)
+		require.Equal(t, n, len(vals))
 		sort.Slice(vals, func(i, j int) bool {
 			return vals[i] < vals[j]
 		})
-		require.Equal(t, genGroups(16, i, 128), vals)
+		require.Equal(t, genGroups(n, i, 128), vals)
+	}
+}
+
+// makeGroup returns a group containing the specified control bytes followed
+// by full control bytes (with an H2 of 0x7f) up to groupSize.
+func makeGroup(ctrls []ctrl) *ctrlGroup {
+	padded := make([]ctrl, groupSize)
+	for i := range padded {
+		padded[i] = 0x7f
 	}
+	copy(padded, ctrls)
+	return makeCtrlBytes(padded).GroupAt(0)
 }
 
 func TestMatchH2(t *testing.T) {
 	ctrls := []ctrl{0x1, 0x2, 0x3, 0x4, 0x5, 0x6, 0x7, 0x8}
 	for i := uintptr(1); i <= 8; i++ {
-		match := makeCtrlBytes(ctrls).GroupAt(0).matchH2(i)
+		match := makeGroup(ctrls).matchH2(i)
 		bit := match.first()
 		require.EqualValues(t, i-1, bit)
 	}
@@ -121,7 +162,7 @@ func TestMatchEmpty(t *testing.T) {
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
-			match := makeCtrlBytes(c.ctrls).GroupAt(0).matchEmpty()
+			match := makeGroup(c.ctrls).matchEmpty()
 			var results []uintptr
 			for match != 0 {
 				idx := match.first()
@@ -143,7 +184,7 @@ func TestMatchEmptyOrDeleted(t *testing.T) {
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
-			match := makeCtrlBytes(c.ctrls).GroupAt(0).matchEmptyOrDeleted()
+			match := makeGroup(c.ctrls).matchEmptyOrDeleted()
 			var results []uintptr
 			for match != 0 {
 				idx := match.first()
@@ -155,6 +196,51 @@ func TestMatchEmptyOrDeleted(t *testing.T) {
 	}
 }
 
+// TestMatchRandom cross-checks the group matching routines against a
+// byte-at-a-time reference on random groups. It is run against both the
+// generic and the swiss_simd implementations.
+func TestMatchRandom(t *testing.T) {
+	ctrlValues := []ctrl{ctrlEmpty, ctrlDeleted, ctrlSentinel, 0x0, 0x1, 0x2, 0x3, 0x7f}
+	ref := func(ctrls []ctrl, pred func(c ctrl) bool) bitset {
+		var b bitset
+		for i, c := range ctrls {
+			if pred(c) {
+				b |= slotBitset(uintptr(i))
+			}
+		}
+		return b
+	}
+
+	ctrls := make([]ctrl, groupSize)
+	for iter := 0; iter < 10000; iter++ {
+		for i := range ctrls {
+			if rand.Intn(2) == 0 {
+				ctrls[i] = ctrlValues[rand.Intn(len(ctrlValues))]
+			} else {
+				ctrls[i] = ctrl(rand.Intn(128))
+			}
+		}
+		g := makeCtrlBytes(ctrls).GroupAt(0)
+
+		require.Equal(t, ref(ctrls, func(c ctrl) bool { return c == ctrlEmpty }),
+			g.matchEmpty(), "%x", ctrls)
+		require.Equal(t, ref(ctrls, func(c ctrl) bool { return c == ctrlEmpty || c == ctrlDeleted }),
+			g.matchEmptyOrDeleted(), "%x", ctrls)
+
+		// matchH2 may return false positives, but only on full slots and only
+		// if there is also a true match.
+		h := uintptr(ctrls[rand.Intn(groupSize)] & 0x7f)
+		exact := ref(ctrls, func(c ctrl) bool { return c == ctrl(h) })
+		full := ref(ctrls, func(c ctrl) bool { return c&ctrlEmpty == 0 })
+		match := g.matchH2(h)
+		require.Equal(t, exact, match&exact, "%x %x", ctrls, h)
+		require.Equal(t, match, match&full, "%x %x", ctrls, h)
+		if exact == 0 {
+			require.EqualValues(t, 0, match, "%x %x", ctrls, h)
+		}
+	}
+}
+
 func TestConvertNonFullToEmptyAndFullToDeleted(t *testing.T) {
 	ctrls := make([]ctrl, groupSize)
 	expected := make([]ctrl, groupSize)
@@ -182,71 +268,72 @@ func TestConvertNonFullToEmptyAndFullToDeleted(t *testing.T) {
 }
 
 func TestAbsentAt(t *testing.T) {
+	// The sets specify the first 8 slots of the group. The remaining slots
+	// are not in the set.
+	const pad = groupSize - 8
 	testCases := []struct {
 		set   string
 		start uintptr
 		end   uintptr
 	}{
-		{set: "01001100", start: 1, end: 2},
-		{set: "11001000", start: 0, end: 3},
-		{set: "00001001", start: 4, end: 0},
-		{set: "10001001", start: 0, end: 0},
-		{set: "00000000", start: 8, end: 8},
+		{set: "01001100", start: 1, end: 2 + pad},
+		{set: "11001000", start: 0, end: 3 + pad},
+		{set: "00001001", start: 4, end: 0 + pad},
+		{set: "10001001", start: 0, end: 0 + pad},
+		{set: "00000000", start: groupSize, end: groupSize},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
 			b := bitsetFromString(t, c.set)
 			require.Equal(t, c.start, b.absentAtStart())
 			require.Equal(t, c.end, b.absentAtEnd())
+			require.Equal(t, c.set+strings.Repeat("0", pad), b.String())
 		})
 	}
 }
 
 func bitsetFromString(t *testing.T, str string) bitset {
-	require.Equal(t, 8, len(str))
+	require.LessOrEqual(t, len(str), groupSize)
 	var b bitset
-	for i := 0; i < 8; i++ {
+	for i := 0; i < len(str); i++ {
 		require.True(t, str[i] == '0' || str[i] == '1')
 		if str[i] == '1' {
-			b |= 0x80 << (i * 8)
+			b |= slotBitset(uintptr(i))
 		}
 	}
 	return b
 }
 
 func TestWasNeverFull(t *testing.T) {
+	const capacity = 2*groupSize - 1
 	b := &bucket[int, int]{
-		capacity: 15,
-		ctrls:    makeCtrlBytes(make([]ctrl, 16)),
+		capacity: capacity,
+		ctrls:    makeCtrlBytes(make([]ctrl, capacity+1)),
 	}
 
-	testCases := []struct {
+	type testCase struct {
 		emptyIndexes []uintptr
 		expected     bool
-	}{
+	}
+	testCases := []testCase{
 		{[]uintptr{}, false},
 		{[]uintptr{0}, false},
-		{[]uintptr{0, 15}, true},
-		{[]uintptr{1, 15}, true},
-		{[]uintptr{2, 15}, true},
-		{[]uintptr{3, 15}, true},
-		{[]uintptr{4, 15}, true},
-		{[]uintptr{5, 15}, true},
-		{[]uintptr{6, 15}, true},
-		{[]uintptr{7, 15}, true},
-		{[]uintptr{8, 15}, false},
-		{[]uintptr{0, 14}, true},
-		{[]uintptr{0, 13}, true},
-		{[]uintptr{0, 12}, true},
-		{[]uintptr{0, 11}, true},
-		{[]uintptr{0, 10}, true},
-		{[]uintptr{0, 9}, true},
-		{[]uintptr{0, 8}, true},
-		{[]uintptr{0, 7}, false},
 	}
+	// An empty slot within the group starting at 0 and an empty slot before
+	// it means slot 0 was never part of a full group.
+	for i := uintptr(0); i < groupSize; i++ {
+		testCases = append(testCases, testCase{[]uintptr{i, capacity}, true})
+	}
+	testCases = append(testCases, testCase{[]uintptr{groupSize, capacity}, false})
+	// Similarly for an empty slot within the group ending before slot 0.
+	for i := uintptr(capacity - 1); i >= groupSize; i-- {
+		testCases = append(testCases, testCase{[]uintptr{0, i}, true})
+	}
+	testCases = append(testCases, testCase{[]uintptr{0, groupSize - 1}, false})
+
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
-			for i := uintptr(0); i < 16; i++ {
+			for i := uintptr(0); i <= capacity; i++ {
 				*b.ctrls.At(i) = 0
 			}
 			for _, i := range c.emptyIndexes {
@@ -257,7 +344,180 @@ func TestWasNeverFull(t *testing.T) {
 	}
 }
 
+func TestInitialBuckets(t *testing.T) {
+	for _, n := range []int{1, 2, 8, 64} {
+		for _, initialCapacity := range []int{0, 10_000} {
+			t.Run(fmt.Sprintf("n=%d/cap=%d", n, initialCapacity), func(t *testing.T) {
+				// Buckets are never split so that the layout is determined
+				// only by WithInitialBuckets.
+				m := New[int, int](initialCapacity, WithInitialBuckets[int, int](n),
+					WithMaxBucketCapacity[int, int](math.MaxUint64))
+				require.EqualValues(t, n, m.bucketCount())
+				require.EqualValues(t, n, m.BucketCount())
+				if initialCapacity > 0 {
+					require.GreaterOrEqual(t, m.Cap(), initialCapacity)
+				}
+
+				// Keys are routed to buckets by the high bits of their hash.
+				d := bits.TrailingZeros(uint(n))
+				for i := 0; i < 1000; i++ {
+					h := m.Hash(i)
+					require.EqualValues(t, uint64(h)>>(64-d), m.bucket(h).index)
+				}
+
+				e := make(map[int]int)
+				for i := 0; i < 10_000; i++ {
+					k, v := rand.Int(), rand.Int()
+					m.Put(k, v)
+					e[k] = v
+				}
+				require.Equal(t, e, m.toBuiltinMap())
+				require.EqualValues(t, n, m.BucketCount())
+
+				// The layout is retained when the map is cleared or rebuilt.
+				m.Clear()
+				require.EqualValues(t, n, m.BucketCount())
+				m.Shrink()
+				require.EqualValues(t, n, m.BucketCount())
+				require.EqualValues(t, n, m.Clone().BucketCount())
+			})
+		}
+	}
+
+	require.Panics(t, func() { WithInitialBuckets[int, int](0) })
+	require.Panics(t, func() { WithInitialBuckets[int, int](3) })
+}
+
+func TestLoadBuckets(t *testing.T) {
+	for _, n := range []int{1, 8, 64} {
+		for _, maxBucketCapacity := range []uintptr{defaultMaxBucketCapacity, 31} {
+			t.Run(fmt.Sprintf("n=%d/max=%d", n, maxBucketCapacity), func(t *testing.T) {
+				a := &countingAllocator[int, int]{}
+				m := New[int, int](0, WithInitialBuckets[int, int](n),
+					WithMaxBucketCapacity[int, int](maxBucketCapacity),
+					WithAllocator[int, int](a))
+				e := make(map[int]int)
+				for i := 0; i < 100; i++ {
+					m.Put(-i, i)
+					e[-i] = i
+				}
+
+				// Partition the input by bucket. Keys are repeated in order to
+				// exercise overwriting existing entries.
+				parts := make(map[int][]int)
+				for i := 0; i < 20_000; i++ {
+					k := rand.Intn(15_000)
+					parts[m.BucketIndex(k)] = append(parts[m.BucketIndex(k)], k)
+					e[k] = k
+				}
+				dirSize, buckets := m.bucketCount(), m.BucketCount()
+				var calls atomic.Int32
+				m.LoadBuckets(func(i int, put func(key, value int)) {
+					calls.Add(1)
+					for _, k := range parts[i] {
+						put(k, k)
+					}
+				})
+				require.EqualValues(t, dirSize, calls.Load())
+				if dirSize > 1 {
+					// Buckets are not split while they are loaded in parallel.
+					require.EqualValues(t, buckets, m.BucketCount())
+				}
+				require.EqualValues(t, len(e), m.Len())
+				require.Equal(t, e, m.toBuiltinMap())
+				require.NoError(t, m.Validate())
+				require.EqualValues(t, a.alloc, m.Stats().Allocs)
+				require.EqualValues(t, a.free, m.Stats().Frees)
+
+				// Buckets which grew beyond the max bucket capacity are split
+				// by later insertions.
+				for i := 0; i < 20_000; i++ {
+					m.Put(i+15_000, i)
+					e[i+15_000] = i
+				}
+				require.Equal(t, e, m.toBuiltinMap())
+				if maxBucketCapacity == 31 {
+					require.Greater(t, m.BucketCount(), buckets)
+				}
+
+				m.Close()
+				require.EqualValues(t, a.alloc, a.free)
+			})
+		}
+	}
+
+	// A key belonging to a different bucket is rejected.
+	m := New[int, int](0, WithInitialBuckets[int, int](4))
+	k := 0
+	for m.BucketIndex(k) == 0 {
+		k++
+	}
+	require.Panics(t, func() {
+		m.LoadBuckets(func(i int, put func(key, value int)) {
+			if i == 0 {
+				put(k, k)
+			}
+		})
+	})
+	require.NoError(t, m.Validate())
+}
+
+func TestZeroValue(t *testing.T) {
+	var m Map[int, int]
+
+	// Lookups, deletions, and iteration do not initialize the map.
+	require.EqualValues(t, 0, m.Len())
+	_, ok := m.Get(1)
+	require.False(t, ok)
+	require.EqualValues(t, -1, m.GetOrDefault(1, -1))
+	require.False(t, m.Contains(1))
+	require.Nil(t, m.GetPtr(1))
+	m.All(func(k, v int) bool {
+		t.Fatalf("unexpected entry %d", k)
+		return true
+	})
+	m.Delete(1)
+	_, ok = m.Pop(1)
+	require.False(t, ok)
+	require.False(t, m.Update(1, func(v int) int { return v }))
+	require.False(t, CompareAndSwap(&m, 1, 0, 1))
+	require.False(t, CompareAndDelete(&m, 1, 0))
+	_, found := m.GetBatch([]int{1, 2}, nil, nil)
+	require.Equal(t, []bool{false, false}, found)
+	require.EqualValues(t, 0, m.Cap())
+	require.Nil(t, m.hash)
+
+	// The first insertion initializes the map with the default options.
+	m.Put(1, 1)
+	require.NotNil(t, m.hash)
+	require.Equal(t, defaultAllocator[int, int]{}, m.allocator)
+	require.EqualValues(t, defaultMaxBucketCapacity, m.maxBucketCapacity)
+	require.EqualValues(t, defaultMaxLoad, m.maxLoad)
+	v, ok := m.Get(1)
+	require.True(t, ok)
+	require.EqualValues(t, 1, v)
+
+	for i := 0; i < 10_000; i++ {
+		m.Put(i, i)
+	}
+	require.EqualValues(t, 10_000, m.Len())
+
+	// Other insertion operations initialize the map too.
+	var a Map[int, int]
+	a.GetOrPut(1, 1)
+	require.Equal(t, map[int]int{1: 1}, a.toBuiltinMap())
+	var b Map[int, []int]
+	Append(&b, 1, 1)
+	require.Equal(t, map[int][]int{1: {1}}, b.toBuiltinMap())
+	var c Map[int, int]
+	c.Grow(100)
+	require.GreaterOrEqual(t, c.Cap(), 100)
+}
+
 func TestInitialCapacity(t *testing.T) {
+	if groupSize != 8 {
+		t.Skip("the expected capacities assume 8-wide groups")
+	}
 	testCases := []struct {
 		initialCapacity   int
 		maxBucketCapacity uintptr
@@ -278,196 +538,2712 @@ func TestInitialCapacity(t *testing.T) {
 			m := New[int, int](c.initialCapacity,
 				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
 			require.EqualValues(t, c.expectedBuckets, m.bucketCount())
-			require.EqualValues(t, c.expectedCapacity, m.capacity())
+			require.EqualValues(t, c.expectedCapacity, m.Cap())
+
+			capacity, buckets := SizeFor(c.initialCapacity, c.maxBucketCapacity)
+			require.EqualValues(t, c.expectedBuckets, buckets)
+			require.EqualValues(t, c.expectedCapacity, capacity)
 		})
 	}
 }
 
-func TestBasic(t *testing.T) {
-	test := func(t *testing.T, m *Map[int, int]) {
-		const count = 100
-
-		e := make(map[int]int)
-		require.EqualValues(t, 0, m.Len())
-		require.EqualValues(t, 0, m.bucket0.growthLeft)
-
-		// Non-existent.
-		for i := 0; i < count; i++ {
-			_, ok := m.Get(i)
-			require.False(t, ok)
+func TestSizeFor(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{0, 7, 100, 4095, math.MaxUint64} {
+		for n := 0; n < 20_000; n = n*5/4 + 1 {
+			m := New[int, int](n, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			capacity, buckets := SizeFor(n, maxBucketCapacity)
+			require.EqualValues(t, m.bucketCount(), buckets)
+			require.EqualValues(t, m.Cap(), capacity)
 		}
+	}
+}
 
-		// Insert.
-		for i := 0; i < count; i++ {
-			m.Put(i, i+count)
-			e[i] = i + count
-			v, ok := m.Get(i)
-			require.True(t, ok)
-			require.EqualValues(t, i+count, v)
-			require.EqualValues(t, i+1, m.Len())
-			require.Equal(t, e, m.toBuiltinMap())
-		}
+func TestInitialCapacityOverflow(t *testing.T) {
+	// Initial capacities too large to be allocated are ignored rather than
+	// overflowing the sizing arithmetic into a tiny or negative capacity.
+	for _, maxBucketCapacity := range []uintptr{7, 4095, math.MaxUint64} {
+		for _, n := range []int{
+			maxAlloc + 1, 1 << 54, 1 << 62, math.MaxInt / 2, math.MaxInt - 1, math.MaxInt,
+		} {
+			capacity, buckets := SizeFor(n, maxBucketCapacity)
+			require.EqualValues(t, 0, capacity, "n=%d", n)
+			require.EqualValues(t, 1, buckets, "n=%d", n)
 
-		// Update.
-		for i := 0; i < count; i++ {
-			m.Put(i, i+2*count)
-			e[i] = i + 2*count
-			v, ok := m.Get(i)
-			require.True(t, ok)
-			require.EqualValues(t, i+2*count, v)
-			require.EqualValues(t, count, m.Len())
-			require.Equal(t, e, m.toBuiltinMap())
-		}
+			m := New[int, int](n, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			require.EqualValues(t, 0, m.Cap())
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			for i := 0; i < 100; i++ {
+				v, ok := m.Get(i)
+				require.True(t, ok)
+				require.EqualValues(t, i, v)
+			}
 
-		// Delete.
-		for i := 0; i < count; i++ {
-			m.Delete(i)
-			delete(e, i)
-			require.EqualValues(t, count-i-1, m.Len())
-			_, ok := m.Get(i)
-			require.False(t, ok)
-			require.Equal(t, e, m.toBuiltinMap())
+			// Growing by an unallocatable amount leaves the map unchanged.
+			c := m.Cap()
+			m.Grow(n)
+			require.EqualValues(t, c, m.Cap())
+			require.EqualValues(t, 100, m.Len())
 		}
-	}
 
-	t.Run("normal", func(t *testing.T) {
-		test(t, New[int, int](0))
-	})
+		// The size of the slots is taken into account.
+		m := New[int, int](maxAlloc/2, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		require.EqualValues(t, 0, m.Cap())
 
-	t.Run("degenerate", func(t *testing.T) {
-		testDegenerate := func(t *testing.T, h uintptr) {
-			m := New[int, int](0,
-				WithHash[int, int](func(key *int, seed uintptr) uintptr {
-					return h
-				}),
-				WithMaxBucketCapacity[int, int](7))
-			test(t, m)
+		// The buckets requested by WithInitialBuckets are still allocated.
+		options := []option[int, int]{
+			WithMaxBucketCapacity[int, int](maxBucketCapacity),
+			WithInitialBuckets[int, int](4),
 		}
+		m = New[int, int](math.MaxInt, options...)
+		require.EqualValues(t, New[int, int](0, options...).Cap(), m.Cap())
+		require.EqualValues(t, 4, m.bucketCount())
+	}
 
-		for _, v := range []uintptr{0, ^uintptr(0)} {
-			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
-				testDegenerate(t, v)
-			})
-		}
-		for i := 0; i < 10; i++ {
-			v := uintptr(rand.Uint64())
-			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
-				testDegenerate(t, v)
-			})
-		}
-	})
+	// Large but allocatable capacities are honored.
+	capacity, _ := SizeFor(1<<40, math.MaxUint64)
+	require.LessOrEqual(t, 1<<40, capacity)
 }
 
-func TestRandom(t *testing.T) {
-	test := func(t *testing.T, m *Map[int, int]) {
-		e := make(map[int]int)
-		for i := 0; i < 10000; i++ {
-			switch r := rand.Float64(); {
-			case r < 0.5: // 50% inserts
-				k, v := rand.Int(), rand.Int()
-				m.Put(k, v)
-				e[k] = v
-			case r < 0.65: // 15% updates
-				if k, _, ok := m.randElement(); !ok {
-					require.EqualValues(t, 0, m.Len(), e)
-				} else {
-					v := rand.Int()
-					m.Put(k, v)
-					e[k] = v
-				}
-			case r < 0.80: // 15% deletes
-				if k, _, ok := m.randElement(); !ok {
-					require.EqualValues(t, 0, m.Len(), e)
-				} else {
-					m.Delete(k)
-					delete(e, k)
-				}
-			case r < 0.95: // 25% lookups
-				if k, v, ok := m.randElement(); !ok {
-					require.EqualValues(t, 0, m.Len(), e)
-				} else {
-					require.EqualValues(t, e[k], v)
-				}
-			default: // 5% rehash in place and iterate
-				m.bucket0.rehashInPlace(m)
-				require.Equal(t, e, m.toBuiltinMap())
+func TestFromGoMap(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			e := make(map[int]int)
+			for i := 0; i < 5000; i++ {
+				e[rand.Int()] = rand.Int()
 			}
+
+			a := &countingAllocator[int, int]{}
+			m := FromGoMap(e, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			require.Equal(t, e, m.toBuiltinMap())
 			require.EqualValues(t, len(e), m.Len())
-		}
+
+			// The map was sized up front and did not need to grow. Note that
+			// with multiple buckets an unlucky distribution of the keys may
+			// still require a bucket to be split.
+			if maxBucketCapacity == math.MaxUint64 {
+				require.EqualValues(t, 1, a.alloc)
+			}
+		})
 	}
 
-	t.Run("normal", func(t *testing.T) {
-		test(t, New[int, int](0))
-	})
+	m := FromGoMap(map[string]int{})
+	require.EqualValues(t, 0, m.Len())
+	require.EqualValues(t, 0, m.Cap())
+}
 
-	t.Run("degenerate", func(t *testing.T) {
-		testDegenerate := func(t *testing.T, h uintptr) {
-			m := New[int, int](0,
-				WithHash[int, int](func(key *int, seed uintptr) uintptr {
-					return h
-				}),
-				WithMaxBucketCapacity[int, int](512))
-			test(t, m)
-		}
+func TestNewFromSlices(t *testing.T) {
+	keys := make([]int, 5000)
+	values := make([]int, len(keys))
+	e := make(map[int]int)
+	for i := range keys {
+		// Repeat some of the keys.
+		keys[i] = rand.Intn(4000)
+		values[i] = rand.Int()
+		e[keys[i]] = values[i]
+	}
 
-		for _, v := range []uintptr{0, ^uintptr(0)} {
-			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
-				testDegenerate(t, v)
-			})
-		}
-	})
+	a := &countingAllocator[int, int]{}
+	m, err := NewFromSlices(keys, values, WithAllocator[int, int](a),
+		WithMaxBucketCapacity[int, int](math.MaxUint64))
+	require.NoError(t, err)
+	require.Equal(t, e, m.toBuiltinMap())
+	require.EqualValues(t, len(e), m.Len())
+	// The map was sized up front and did not need to grow.
+	require.EqualValues(t, 1, a.alloc)
+
+	empty, err := NewFromSlices[string, int](nil, nil)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, empty.Len())
+
+	_, err = NewFromSlices(keys, values[1:])
+	require.EqualError(t, err,
+		"swiss: NewFromSlices: mismatched key and value counts: 5000 != 4999")
 }
 
-func TestIterateMutate(t *testing.T) {
-	m := New[int, int](0)
-	for i := 0; i < 100; i++ {
+func TestReset(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+
+	// A heavily used map is reset to a single small bucket and all of its
+	// other memory is released.
+	m := New[int, int](0, WithAllocator[int, int](a))
+	for i := 0; i < 10_000; i++ {
 		m.Put(i, i)
 	}
-	e := m.toBuiltinMap()
-	require.EqualValues(t, 100, m.Len())
-	require.EqualValues(t, 100, len(e))
+	require.Greater(t, int(m.bucketCount()), 1)
+	m.Reset()
+	require.EqualValues(t, 0, m.Len())
+	require.EqualValues(t, 1, m.bucketCount())
+	require.EqualValues(t, resetBucketCapacity, m.Cap())
+	require.EqualValues(t, 1, a.alloc-a.free)
 
-	// Iterate over the map, resizing it periodically. We should see all of
-	// the elements that were originally in the map because All takes a
-	// snapshot of the ctrls and slots before iterating.
-	vals := make(map[int]int)
-	m.All(func(k, v int) bool {
-		if (k % 10) == 0 {
-			m.bucket0.resize(m, 2*m.bucket0.capacity+1)
+	// A lightly used map keeps its backing arrays, and can be filled up to
+	// the baseline capacity again without allocating.
+	alloc := a.alloc
+	for i := 0; i < 50; i++ {
+		m.Put(i, i)
+	}
+	m.Reset()
+	require.EqualValues(t, resetBucketCapacity, m.Cap())
+	for i := 0; i < 50; i++ {
+		_, ok := m.Get(i)
+		require.False(t, ok)
+		m.Put(i, i)
+	}
+	require.EqualValues(t, alloc, a.alloc)
+
+	// Round trip maps through a pool. Whichever map the pool returns is
+	// empty and usable.
+	pool := sync.Pool{
+		New: func() any {
+			return New[int, int](0, WithAllocator[int, int](a))
+		},
+	}
+	m.Reset()
+	pool.Put(m)
+	for i := 0; i < 10; i++ {
+		p := pool.Get().(*Map[int, int])
+		require.EqualValues(t, 0, p.Len())
+		for j := 0; j < 100*i; j++ {
+			p.Put(j, j)
 		}
-		vals[k] = v
-		return true
-	})
-	require.EqualValues(t, e, vals)
+		require.EqualValues(t, 100*i, p.Len())
+		p.Reset()
+		require.LessOrEqual(t, p.Cap(), int(resetBucketCapacity))
+		pool.Put(p)
+	}
+
+	// An unused map is left with zero capacity.
+	e := New[int, int](0, WithAllocator[int, int](a))
+	e.Reset()
+	require.EqualValues(t, 0, e.Cap())
 }
 
-func TestClear(t *testing.T) {
+func TestGrow(t *testing.T) {
 	testCases := []struct {
-		count             int
+		used              int
+		grow              int
 		maxBucketCapacity uintptr
 	}{
-		{count: 1000, maxBucketCapacity: math.MaxUint64},
-		{count: 1000, maxBucketCapacity: 7},
+		{0, 0, defaultMaxBucketCapacity},
+		{0, 1, defaultMaxBucketCapacity},
+		{3, 3, defaultMaxBucketCapacity},
+		{10, 800, defaultMaxBucketCapacity},
+		{10, 900, defaultMaxBucketCapacity},
+		{100, 1000, defaultMaxBucketCapacity},
+		{4, 12, 7},
+		{1000, 64536, 4095},
 	}
 	for _, c := range testCases {
 		t.Run("", func(t *testing.T) {
-			m := New[int, int](0, WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
-			for i := 0; i < c.count; i++ {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			for i := 0; i < c.used; i++ {
 				m.Put(i, i)
 			}
+			e := m.toBuiltinMap()
 
-			capacity := m.capacity()
-			m.Clear()
-			require.EqualValues(t, 0, m.Len())
-			require.EqualValues(t, capacity, m.capacity())
+			m.Grow(c.grow)
+			require.Equal(t, e, m.toBuiltinMap())
 
-			m.All(func(k, v int) bool {
-				require.Fail(t, "should not iterate")
-				return true
-			})
-		})
-	}
-}
+			// The map should be sized identically to a map created with the
+			// combined initial capacity.
+			expected := New[int, int](c.used+c.grow,
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			if c.grow > 0 {
+				require.EqualValues(t, expected.bucketCount(), m.bucketCount())
+				require.EqualValues(t, expected.Cap(), m.Cap())
+			}
+
+			// Growing again is a no-op.
+			allocs := a.alloc
+			m.Grow(c.grow)
+			require.EqualValues(t, allocs, a.alloc)
+
+			for i := c.used; i < c.used+c.grow; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			require.Equal(t, e, m.toBuiltinMap())
+			if m.bucketCount() == 1 {
+				// A single bucket never needs to grow after Grow.
+				require.EqualValues(t, allocs, a.alloc)
+			}
+
+			m.Close()
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestShrink(t *testing.T) {
+	count := 1_000_000
+	if invariants {
+		count = 10_000
+	}
+
+	a := &countingAllocator[int, int]{}
+	m := New[int, int](0, WithAllocator[int, int](a))
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < count; i++ {
+		if i%10 != 0 {
+			m.Delete(i)
+		}
+	}
+	e := m.toBuiltinMap()
+	require.EqualValues(t, count/10, len(e))
+
+	before := m.Cap()
+	m.Shrink()
+	require.Equal(t, e, m.toBuiltinMap())
+	require.Less(t, m.Cap(), before/4)
+
+	// The shrunk map should be sized as if it had been created to hold the
+	// remaining entries.
+	expected := New[int, int](m.Len())
+	require.LessOrEqual(t, m.Cap(), 2*expected.Cap())
+
+	for k, v := range e {
+		got, ok := m.Get(k)
+		require.True(t, ok)
+		require.EqualValues(t, v, got)
+	}
+
+	// Shrinking an empty map releases all of its memory.
+	for k := range e {
+		m.Delete(k)
+	}
+	m.Shrink()
+	require.EqualValues(t, 0, m.Cap())
+	require.EqualValues(t, a.alloc, a.free)
+	m.Put(1, 1)
+	require.Equal(t, map[int]int{1: 1}, m.toBuiltinMap())
+
+	m.Close()
+	require.EqualValues(t, a.alloc, a.free)
+}
+
+func TestMaxLoadFactor(t *testing.T) {
+	// fill returns the number of entries in the map when it first grew beyond
+	// 1023 slots.
+	fill := func(options ...option[int, int]) int {
+		options = append(options, WithMaxBucketCapacity[int, int](math.MaxUint64))
+		m := New[int, int](1, options...)
+		for i := 0; ; i++ {
+			if m.Cap() > 1023 {
+				return i - 1
+			}
+			m.Put(i, i)
+		}
+	}
+
+	def := fill()
+	require.EqualValues(t, 895, def)
+	require.EqualValues(t, def, fill(WithMaxLoadFactor[int, int](7.0/8)))
+	low := fill(WithMaxLoadFactor[int, int](0.5))
+	require.EqualValues(t, 511, low)
+	high := fill(WithMaxLoadFactor[int, int](0.9375))
+	require.EqualValues(t, 959, high)
+
+	for _, f := range []float64{0.25, 0.5, 0.9375} {
+		t.Run(fmt.Sprint(f), func(t *testing.T) {
+			// A map sized by New holds the requested number of entries
+			// without growing.
+			m := New[int, int](1000, WithMaxLoadFactor[int, int](f))
+			capacity := m.Cap()
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+			}
+			require.EqualValues(t, capacity, m.Cap())
+			require.LessOrEqual(t, m.Stats().LoadFactor, f)
+
+			// Once the map is half full, deleting and inserting rehashes the
+			// tombstones away in place rather than growing the map.
+			for i := 0; i < 500; i++ {
+				m.Delete(i)
+			}
+			for i := 1000; i < 100000; i++ {
+				m.Delete(i - 500)
+				m.Put(i, i)
+			}
+			require.EqualValues(t, capacity, m.Cap())
+			require.EqualValues(t, 500, m.Len())
+		})
+	}
+
+	for _, f := range []float64{0, 0.2, 0.95, 1, math.NaN()} {
+		require.Panics(t, func() { WithMaxLoadFactor[int, int](f) }, "%g", f)
+	}
+}
+
+func TestAutoCompact(t *testing.T) {
+	// churn fills a map to ~80% of its capacity and then repeatedly deletes
+	// the oldest entry and inserts a new one, returning the capacity of the
+	// map before and after the churn.
+	churn := func(options ...option[int, int]) (before, after int) {
+		options = append(options, WithMaxBucketCapacity[int, int](math.MaxUint64))
+		m := New[int, int](800, options...)
+		for i := 0; i < 800; i++ {
+			m.Put(i, i)
+		}
+		before = m.Cap()
+		for i := 800; i < 100000; i++ {
+			m.Delete(i - 800)
+			m.Put(i, i)
+		}
+		require.EqualValues(t, 800, m.Len())
+		for i := 100000 - 800; i < 100000; i++ {
+			v, ok := m.Get(i)
+			require.True(t, ok)
+			require.EqualValues(t, i, v)
+		}
+		return before, m.Cap()
+	}
+
+	// By default too few tombstones are reclaimable when the bucket fills up
+	// and the map grows.
+	before, after := churn()
+	require.EqualValues(t, 1023, before)
+	require.Greater(t, after, before)
+
+	// With a low threshold the tombstones are compacted away instead.
+	before, after = churn(WithAutoCompact[int, int](0.0625))
+	require.EqualValues(t, 1023, before)
+	require.EqualValues(t, before, after)
+
+	for _, f := range []float64{0, 0.05, 1.5, math.NaN()} {
+		require.Panics(t, func() { WithAutoCompact[int, int](f) }, "%g", f)
+	}
+}
+
+func TestWithSeed(t *testing.T) {
+	// layout returns the keys in slot order across all buckets.
+	layout := func(m *Map[int, int]) []int {
+		var keys []int
+		m.buckets(0, func(b *bucket[int, int]) bool {
+			for i := uintptr(0); i < b.capacity; i++ {
+				if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+					keys = append(keys, -1)
+				} else {
+					keys = append(keys, b.slots.At(i).key)
+				}
+			}
+			return true
+		})
+		return keys
+	}
+	build := func(options ...option[int, int]) *Map[int, int] {
+		m := New[int, int](0, options...)
+		for i := 0; i < 1000; i++ {
+			m.Put(i, i)
+		}
+		return m
+	}
+
+	for _, maxBucketCapacity := range []uintptr{defaultMaxBucketCapacity, 7} {
+		a := build(WithSeed[int, int](1), WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		b := build(WithSeed[int, int](1), WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		c := build(WithSeed[int, int](2), WithMaxBucketCapacity[int, int](maxBucketCapacity))
+		require.EqualValues(t, 1, a.seed)
+		require.Equal(t, layout(a), layout(b))
+		require.NotEqual(t, layout(a), layout(c))
+		require.Equal(t, a.toBuiltinMap(), c.toBuiltinMap())
+
+		// The seed is retained across Clear and Clone.
+		a.Clear()
+		require.EqualValues(t, 1, a.seed)
+		require.EqualValues(t, 1, a.Clone().seed)
+	}
+
+	// Without WithSeed, the seed is randomized by Clear.
+	m := New[int, int](0)
+	seed := m.seed
+	m.Clear()
+	require.NotEqual(t, seed, m.seed)
+}
+
+func TestDeterministicIteration(t *testing.T) {
+	order := func(m *Map[int, int]) []int {
+		var keys []int
+		m.All(func(k, v int) bool {
+			keys = append(keys, k)
+			return true
+		})
+		return keys
+	}
+
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			build := func(options ...option[int, int]) *Map[int, int] {
+				options = append(options, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+				m := New[int, int](0, options...)
+				for i := 0; i < 1000; i++ {
+					m.Put(i, i)
+				}
+				for i := 0; i < 1000; i += 3 {
+					m.Delete(i)
+				}
+				return m
+			}
+
+			// Identically constructed maps iterate in the same order, and
+			// repeated iteration of a map visits the entries in the same order.
+			a := build(WithSeed[int, int](1), WithDeterministicIteration[int, int]())
+			b := build(WithSeed[int, int](1), WithDeterministicIteration[int, int]())
+			expected := order(a)
+			require.EqualValues(t, a.Len(), len(expected))
+			for i := 0; i < 10; i++ {
+				require.Equal(t, expected, order(a))
+				require.Equal(t, expected, order(b))
+			}
+
+			// By default the iteration order is randomized.
+			c := build(WithSeed[int, int](1))
+			require.Equal(t, a.toBuiltinMap(), c.toBuiltinMap())
+			randomized := false
+			for i := 0; i < 10 && !randomized; i++ {
+				randomized = !slices.Equal(expected, order(c))
+			}
+			require.True(t, randomized)
+
+			// With stable random iteration repeated iteration of a map visits
+			// the entries in the same order, but separately constructed maps
+			// iterate in different orders.
+			d := build(WithSeed[int, int](1), WithStableRandomIteration[int, int]())
+			stable := order(d)
+			for i := 0; i < 10; i++ {
+				require.Equal(t, stable, order(d))
+			}
+			randomized = false
+			for i := 0; i < 10 && !randomized; i++ {
+				e := build(WithSeed[int, int](1), WithStableRandomIteration[int, int]())
+				randomized = !slices.Equal(stable, order(e))
+			}
+			require.True(t, randomized)
+		})
+	}
+}
+
+func TestReseed(t *testing.T) {
+	testCases := []struct {
+		count             int
+		maxBucketCapacity uintptr
+	}{
+		{0, defaultMaxBucketCapacity},
+		{5, defaultMaxBucketCapacity},
+		{1000, defaultMaxBucketCapacity},
+		{1000, 127},
+		{1000, 7},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			for i := 0; i < c.count; i++ {
+				m.Put(i, i)
+			}
+			e := m.toBuiltinMap()
+			seed, capacity := m.seed, m.Cap()
+
+			m.Reseed()
+			require.NotEqual(t, seed, m.seed)
+			require.Equal(t, e, m.toBuiltinMap())
+			if c.maxBucketCapacity == defaultMaxBucketCapacity {
+				require.EqualValues(t, capacity, m.Cap())
+			} else {
+				require.GreaterOrEqual(t, m.Cap(), capacity)
+			}
+			for k, v := range e {
+				got, ok := m.Get(k)
+				require.True(t, ok)
+				require.EqualValues(t, v, got)
+			}
+
+			m.Close()
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestAutoReseed(t *testing.T) {
+	// Simulate a hash flooding attack where every key collides under the
+	// initial seed.
+	const attackedSeed = 1
+	hash := getRuntimeHasher[int]()
+	floodedHash := func(key *int, seed uintptr) uintptr {
+		if seed == attackedSeed {
+			return 0
+		}
+		return hash(unsafe.Pointer(key), seed)
+	}
+
+	const count = 1000
+	build := func(options ...option[int, int]) *Map[int, int] {
+		options = append(options, WithHash[int, int](floodedHash), WithSeed[int, int](attackedSeed))
+		m := New[int, int](0, options...)
+		for i := 0; i < count; i++ {
+			m.Put(i, i)
+		}
+		return m
+	}
+
+	m := build()
+	require.EqualValues(t, attackedSeed, m.seed)
+	require.Greater(t, m.ProbeStats().Max, count/groupSize)
+
+	m = build(WithAutoReseed[int, int](4))
+	require.NotEqual(t, attackedSeed, m.seed)
+	require.Less(t, m.ProbeStats().Max, 8)
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i, v)
+	}
+
+	// A degenerate hash function is not fixed by reseeding, but the cost of
+	// reseeding is bounded.
+	a := &countingAllocator[int, int]{}
+	d := New[int, int](0, WithAllocator[int, int](a),
+		WithHash[int, int](func(key *int, seed uintptr) uintptr { return 0 }),
+		WithAutoReseed[int, int](4))
+	for i := 0; i < count; i++ {
+		d.Put(i, i)
+	}
+	require.EqualValues(t, count, d.Len())
+	require.Less(t, a.alloc, 100)
+}
+
+func TestBasic(t *testing.T) {
+	test := func(t *testing.T, m *Map[int, int]) {
+		const count = 100
+
+		e := make(map[int]int)
+		require.EqualValues(t, 0, m.Len())
+		require.EqualValues(t, 0, m.bucket0.growthLeft)
+
+		// Non-existent.
+		for i := 0; i < count; i++ {
+			_, ok := m.Get(i)
+			require.False(t, ok)
+		}
+
+		// Insert.
+		for i := 0; i < count; i++ {
+			require.False(t, m.Contains(i))
+			m.Put(i, i+count)
+			e[i] = i + count
+			v, ok := m.Get(i)
+			require.True(t, ok)
+			require.EqualValues(t, i+count, v)
+			require.True(t, m.Contains(i))
+			require.EqualValues(t, i+1, m.Len())
+			require.Equal(t, e, m.toBuiltinMap())
+		}
+
+		// Update.
+		for i := 0; i < count; i++ {
+			m.Put(i, i+2*count)
+			e[i] = i + 2*count
+			v, ok := m.Get(i)
+			require.True(t, ok)
+			require.EqualValues(t, i+2*count, v)
+			require.EqualValues(t, count, m.Len())
+			require.Equal(t, e, m.toBuiltinMap())
+		}
+
+		// Delete.
+		for i := 0; i < count; i++ {
+			m.Delete(i)
+			delete(e, i)
+			require.EqualValues(t, count-i-1, m.Len())
+			_, ok := m.Get(i)
+			require.False(t, ok)
+			require.False(t, m.Contains(i))
+			require.Equal(t, e, m.toBuiltinMap())
+		}
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		test(t, New[int, int](0))
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		testDegenerate := func(t *testing.T, h uintptr) {
+			m := New[int, int](0,
+				WithHash[int, int](func(key *int, seed uintptr) uintptr {
+					return h
+				}),
+				WithMaxBucketCapacity[int, int](7))
+			test(t, m)
+		}
+
+		for _, v := range []uintptr{0, ^uintptr(0)} {
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+		for i := 0; i < 10; i++ {
+			v := uintptr(rand.Uint64())
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+	})
+}
+
+func TestHashed(t *testing.T) {
+	count := 10_000
+	if invariants {
+		count = 1000
+	}
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			options := []option[int, int]{
+				WithSeed[int, int](1),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity),
+			}
+			a := New[int, int](0, options...)
+			b := New[int, int](0, options...)
+
+			// Maps with the same seed compute the same hashes, so a hash
+			// computed once may be used with both maps.
+			for i := 0; i < count; i++ {
+				h := a.Hash(i)
+				require.Equal(t, h, b.Hash(i))
+				a.PutHashed(i, h, i)
+				b.PutHashed(i, h, -i)
+			}
+			require.EqualValues(t, count, a.Len())
+			require.EqualValues(t, count, b.Len())
+
+			for i := 0; i < 2*count; i++ {
+				h := a.Hash(i)
+				v, ok := a.GetHashed(i, h)
+				require.Equal(t, i < count, ok)
+				if ok {
+					require.EqualValues(t, i, v)
+				}
+				v, ok = b.GetHashed(i, h)
+				require.Equal(t, i < count, ok)
+				if ok {
+					require.EqualValues(t, -i, v)
+				}
+
+				// The entries are found by the unhashed operations too.
+				_, ok = a.Get(i)
+				require.Equal(t, i < count, ok)
+			}
+
+			// Overwriting an existing entry does not add a duplicate.
+			for i := 0; i < count; i++ {
+				a.PutHashed(i, a.Hash(i), i+1)
+			}
+			require.EqualValues(t, count, a.Len())
+			for i := 0; i < count; i++ {
+				v, ok := a.Get(i)
+				require.True(t, ok)
+				require.EqualValues(t, i+1, v)
+			}
+
+			// Maps with different seeds compute different hashes.
+			c := New[int, int](0, WithSeed[int, int](2))
+			require.NotEqual(t, a.Hash(1), c.Hash(1))
+		})
+	}
+}
+
+func TestGetOrPut(t *testing.T) {
+	test := func(t *testing.T, m *Map[int, int]) {
+		const count = 100
+
+		e := make(map[int]int)
+		for i := 0; i < count; i++ {
+			v, loaded := m.GetOrPut(i, i+count)
+			require.False(t, loaded)
+			require.EqualValues(t, i+count, v)
+			e[i] = i + count
+			require.EqualValues(t, i+1, m.Len())
+			require.Equal(t, e, m.toBuiltinMap())
+		}
+
+		// Existing entries are loaded and not overwritten.
+		for i := 0; i < count; i++ {
+			v, loaded := m.GetOrPut(i, i+2*count)
+			require.True(t, loaded)
+			require.EqualValues(t, i+count, v)
+			require.EqualValues(t, count, m.Len())
+		}
+		require.Equal(t, e, m.toBuiltinMap())
+
+		// Deleted entries leave tombstones which GetOrPut may reuse.
+		for i := 0; i < count; i += 2 {
+			m.Delete(i)
+			delete(e, i)
+		}
+		for i := 0; i < count; i++ {
+			v, loaded := m.GetOrPut(i, i+3*count)
+			require.Equal(t, i%2 == 1, loaded)
+			if !loaded {
+				e[i] = i + 3*count
+			}
+			require.EqualValues(t, e[i], v)
+		}
+		require.EqualValues(t, count, m.Len())
+		require.Equal(t, e, m.toBuiltinMap())
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		test(t, New[int, int](0))
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		for _, v := range []uintptr{0, ^uintptr(0)} {
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				m := New[int, int](0,
+					WithHash[int, int](func(key *int, seed uintptr) uintptr {
+						return v
+					}),
+					WithMaxBucketCapacity[int, int](7))
+				test(t, m)
+			})
+		}
+	})
+}
+
+func TestGetOrCompute(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+
+	var calls int
+	for i := 0; i < count; i++ {
+		v, loaded := m.GetOrCompute(i, func() int {
+			calls++
+			return i + count
+		})
+		require.False(t, loaded)
+		require.EqualValues(t, i+count, v)
+	}
+	require.EqualValues(t, count, calls)
+	require.EqualValues(t, count, m.Len())
+
+	// fn is never invoked for existing keys.
+	for i := 0; i < count; i++ {
+		v, loaded := m.GetOrCompute(i, func() int {
+			require.Fail(t, "fn should not be called")
+			return 0
+		})
+		require.True(t, loaded)
+		require.EqualValues(t, i+count, v)
+	}
+
+	// A panic inside fn leaves the map unchanged.
+	e := m.toBuiltinMap()
+	require.Panics(t, func() {
+		m.GetOrCompute(count, func() int {
+			panic("boom")
+		})
+	})
+	require.EqualValues(t, count, m.Len())
+	require.Equal(t, e, m.toBuiltinMap())
+	_, ok := m.Get(count)
+	require.False(t, ok)
+	m.bucket0.checkInvariants(m)
+
+	if invariants {
+		// Modifying the map from fn panics, while reading it does not.
+		const msg = "invariant failed: Map modified by callback"
+		for _, modify := range []func(){
+			func() { m.Put(-1, 0) },
+			func() { m.Delete(0) },
+			func() { m.Grow(1000) },
+			func() { m.GetOrCompute(-2, func() int { return 0 }) },
+			func() { m.Close() },
+		} {
+			require.PanicsWithValue(t, msg, func() {
+				m.GetOrCompute(count, func() int {
+					modify()
+					return 0
+				})
+			})
+		}
+		require.Equal(t, e, m.toBuiltinMap())
+		v, loaded := m.GetOrCompute(count, func() int { return m.Len() })
+		require.False(t, loaded)
+		require.EqualValues(t, count, v)
+		m.Put(-1, 0)
+	}
+}
+
+func TestDeleteReleasesReferences(t *testing.T) {
+	type big [1 << 10]byte
+	for _, del := range []func(m *Map[int, *big], key int){
+		func(m *Map[int, *big], key int) { m.Delete(key) },
+		func(m *Map[int, *big], key int) { m.Pop(key) },
+		func(m *Map[int, *big], key int) {
+			m.DeleteFunc(func(k int, _ *big) bool { return k == key })
+		},
+		func(m *Map[int, *big], key int) { m.Clear() },
+	} {
+		m := New[int, *big](0)
+		var collected atomic.Bool
+		func() {
+			v := new(big)
+			runtime.SetFinalizer(v, func(*big) { collected.Store(true) })
+			m.Put(1, v)
+		}()
+		del(m, 1)
+
+		for i := 0; i < 10 && !collected.Load(); i++ {
+			runtime.GC()
+			time.Sleep(time.Millisecond)
+		}
+		require.True(t, collected.Load())
+		runtime.KeepAlive(m)
+	}
+}
+
+func TestPop(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+	for i := 0; i < count; i++ {
+		m.Put(i, i+count)
+	}
+
+	_, ok := m.Pop(count)
+	require.False(t, ok)
+	require.EqualValues(t, count, m.Len())
+
+	for i := 0; i < count; i++ {
+		v, ok := m.Pop(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+		require.EqualValues(t, count-i-1, m.Len())
+		_, ok = m.Get(i)
+		require.False(t, ok)
+
+		_, ok = m.Pop(i)
+		require.False(t, ok)
+	}
+}
+
+func TestPopAny(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, options...)
+			_, _, ok := m.PopAny()
+			require.False(t, ok)
+
+			const count = 10_000
+			for i := 0; i < count; i++ {
+				m.Put(i, i+count)
+			}
+
+			// Draining the map visits every entry exactly once, including
+			// entries added while draining.
+			seen := make(map[int]bool)
+			total := count
+			for k, v, ok := m.PopAny(); ok; k, v, ok = m.PopAny() {
+				require.EqualValues(t, k+count, v)
+				require.False(t, seen[k])
+				seen[k] = true
+				require.False(t, m.Contains(k))
+				require.EqualValues(t, total-len(seen), m.Len())
+				if len(seen) == count/2 {
+					m.Put(count, 2*count)
+					total++
+				}
+			}
+			require.Len(t, seen, count+1)
+			require.EqualValues(t, 0, m.Len())
+		})
+	}
+}
+
+func TestGetOrDefault(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+
+	for i := 0; i < count; i++ {
+		require.EqualValues(t, -1, m.GetOrDefault(i, -1))
+		m.Put(i, i)
+	}
+	for i := 0; i < count; i++ {
+		require.EqualValues(t, i, m.GetOrDefault(i, -1))
+	}
+	// A stored zero value is returned rather than the default.
+	m.Put(count, 0)
+	require.EqualValues(t, 0, m.GetOrDefault(count, -1))
+}
+
+func TestGetPtr(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+
+	for i := 0; i < count; i++ {
+		require.Nil(t, m.GetPtr(i))
+		m.Put(i, i)
+	}
+	for i := 0; i < count; i++ {
+		p := m.GetPtr(i)
+		require.NotNil(t, p)
+		*p += count
+	}
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+	}
+
+	if invariants {
+		// A pointer invalidated by a resize refers to poisoned memory.
+		p := m.GetPtr(0)
+		for i := count; m.bucket0.capacity < 4*count; i++ {
+			m.Put(i, i)
+		}
+		poison := uint64(0x0101010101010101) * slotPoison
+		require.EqualValues(t, int(poison), *p)
+
+		// Slots containing pointers are cleared instead.
+		s := New[int, *int](0)
+		s.Put(0, new(int))
+		sp := s.GetPtr(0)
+		for i := 1; s.bucket0.capacity < 4*count; i++ {
+			s.Put(i, nil)
+		}
+		require.Nil(t, *sp)
+	}
+}
+
+func TestGetEntry(t *testing.T) {
+	type key struct {
+		s string
+		n int
+	}
+	m := New[key, int](0)
+	_, _, ok := m.GetEntry(key{})
+	require.False(t, ok)
+
+	const count = 100
+	for i := 0; i < count; i++ {
+		m.Put(key{s: strconv.Itoa(i), n: i}, i)
+	}
+	for i := 0; i < count; i++ {
+		k := key{s: strconv.Itoa(i), n: i}
+		storedKey, value, ok := m.GetEntry(k)
+		require.True(t, ok)
+		// The stored key is a distinct copy of the key.
+		require.Equal(t, k, *storedKey)
+		require.NotSame(t, &k, storedKey)
+		require.EqualValues(t, i, *value)
+		*value += count
+
+		// Lookups return the same stored key.
+		storedKey2, value2, _ := m.GetEntry(k)
+		require.Same(t, storedKey, storedKey2)
+		require.Same(t, value, value2)
+	}
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(key{s: strconv.Itoa(i), n: i})
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+	}
+	_, _, ok = m.GetEntry(key{n: -1})
+	require.False(t, ok)
+}
+
+func TestSwap(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+
+	for i := 0; i < count; i++ {
+		prev, loaded := m.Swap(i, i)
+		require.False(t, loaded)
+		require.EqualValues(t, 0, prev)
+		require.EqualValues(t, i+1, m.Len())
+	}
+	for i := 0; i < count; i++ {
+		prev, loaded := m.Swap(i, i+count)
+		require.True(t, loaded)
+		require.EqualValues(t, i, prev)
+		require.EqualValues(t, count, m.Len())
+	}
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+	}
+}
+
+func TestPutPtr(t *testing.T) {
+	type value [64]int64
+	for _, options := range [][]option[int, value]{
+		nil,
+		{WithMaxBucketCapacity[int, value](127)},
+		{WithIncrementalResize[int, value]()},
+	} {
+		m := New[int, value](0, options...)
+		const count = 5000
+
+		var v value
+		for i := 0; i < count; i++ {
+			v[0], v[len(v)-1] = int64(i), int64(-i)
+			m.PutPtr(i, &v)
+		}
+		// The map does not retain the pointer.
+		v[0] = -1
+		for i := 0; i < count; i += 2 {
+			v[0], v[len(v)-1] = int64(i), int64(i)
+			m.PutPtr(i, &v)
+		}
+		require.EqualValues(t, count, m.Len())
+		for i := 0; i < count; i++ {
+			got, ok := m.Get(i)
+			require.True(t, ok)
+			require.EqualValues(t, i, got[0])
+			if i%2 == 0 {
+				require.EqualValues(t, i, got[len(got)-1])
+			} else {
+				require.EqualValues(t, -i, got[len(got)-1])
+			}
+		}
+	}
+}
+
+func TestPutReturningInserted(t *testing.T) {
+	var m Map[int, int]
+	const count = 1000
+
+	for i := 0; i < count; i++ {
+		require.True(t, m.PutReturningInserted(i, i))
+		require.EqualValues(t, i+1, m.Len())
+		require.False(t, m.PutReturningInserted(i, i+count))
+		require.EqualValues(t, i+1, m.Len())
+	}
+	for i := 0; i < count; i++ {
+		require.False(t, m.PutReturningInserted(i, i+2*count))
+	}
+	require.EqualValues(t, count, m.Len())
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+2*count, v)
+	}
+
+	// A deleted key is inserted again.
+	m.Delete(0)
+	require.True(t, m.PutReturningInserted(0, 0))
+	require.EqualValues(t, count, m.Len())
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+
+	// Absent keys are never swapped or inserted.
+	for i := 0; i < count; i++ {
+		require.False(t, CompareAndSwap(m, i, 0, i))
+	}
+	require.EqualValues(t, 0, m.Len())
+
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < count; i++ {
+		require.False(t, CompareAndSwap(m, i, i+1, -1))
+		require.True(t, CompareAndSwap(m, i, i, i+count))
+		require.False(t, CompareAndSwap(m, i, i, -1))
+	}
+	require.EqualValues(t, count, m.Len())
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+	}
+}
+
+func TestCompareAndDelete(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+
+	require.False(t, CompareAndDelete(m, count, 0))
+	for i := 0; i < count; i++ {
+		require.False(t, CompareAndDelete(m, i, i+1))
+		require.True(t, m.Contains(i))
+		require.True(t, CompareAndDelete(m, i, i))
+		require.False(t, m.Contains(i))
+		require.False(t, CompareAndDelete(m, i, i))
+		require.EqualValues(t, count-i-1, m.Len())
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	m := New[int, int](0)
+	const count = 100
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+
+	for i := 0; i < count; i++ {
+		require.True(t, m.Update(i, func(old int) int {
+			require.EqualValues(t, i, old)
+			return old + count
+		}))
+	}
+	require.False(t, m.Update(count, func(old int) int {
+		require.Fail(t, "fn should not be called")
+		return old
+	}))
+	require.EqualValues(t, count, m.Len())
+
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i+count, v)
+	}
+
+	// A panic inside fn leaves the value unchanged.
+	require.Panics(t, func() {
+		m.Update(0, func(old int) int {
+			panic("boom")
+		})
+	})
+	v, ok := m.Get(0)
+	require.True(t, ok)
+	require.EqualValues(t, count, v)
+
+	if invariants {
+		// Modifying the map from fn panics.
+		require.PanicsWithValue(t, "invariant failed: Map modified by callback", func() {
+			m.Update(0, func(old int) int {
+				m.Put(-1, 0)
+				return old
+			})
+		})
+		require.True(t, m.Update(0, func(old int) int { return old + m.Len() }))
+		m.Put(-1, 0)
+	}
+}
+
+func TestAccumulate(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			add := func(a, b int) int {
+				return a + b
+			}
+
+			e := make(map[int]int)
+			for i := 0; i < 10_000; i++ {
+				k := rand.Intn(1000)
+				e[k] += i
+				require.EqualValues(t, e[k], m.Accumulate(k, i, add))
+			}
+			require.Equal(t, e, m.toBuiltinMap())
+			m.checkInvariants()
+			m.buckets(0, func(b *bucket[int, int]) bool {
+				b.checkInvariants(m)
+				return true
+			})
+
+			// A panic in add leaves the stored value unmodified.
+			k := 0
+			for k = range e {
+				break
+			}
+			require.Panics(t, func() {
+				m.Accumulate(k, 1, func(a, b int) int {
+					panic("boom")
+				})
+			})
+			v, ok := m.Get(k)
+			require.True(t, ok)
+			require.EqualValues(t, e[k], v)
+
+			if invariants {
+				// Modifying the map from add panics.
+				require.PanicsWithValue(t, "invariant failed: Map modified by callback", func() {
+					m.Accumulate(k, 1, func(a, b int) int {
+						m.Delete(k)
+						return a + b
+					})
+				})
+				require.Equal(t, e, m.toBuiltinMap())
+			}
+		})
+	}
+}
+
+func TestAppend(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, []int](0, WithMaxBucketCapacity[int, []int](maxBucketCapacity))
+
+			e := make(map[int][]int)
+			for i := 0; i < 10_000; i++ {
+				k := rand.Intn(1000)
+				e[k] = append(e[k], i, -i)
+				require.Equal(t, e[k], Append(m, k, i, -i))
+			}
+			require.Equal(t, e, m.toBuiltinMap())
+
+			// The inserted slice does not alias elems.
+			elems := []int{1, 2, 3}
+			Append(m, -1, elems...)
+			elems[0] = 0
+			v, _ := m.Get(-1)
+			require.Equal(t, []int{1, 2, 3}, v)
+
+			// Appending nothing to a missing key inserts an empty entry.
+			Append(m, -2)
+			v, ok := m.Get(-2)
+			require.True(t, ok)
+			require.Empty(t, v)
+		})
+	}
+}
+
+func TestDeleteAll(t *testing.T) {
+	m := New[int, int](0)
+	require.EqualValues(t, 0, m.DeleteAll(1, 2, 3))
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	require.EqualValues(t, 0, m.DeleteAll())
+	// Absent and repeated keys are not counted.
+	require.EqualValues(t, 3, m.DeleteAll(1, 2, 3, 3, 100, -1))
+	require.EqualValues(t, 97, m.Len())
+
+	keys := make([]int, 0, 200)
+	for i := 0; i < 200; i++ {
+		keys = append(keys, i)
+	}
+	require.EqualValues(t, 97, m.DeleteAll(keys...))
+	require.EqualValues(t, 0, m.Len())
+}
+
+func TestDeleteAllAndCompact(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 1023} {
+		t.Run("", func(t *testing.T) {
+			// Fill the buckets close to their max load so that most deletions
+			// leave tombstones.
+			const count = 14_000
+			a := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < count; i++ {
+				a.Put(i, i)
+			}
+			b := a.Clone()
+
+			// Deleting a few keys leaves the tombstones in place.
+			require.EqualValues(t, 10, b.DeleteAllAndCompact(0, 1, 2, 3, 4, 5, 6, 7, 8, 9))
+			require.Greater(t, b.Stats().Tombstones, 0)
+			a.DeleteAll(0, 1, 2, 3, 4, 5, 6, 7, 8, 9)
+
+			// Deleting a large batch compacts the buckets in which it leaves
+			// many tombstones, which shortens the probe sequences compared to
+			// DeleteAll.
+			var keys []int
+			for i := 10; i < count; i++ {
+				if i%10 != 0 {
+					keys = append(keys, i)
+				}
+			}
+			require.EqualValues(t, len(keys), a.DeleteAll(keys...))
+			require.EqualValues(t, len(keys), b.DeleteAllAndCompact(keys...))
+			require.Less(t, 2*b.Stats().Tombstones, a.Stats().Tombstones)
+			require.Less(t, b.ProbeStats().Mean, a.ProbeStats().Mean)
+			require.Equal(t, a.toBuiltinMap(), b.toBuiltinMap())
+			require.EqualValues(t, a.Cap(), b.Cap())
+		})
+	}
+}
+
+func TestDeleteFunc(t *testing.T) {
+	count := 100_000
+	if invariants {
+		count = 1000
+	}
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 511} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			e := make(map[int]int)
+			for i := 0; i < count; i++ {
+				k, v := rand.Int(), rand.Int()
+				m.Put(k, v)
+				e[k] = v
+			}
+
+			m.DeleteFunc(func(k, v int) bool {
+				return v%2 == 0
+			})
+			for k, v := range e {
+				if v%2 == 0 {
+					delete(e, k)
+				}
+			}
+			require.EqualValues(t, len(e), m.Len())
+			require.Equal(t, e, m.toBuiltinMap())
+
+			m.DeleteFunc(func(k, v int) bool {
+				return true
+			})
+			require.EqualValues(t, 0, m.Len())
+		})
+	}
+}
+
+func TestAllMutable(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			const count = 10_000
+			m := New[int, int](0, options...)
+			e := make(map[int]int)
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+				e[i] = i
+			}
+			// Leave tombstones behind so that iteration has to skip them.
+			for i := 0; i < count; i += 7 {
+				m.Delete(i)
+				delete(e, i)
+			}
+
+			for round := 0; round < 3; round++ {
+				n := m.Len()
+				visited := make(map[int]bool)
+				m.AllMutable(func(k int, v *int) Action {
+					require.False(t, visited[k])
+					visited[k] = true
+					require.Equal(t, e[k], *v)
+					switch rand.Intn(3) {
+					case 0:
+						delete(e, k)
+						return ActionDelete
+					case 1:
+						*v += count
+						e[k] = *v
+					}
+					return ActionKeep
+				})
+				require.Len(t, visited, n)
+				require.Equal(t, e, m.toBuiltinMap())
+			}
+
+			// Stopping keeps the current entry, including its modification,
+			// and visits no further entries.
+			var n int
+			m.AllMutable(func(k int, v *int) Action {
+				n++
+				*v = -1
+				e[k] = -1
+				return ActionStop
+			})
+			require.Equal(t, 1, n)
+			require.Equal(t, e, m.toBuiltinMap())
+		})
+	}
+}
+
+func TestCountFunc(t *testing.T) {
+	var z Map[int, int]
+	isEven := func(k, v int) bool { return v%2 == 0 }
+	require.EqualValues(t, 0, z.CountFunc(isEven))
+	require.False(t, z.Any(isEven))
+	require.True(t, z.Every(isEven))
+
+	const count = 1000
+	m := New[int, int](0)
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+	require.EqualValues(t, count/2, m.CountFunc(isEven))
+	require.EqualValues(t, count, m.CountFunc(func(k, v int) bool { return true }))
+	require.True(t, m.Any(isEven))
+	require.False(t, m.Every(isEven))
+	require.True(t, m.Every(func(k, v int) bool { return k == v }))
+	require.False(t, m.Any(func(k, v int) bool { return k != v }))
+
+	// Any and Every stop at the first entry which decides the result.
+	var calls int
+	require.True(t, m.Any(func(k, v int) bool { calls++; return true }))
+	require.EqualValues(t, 1, calls)
+	calls = 0
+	require.False(t, m.Every(func(k, v int) bool { calls++; return false }))
+	require.EqualValues(t, 1, calls)
+
+	// No intermediate slice or map is built.
+	allocs := testing.AllocsPerRun(10, func() {
+		m.CountFunc(isEven)
+		m.Any(isEven)
+		m.Every(isEven)
+	})
+	require.EqualValues(t, 0, allocs)
+}
+
+func TestAnyEveryShortCircuit(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			const count = 10_000
+			m := New[int, int](0, options...)
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+
+			// Iteration stops as soon as the entry which decides the result
+			// is visited, wherever it is in the iteration order.
+			for _, target := range []int{0, count / 2, count - 1} {
+				var seen []int
+				require.True(t, m.Any(func(k, v int) bool {
+					seen = append(seen, k)
+					return k == target
+				}))
+				require.Equal(t, target, seen[len(seen)-1])
+				require.NotContains(t, seen[:len(seen)-1], target)
+
+				seen = seen[:0]
+				require.False(t, m.Every(func(k, v int) bool {
+					seen = append(seen, k)
+					return k != target
+				}))
+				require.Equal(t, target, seen[len(seen)-1])
+				require.NotContains(t, seen[:len(seen)-1], target)
+			}
+
+			// Otherwise every entry is visited exactly once.
+			var n int
+			require.False(t, m.Any(func(k, v int) bool { n++; return false }))
+			require.EqualValues(t, count, n)
+			n = 0
+			require.True(t, m.Every(func(k, v int) bool { n++; return true }))
+			require.EqualValues(t, count, n)
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	count := 10_000
+	if invariants {
+		count = 1000
+	}
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 511} {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < count; i++ {
+				m.Put(i, rand.Int())
+			}
+			e := m.toBuiltinMap()
+			allocs := a.alloc
+
+			f := m.Filter(func(k, v int) bool {
+				return v%2 == 0
+			})
+			require.Greater(t, a.alloc, allocs)
+
+			// The source is unchanged.
+			require.Equal(t, e, m.toBuiltinMap())
+
+			expected := make(map[int]int)
+			for k, v := range e {
+				if v%2 == 0 {
+					expected[k] = v
+				}
+			}
+			require.EqualValues(t, len(expected), f.Len())
+			require.Equal(t, expected, f.toBuiltinMap())
+
+			// Mutating the result does not affect the source.
+			f.Clear()
+			require.Equal(t, e, m.toBuiltinMap())
+
+			empty := m.Filter(func(k, v int) bool {
+				return false
+			})
+			require.EqualValues(t, 0, empty.Len())
+
+			m.Close()
+			f.Close()
+			empty.Close()
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestMapValues(t *testing.T) {
+	count := 10_000
+	if invariants {
+		count = 1000
+	}
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 511} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < count; i++ {
+				m.Put(rand.Int(), i)
+			}
+			e := m.toBuiltinMap()
+
+			calls := make(map[int]int)
+			r := MapValues(m, func(k, v int) string {
+				calls[k]++
+				return strconv.Itoa(v)
+			})
+			require.EqualValues(t, len(e), len(calls))
+			for _, n := range calls {
+				require.EqualValues(t, 1, n)
+			}
+
+			// The destination was sized up front and did not need to grow.
+			require.EqualValues(t, r.Cap(), New[int, string](len(e),
+				WithMaxBucketCapacity[int, string](maxBucketCapacity)).Cap())
+
+			expected := make(map[int]string, len(e))
+			for k, v := range e {
+				expected[k] = strconv.Itoa(v)
+			}
+			require.Equal(t, expected, r.toBuiltinMap())
+			require.Equal(t, e, m.toBuiltinMap())
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	testCases := []struct {
+		count             int
+		maxBucketCapacity uintptr
+	}{
+		{count: 0, maxBucketCapacity: math.MaxUint64},
+		{count: 1000, maxBucketCapacity: math.MaxUint64},
+		{count: 1000, maxBucketCapacity: 7},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			for i := 0; i < c.count; i++ {
+				m.Put(i, i)
+			}
+			e := m.toBuiltinMap()
+
+			clone := m.Clone()
+			require.EqualValues(t, m.Len(), clone.Len())
+			require.EqualValues(t, m.Cap(), clone.Cap())
+			require.EqualValues(t, m.bucketCount(), clone.bucketCount())
+			require.Equal(t, e, clone.toBuiltinMap())
+
+			// Mutate the original and verify the clone is unaffected.
+			for i := 0; i < c.count; i++ {
+				if i%2 == 0 {
+					m.Delete(i)
+				} else {
+					m.Put(i, -i)
+				}
+			}
+			for i := c.count; i < 2*c.count; i++ {
+				m.Put(i, i)
+			}
+			require.Equal(t, e, clone.toBuiltinMap())
+
+			// Closing the original does not free the clone's memory.
+			m.Close()
+			require.Equal(t, e, clone.toBuiltinMap())
+			clone.Put(-1, -1)
+			clone.Close()
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestCopyInto(t *testing.T) {
+	a := &countingAllocator[int, int]{}
+	dst := New[int, int](0, WithAllocator[int, int](a))
+	var maxCount int
+	for _, count := range []int{1000, 10, 500, 0, 1000, 2000, 1500} {
+		src := New[int, int](0)
+		for i := 0; i < count; i++ {
+			src.Put(rand.Int(), i)
+		}
+		allocs := a.alloc
+		src.CopyInto(dst)
+		require.Equal(t, src.toBuiltinMap(), dst.toBuiltinMap())
+		require.EqualValues(t, count, dst.Len())
+		if count <= maxCount {
+			// dst was previously grown to hold at least count entries and
+			// is reused without allocating.
+			require.EqualValues(t, allocs, a.alloc)
+		}
+		maxCount = max(maxCount, count)
+	}
+
+	// A zero value destination is initialized.
+	src := New[int, int](0)
+	src.Put(1, 1)
+	var z Map[int, int]
+	src.CopyInto(&z)
+	require.Equal(t, map[int]int{1: 1}, z.toBuiltinMap())
+
+	src.CopyInto(src)
+	require.Equal(t, map[int]int{1: 1}, src.toBuiltinMap())
+}
+
+func TestSnapshot(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](7)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, options...)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, i)
+			}
+			e1 := m.toBuiltinMap()
+			s1 := m.Snapshot()
+			require.Equal(t, e1, s1.toBuiltinMap())
+
+			// Mutating the map does not affect the snapshot.
+			for i := 0; i < 1000; i++ {
+				if i%2 == 0 {
+					m.Delete(i)
+				} else {
+					m.Put(i, -i)
+				}
+			}
+			for i := 1000; i < 2000; i++ {
+				m.Put(i, i)
+			}
+			e2 := m.toBuiltinMap()
+			require.Equal(t, e1, s1.toBuiltinMap())
+
+			// Multiple snapshots of the same state share its memory.
+			s2 := m.Snapshot()
+			s3 := m.Snapshot()
+			m.DeleteFunc(func(k, v int) bool { return true })
+			require.EqualValues(t, 0, m.Len())
+			require.Equal(t, e1, s1.toBuiltinMap())
+			require.Equal(t, e2, s2.toBuiltinMap())
+			require.Equal(t, e2, s3.toBuiltinMap())
+
+			// Mutating the map while iterating over it after taking a
+			// snapshot.
+			m.Merge(s2)
+			s4 := m.Snapshot()
+			n := 0
+			m.All(func(k, v int) bool {
+				m.Delete(k)
+				n++
+				return true
+			})
+			require.EqualValues(t, len(e2), n)
+			require.EqualValues(t, 0, m.Len())
+			require.Equal(t, e2, s4.toBuiltinMap())
+
+			// A snapshot cannot be mutated, but can be snapshotted and closed.
+			require.Panics(t, func() { s1.Put(1, 1) })
+			require.Panics(t, func() { s1.Delete(1) })
+			require.Equal(t, e1, s1.Snapshot().toBuiltinMap())
+			s1.Close()
+			require.Equal(t, e2, s2.toBuiltinMap())
+
+			// Closing the map does not release the memory of a snapshot.
+			m.Put(1, 1)
+			s5 := m.Snapshot()
+			m.Close()
+			require.Equal(t, map[int]int{1: 1}, s5.toBuiltinMap())
+		})
+	}
+
+	t.Run("concurrent", func(t *testing.T) {
+		m := New[int, int](0, WithMaxBucketCapacity[int, int](63))
+		for i := 0; i < 1000; i++ {
+			m.Put(i, 0)
+		}
+		// Readers verify that every entry of a snapshot has the generation of
+		// the snapshot while the writer updates the map.
+		var wg sync.WaitGroup
+		for gen := 1; gen <= 10; gen++ {
+			s := m.Snapshot()
+			wg.Add(1)
+			go func(gen int) {
+				defer wg.Done()
+				for i := 0; i < 1000; i++ {
+					v, ok := s.Get(i)
+					if !ok || v != gen-1 {
+						t.Errorf("snapshot %d: %d: found %d, %t", gen, i, v, ok)
+						return
+					}
+				}
+			}(gen)
+			for i := 0; i < 1000; i++ {
+				m.Put(i, gen)
+			}
+		}
+		wg.Wait()
+	})
+
+	var z Map[int, int]
+	require.EqualValues(t, 0, z.Snapshot().Len())
+	z.Put(1, 1)
+	require.EqualValues(t, 1, z.Len())
+}
+
+func TestEqual(t *testing.T) {
+	build := func(n int, options ...option[int, int]) *Map[int, int] {
+		m := New[int, int](0, options...)
+		for i := 0; i < n; i++ {
+			m.Put(i, i)
+		}
+		return m
+	}
+
+	a := build(100)
+	require.True(t, Equal(a, a))
+	require.True(t, Equal(a, build(100)))
+	require.True(t, Equal(New[int, int](0), New[int, int](100)))
+	// Maps with differing layouts compare equal.
+	require.True(t, Equal(a, build(100, WithMaxBucketCapacity[int, int](7))))
+
+	// Differing lengths.
+	require.False(t, Equal(a, build(99)))
+	require.False(t, Equal(build(99), a))
+
+	// Same length, differing keys.
+	b := build(100)
+	b.Delete(0)
+	b.Put(100, 100)
+	require.False(t, Equal(a, b))
+
+	// Same keys, differing values.
+	b = build(100)
+	b.Put(50, -50)
+	require.False(t, Equal(a, b))
+	require.False(t, Equal(b, a))
+
+	// EqualFunc with a custom equality.
+	abs := func(a, b int) bool {
+		return a == b || a == -b
+	}
+	require.True(t, a.EqualFunc(b, abs))
+	require.True(t, b.EqualFunc(a, abs))
+
+	require.EqualValues(t, 0, testing.AllocsPerRun(10, func() {
+		Equal(a, b)
+	}))
+}
+
+func TestFingerprint(t *testing.T) {
+	valueHash := WithValueHash[int, string](func(value *string, seed uintptr) uintptr {
+		h := uint64(14695981039346656037) ^ uint64(seed)
+		for i := 0; i < len(*value); i++ {
+			h = (h ^ uint64((*value)[i])) * 1099511628211
+		}
+		return uintptr(h)
+	})
+	build := func(keys []int, options ...option[int, string]) *Map[int, string] {
+		m := New[int, string](0, append(options, valueHash)...)
+		for _, k := range keys {
+			m.Put(k, strconv.Itoa(k))
+		}
+		return m
+	}
+
+	const count = 1000
+	keys := make([]int, count)
+	for i := range keys {
+		keys[i] = i
+	}
+	a := build(keys)
+	fp := a.Fingerprint()
+	require.Equal(t, fp, a.Fingerprint())
+
+	// Equal maps have equal fingerprints regardless of the insertion order,
+	// seed, and bucket layout.
+	rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+	require.Equal(t, fp, build(keys).Fingerprint())
+	require.Equal(t, fp, build(keys, WithMaxBucketCapacity[int, string](7)).Fingerprint())
+	require.Equal(t, fp, build(keys, WithIncrementalResize[int, string]()).Fingerprint())
+	require.Equal(t, fp, a.Clone().Fingerprint())
+
+	// Changing a value, adding or removing an entry, or swapping the values
+	// of two keys changes the fingerprint.
+	a.Put(1, "x")
+	require.NotEqual(t, fp, a.Fingerprint())
+	a.Put(1, "1")
+	require.Equal(t, fp, a.Fingerprint())
+	a.Put(count, "x")
+	require.NotEqual(t, fp, a.Fingerprint())
+	a.Delete(count)
+	require.Equal(t, fp, a.Fingerprint())
+	a.Delete(0)
+	require.NotEqual(t, fp, a.Fingerprint())
+	a.Put(0, "0")
+	a.Put(1, "2")
+	a.Put(2, "1")
+	require.NotEqual(t, fp, a.Fingerprint())
+
+	// Empty maps have the same fingerprint.
+	a.Clear()
+	require.Equal(t, build(nil).Fingerprint(), a.Fingerprint())
+
+	m := New[int, string](0)
+	require.Panics(t, func() { m.Fingerprint() })
+}
+
+func TestMerge(t *testing.T) {
+	const count = 1000
+	a := New[int, int](0)
+	b := New[int, int](0, WithMaxBucketCapacity[int, int](7))
+	e := make(map[int]int)
+	for i := 0; i < count; i++ {
+		a.Put(i, i)
+		e[i] = i
+	}
+	for i := count / 2; i < count+count/2; i++ {
+		b.Put(i, -i)
+		e[i] = -i
+	}
+
+	a.Merge(b)
+	require.EqualValues(t, len(e), a.Len())
+	require.Equal(t, e, a.toBuiltinMap())
+	require.EqualValues(t, count, b.Len())
+
+	a.Merge(a)
+	require.Equal(t, e, a.toBuiltinMap())
+
+	// Room for the entries of the other map is reserved up front, so an
+	// empty map grows once.
+	c := New[int, int](0)
+	c.Merge(a)
+	require.Equal(t, e, c.toBuiltinMap())
+	require.EqualValues(t, 1, c.Stats().Allocs)
+}
+
+func TestMergeFunc(t *testing.T) {
+	const count = 1000
+	a := New[int, int](0)
+	b := New[int, int](0, WithMaxBucketCapacity[int, int](7))
+	e := make(map[int]int)
+	for i := 0; i < count; i++ {
+		a.Put(i, i)
+		e[i] = i
+	}
+	for i := count / 2; i < count+count/2; i++ {
+		b.Put(i, i)
+		e[i] += i
+	}
+
+	var collisions int
+	a.MergeFunc(b, func(k, existing, incoming int) int {
+		require.EqualValues(t, k, existing)
+		require.EqualValues(t, k, incoming)
+		collisions++
+		return existing + incoming
+	})
+	require.EqualValues(t, count/2, collisions)
+	require.EqualValues(t, len(e), a.Len())
+	require.Equal(t, e, a.toBuiltinMap())
+
+	c := New[int, int](0)
+	c.MergeFunc(a, func(k, existing, incoming int) int {
+		require.Fail(t, "combine should not be called")
+		return 0
+	})
+	require.Equal(t, e, c.toBuiltinMap())
+	require.EqualValues(t, 1, c.Stats().Allocs)
+
+	// Merging a map into itself combines every entry with itself.
+	a.MergeFunc(a, func(k, existing, incoming int) int {
+		require.EqualValues(t, existing, incoming)
+		return existing - incoming
+	})
+	require.EqualValues(t, len(e), a.Len())
+	a.All(func(k, v int) bool {
+		require.EqualValues(t, 0, v)
+		return true
+	})
+}
+
+func TestDifference(t *testing.T) {
+	// The values of b are negated so that the results show which map each
+	// entry came from.
+	build := func(lo, hi, sign int, options ...option[int, int]) *Map[int, int] {
+		m := New[int, int](0, options...)
+		for i := lo; i < hi; i++ {
+			m.Put(i, sign*i)
+		}
+		return m
+	}
+	expected := func(a, b *Map[int, int], keep func(inA, inB bool) bool) map[int]int {
+		e := make(map[int]int)
+		for _, m := range []*Map[int, int]{a, b} {
+			m.All(func(k, v int) bool {
+				if keep(a.Contains(k), b.Contains(k)) {
+					e[k] = v
+				}
+				return true
+			})
+		}
+		return e
+	}
+
+	const count = 1000
+	a := build(0, count, 1)
+	testCases := []struct {
+		name string
+		b    *Map[int, int]
+	}{
+		{"overlapping-smaller", build(count/2, count+count/4, -1, WithMaxBucketCapacity[int, int](7))},
+		{"overlapping-larger", build(count/2, 2*count, -1, WithMaxBucketCapacity[int, int](7))},
+		{"disjoint", build(count, 2*count, -1)},
+		{"subset", build(count/4, count/2, -1)},
+		{"identical", build(0, count, -1)},
+		{"empty", New[int, int](0)},
+		{"self", a},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			aOnly := expected(a, c.b, func(inA, inB bool) bool { return inA && !inB })
+			bOnly := expected(c.b, a, func(inB, inA bool) bool { return inB && !inA })
+			require.Equal(t, aOnly, Difference(a, c.b).toBuiltinMap())
+			require.Equal(t, bOnly, Difference(c.b, a).toBuiltinMap())
+
+			either := expected(a, c.b, func(inA, inB bool) bool { return inA != inB })
+			require.Equal(t, either, SymmetricDifference(a, c.b).toBuiltinMap())
+			require.Equal(t, either, SymmetricDifference(c.b, a).toBuiltinMap())
+
+			// The operands are not modified.
+			require.EqualValues(t, count, a.Len())
+		})
+	}
+
+	// A zero value map may be either operand.
+	var zero Map[int, int]
+	require.Empty(t, Difference(&zero, a).toBuiltinMap())
+	require.Equal(t, a.toBuiltinMap(), Difference(a, &Map[int, int]{}).toBuiltinMap())
+	require.Equal(t, a.toBuiltinMap(), SymmetricDifference(&Map[int, int]{}, a).toBuiltinMap())
+	require.Equal(t, a.toBuiltinMap(), SymmetricDifference(a, &Map[int, int]{}).toBuiltinMap())
+}
+
+func TestKeysValues(t *testing.T) {
+	m := New[int, int](0)
+	require.Empty(t, m.Keys())
+	require.Empty(t, m.Values())
+	require.Empty(t, m.Entries())
+
+	const count = 1000
+	for i := 0; i < count; i++ {
+		m.Put(i, i+count)
+	}
+
+	keys := m.Keys()
+	require.Len(t, keys, count)
+	require.EqualValues(t, count, cap(keys))
+	sort.Ints(keys)
+	for i := range keys {
+		require.EqualValues(t, i, keys[i])
+	}
+
+	values := m.Values()
+	require.Len(t, values, count)
+	require.EqualValues(t, count, cap(values))
+	sort.Ints(values)
+	for i := range values {
+		require.EqualValues(t, i+count, values[i])
+	}
+
+	entries := m.Entries()
+	require.Len(t, entries, count)
+	require.EqualValues(t, count, cap(entries))
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Value() < entries[j].Value()
+	})
+	for i := range entries {
+		require.EqualValues(t, i, entries[i].Key())
+		require.EqualValues(t, i+count, entries[i].Value())
+	}
+}
+
+func TestAllErr(t *testing.T) {
+	m := New[int, int](0)
+	const count = 1000
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+
+	e := make(map[int]int)
+	require.NoError(t, m.AllErr(func(k, v int) error {
+		e[k] = v
+		return nil
+	}))
+	require.Equal(t, m.toBuiltinMap(), e)
+
+	// Iteration stops at the first error, which is returned.
+	errStop := errors.New("stop")
+	var n int
+	err := m.AllErr(func(k, v int) error {
+		n++
+		if n == 10 {
+			return errStop
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, errStop)
+	require.EqualValues(t, 10, n)
+
+	// The map may be mutated during iteration, as with All.
+	require.NoError(t, m.AllErr(func(k, v int) error {
+		m.Delete(k)
+		return nil
+	}))
+	require.EqualValues(t, 0, m.Len())
+}
+
+func TestAllOrdered(t *testing.T) {
+	m := New[string, int](0, WithMaxBucketCapacity[string, int](7))
+	e := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		k := strconv.Itoa(rand.Intn(1 << 20))
+		m.Put(k, i)
+		e[k] = i
+	}
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	var got []string
+	AllOrdered(m, func(k string, v int) bool {
+		if len(got) > 0 {
+			require.Less(t, got[len(got)-1], k)
+		}
+		require.Equal(t, e[k], v)
+		got = append(got, k)
+		return true
+	})
+	require.Equal(t, keys, got)
+
+	// Stopping early.
+	var n int
+	AllOrdered(m, func(k string, v int) bool {
+		n++
+		return n < 10
+	})
+	require.EqualValues(t, 10, n)
+}
+
+func TestForEachBucket(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithMaxBucketCapacity[int, int](127), WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			const count = 10_000
+			m := New[int, int](0, options...)
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+
+			// Scan each bucket on its own goroutine.
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			var buckets int
+			results := make(map[int][]int)
+			m.ForEachBucket(func(i int, all func(yield func(k, v int) bool)) {
+				require.Equal(t, buckets, i)
+				buckets++
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					var keys []int
+					all(func(k, v int) bool {
+						if k != v {
+							panic(fmt.Sprintf("%d != %d", k, v))
+						}
+						keys = append(keys, k)
+						return true
+					})
+					mu.Lock()
+					results[i] = keys
+					mu.Unlock()
+				}()
+			})
+			wg.Wait()
+			require.Equal(t, m.bucketCount() > 1, buckets > 1)
+
+			// Every entry is visited by exactly one of the buckets.
+			seen := make(map[int]bool)
+			for _, keys := range results {
+				for _, k := range keys {
+					require.False(t, seen[k])
+					seen[k] = true
+				}
+			}
+			require.Len(t, seen, count)
+
+			// Stopping the iteration of one bucket does not affect the others.
+			var n, nonEmpty int
+			m.ForEachBucket(func(i int, all func(yield func(k, v int) bool)) {
+				all(func(k, v int) bool {
+					n++
+					return false
+				})
+				if len(results[i]) > 0 {
+					nonEmpty++
+				}
+			})
+			require.Equal(t, nonEmpty, n)
+		})
+	}
+}
+
+func TestAllSorted(t *testing.T) {
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](7))
+	const count = 1000
+	for _, i := range rand.Perm(count) {
+		m.Put(i, -i)
+	}
+
+	// Iterate in descending key order, mutating the map as we go. The
+	// mutations are not visible to the iteration.
+	next := count - 1
+	m.AllSorted(func(a, b int) bool {
+		return a > b
+	}, func(k, v int) bool {
+		require.EqualValues(t, next, k)
+		require.EqualValues(t, -k, v)
+		m.Delete(k - 1)
+		m.Put(k+count, k)
+		next--
+		return true
+	})
+	require.EqualValues(t, -1, next)
+
+	// Stopping early.
+	var n int
+	m.AllSorted(func(a, b int) bool {
+		return a < b
+	}, func(k, v int) bool {
+		n++
+		return n < 10
+	})
+	require.EqualValues(t, 10, n)
+}
+
+func TestRandomElement(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](7))
+	_, _, ok := m.RandomElement(r)
+	require.False(t, ok)
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		m.Put(i, -i)
+	}
+	require.Greater(t, int(m.bucketCount()), 1)
+
+	// Every element should be selected with roughly equal probability.
+	const trials = 100_000
+	counts := make([]int, count)
+	for i := 0; i < trials; i++ {
+		k, v, ok := m.RandomElement(r)
+		require.True(t, ok)
+		require.EqualValues(t, -k, v)
+		counts[k]++
+	}
+	const expected = trials / count
+	for k, n := range counts {
+		require.InDelta(t, expected, n, expected*0.15, "key %d", k)
+	}
+}
+
+func TestSample(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	m := New[int, int](0, WithMaxBucketCapacity[int, int](7))
+	keys, values := m.Sample(r, 10)
+	require.Empty(t, keys)
+	require.Empty(t, values)
+
+	const count = 50
+	for i := 0; i < count; i++ {
+		m.Put(i, -i)
+	}
+
+	// Requesting more elements than present returns everything.
+	keys, values = m.Sample(r, 2*count)
+	require.Len(t, keys, count)
+	require.Len(t, values, count)
+	sort.Ints(keys)
+	for i := range keys {
+		require.EqualValues(t, i, keys[i])
+	}
+
+	// Every element should be selected with roughly equal probability.
+	const trials = 20_000
+	const n = 5
+	counts := make([]int, count)
+	for i := 0; i < trials; i++ {
+		keys, values := m.Sample(r, n)
+		require.Len(t, keys, n)
+		seen := make(map[int]bool)
+		for j := range keys {
+			require.EqualValues(t, -keys[j], values[j])
+			require.False(t, seen[keys[j]])
+			seen[keys[j]] = true
+			counts[keys[j]]++
+		}
+	}
+	const expected = trials * n / count
+	for k, c := range counts {
+		require.InDelta(t, expected, c, expected*0.15, "key %d", k)
+	}
+}
+
+func TestRandom(t *testing.T) {
+	test := func(t *testing.T, m *Map[int, int]) {
+		e := make(map[int]int)
+		for i := 0; i < 10000; i++ {
+			switch r := rand.Float64(); {
+			case r < 0.5: // 50% inserts
+				k, v := rand.Int(), rand.Int()
+				m.Put(k, v)
+				e[k] = v
+			case r < 0.65: // 15% updates
+				if k, _, ok := m.randElement(); !ok {
+					require.EqualValues(t, 0, m.Len(), e)
+				} else {
+					v := rand.Int()
+					m.Put(k, v)
+					e[k] = v
+				}
+			case r < 0.80: // 15% deletes
+				if k, _, ok := m.randElement(); !ok {
+					require.EqualValues(t, 0, m.Len(), e)
+				} else {
+					m.Delete(k)
+					delete(e, k)
+				}
+			case r < 0.95: // 25% lookups
+				if k, v, ok := m.randElement(); !ok {
+					require.EqualValues(t, 0, m.Len(), e)
+				} else {
+					require.EqualValues(t, e[k], v)
+				}
+			default: // 5% rehash in place and iterate
+				m.bucket0.rehashInPlace(m)
+				require.Equal(t, e, m.toBuiltinMap())
+			}
+			require.EqualValues(t, len(e), m.Len())
+		}
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		test(t, New[int, int](0))
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		testDegenerate := func(t *testing.T, h uintptr) {
+			m := New[int, int](0,
+				WithHash[int, int](func(key *int, seed uintptr) uintptr {
+					return h
+				}),
+				WithMaxBucketCapacity[int, int](512))
+			test(t, m)
+		}
+
+		for _, v := range []uintptr{0, ^uintptr(0)} {
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+	})
+}
+
+// FuzzMap applies a sequence of operations decoded from the fuzz input to
+// both a Map and a builtin map, cross-checking the two after every operation.
+// The first byte of the input selects the options of the Map, including its
+// maximum bucket capacity. Each subsequent operation is encoded in 3 bytes:
+// the operation followed by a 16-bit key, whose small domain makes it likely
+// for operations to target keys which are present.
+func FuzzMap(f *testing.F) {
+	configs := [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](7)},
+		{WithMaxBucketCapacity[int, int](15)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithMaxBucketCapacity[int, int](1023)},
+		{WithIncrementalResize[int, int]()},
+		{WithIncrementalResize[int, int](), WithMaxBucketCapacity[int, int](255)},
+		{WithMaxLoadFactor[int, int](0.5), WithMaxBucketCapacity[int, int](63)},
+	}
+
+	f.Add([]byte{0, 0, 0, 1, 1, 0, 1, 2, 0, 1})
+	f.Add([]byte{1, 0, 0, 1, 0, 0, 2, 0, 0, 1, 3, 0, 0, 4, 0, 40})
+	for c := range configs {
+		// Fill the map with 500 keys and then delete them.
+		seed := []byte{byte(c)}
+		for op := byte(0); op < 3; op += 2 {
+			for k := 0; k < 500; k++ {
+				seed = append(seed, op, byte(k>>8), byte(k))
+			}
+		}
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if len(data) == 0 {
+			return
+		}
+		m := New[int, int](0, configs[int(data[0])%len(configs)]...)
+		e := make(map[int]int)
+		data = data[1:]
+
+		for i := 0; len(data) >= 3; i++ {
+			op, k := data[0], int(data[1])<<8|int(data[2])
+			data = data[3:]
+
+			switch op % 8 {
+			case 0, 1: // Put
+				m.Put(k, i)
+				e[k] = i
+			case 2: // Delete
+				m.Delete(k)
+				delete(e, k)
+			case 3: // Clear
+				if op&0x80 != 0 {
+					m.Clear()
+					clear(e)
+				}
+			case 4: // Grow, by at most 4095 entries.
+				m.Grow(k & 4095)
+			case 5: // Rebuild the map in one of several ways.
+				switch op >> 6 {
+				case 0:
+					m.Compact()
+				case 1:
+					m.Shrink()
+				case 2:
+					m.ClearAndShrink()
+					clear(e)
+				case 3:
+					m.Reset()
+					clear(e)
+				}
+			default: // Get
+			}
+
+			v, ok := m.Get(k)
+			ev, eok := e[k]
+			if ok != eok || v != ev {
+				t.Fatalf("op %d: Get(%d) = %d, %t; expected %d, %t", i, k, v, ok, ev, eok)
+			}
+			if m.Len() != len(e) {
+				t.Fatalf("op %d: Len() = %d; expected %d", i, m.Len(), len(e))
+			}
+		}
+
+		require.Equal(t, e, m.toBuiltinMap())
+		for k, ev := range e {
+			v, ok := m.Get(k)
+			require.True(t, ok)
+			require.Equal(t, ev, v)
+		}
+	})
+}
+
+func TestIterateMutate(t *testing.T) {
+	m := New[int, int](0)
+	for i := 0; i < 100; i++ {
+		m.Put(i, i)
+	}
+	e := m.toBuiltinMap()
+	require.EqualValues(t, 100, m.Len())
+	require.EqualValues(t, 100, len(e))
+
+	// Iterate over the map, resizing it periodically. We should see all of
+	// the elements that were originally in the map because All takes a
+	// snapshot of the ctrls and slots before iterating.
+	vals := make(map[int]int)
+	m.All(func(k, v int) bool {
+		if (k % 10) == 0 {
+			m.bucket0.resize(m, 2*m.bucket0.capacity+1)
+		}
+		vals[k] = v
+		return true
+	})
+	require.EqualValues(t, e, vals)
+}
+
+func TestIterateMutateAllocator(t *testing.T) {
+	// Tables freed while iterating are not released to the allocator until
+	// the iteration finishes, so an allocator may reuse freed memory
+	// immediately. The recycling allocator poisons freed slots.
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](7)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			a := &recyclingAllocator[int, int]{
+				poison: Slot[int, int]{key: -1, value: -1},
+				ctrls:  make(map[int][][]uint8),
+				slots:  make(map[int][][]Slot[int, int]),
+			}
+			m := New[int, int](0, append(options, WithAllocator[int, int](a))...)
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			e := m.toBuiltinMap()
+
+			frees := m.Stats().Frees
+			var deferred int
+			vals := make(map[int]int)
+			m.All(func(k, v int) bool {
+				// A nested iteration finishing does not release the tables.
+				m.All(func(k, v int) bool { return false })
+				if k >= 100 {
+					// Entries inserted during iteration may be visited.
+					return true
+				}
+				for i := 0; i < 100; i++ {
+					m.Put(1000+100*k+i, 0)
+				}
+				require.EqualValues(t, frees, m.Stats().Frees)
+				deferred = len(m.deferredFrees)
+				vals[k] = v
+				return true
+			})
+			// Note that entries may be missed when buckets split during
+			// iteration, but no freed slot is visited.
+			for k, v := range vals {
+				require.EqualValues(t, e[k], v)
+			}
+			require.EqualValues(t, frees+deferred, m.Stats().Frees)
+			require.Empty(t, m.deferredFrees)
+			if m.BucketCount() == 1 {
+				// Resizing the single bucket freed its tables.
+				require.NotZero(t, deferred)
+			}
+
+			// Closing the map while iterating releases the tables to the
+			// allocator the map was created with.
+			m.All(func(k, v int) bool {
+				m.Close()
+				require.Less(t, m.frees, m.allocs)
+				return false
+			})
+			require.EqualValues(t, m.allocs, m.frees)
+		})
+	}
+}
+
+func TestClear(t *testing.T) {
+	testCases := []struct {
+		count             int
+		maxBucketCapacity uintptr
+	}{
+		{count: 1000, maxBucketCapacity: math.MaxUint64},
+		{count: 1000, maxBucketCapacity: 7},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			for i := 0; i < c.count; i++ {
+				m.Put(i, i)
+			}
+
+			capacity := m.Cap()
+			m.Clear()
+			require.EqualValues(t, 0, m.Len())
+			require.EqualValues(t, capacity, m.Cap())
+
+			m.All(func(k, v int) bool {
+				require.Fail(t, "should not iterate")
+				return true
+			})
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var zero Map[int, int]
+	require.NoError(t, zero.Validate())
+
+	build := func() *Map[int, int] {
+		m := New[int, int](0, WithMaxBucketCapacity[int, int](127))
+		for i := 0; i < 1000; i++ {
+			m.Put(i, i)
+		}
+		for i := 0; i < 1000; i += 3 {
+			m.Delete(i)
+		}
+		require.NoError(t, m.Validate())
+		return m
+	}
+	full := func(b *bucket[int, int]) uintptr {
+		for i := uintptr(0); ; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) != ctrlEmpty {
+				return i
+			}
+		}
+	}
+
+	testCases := []struct {
+		corrupt func(m *Map[int, int], b *bucket[int, int])
+		err     string
+	}{
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			*b.ctrls.At(b.capacity) = ctrlEmpty
+		}, "expected sentinel"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			*b.ctrls.At(0) ^= 1
+		}, "!= ctrl"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			b.slots.At(full(b)).key = -1
+		}, "not found"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			b.used++
+		}, "used count"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			b.growthLeft--
+		}, "growthLeft"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			m.used--
+		}, "Len"},
+		{func(m *Map[int, int], b *bucket[int, int]) {
+			*m.dir.At(0) = nil
+		}, "nil bucket"},
+	}
+	for _, c := range testCases {
+		t.Run(c.err, func(t *testing.T) {
+			m := build()
+			c.corrupt(m, *m.dir.At(m.bucketCount() - 1))
+			require.ErrorContains(t, m.Validate(), c.err)
+		})
+	}
+
+	m := build()
+	m.Close()
+	require.Error(t, m.Validate())
+}
+
+func TestString(t *testing.T) {
+	m := New[int, string](0)
+	require.Equal(t, "swiss.Map[int,string]{len:0 cap:0 buckets:1 []}", m.String())
+
+	m.Put(1, "a")
+	require.Equal(t, fmt.Sprintf("swiss.Map[int,string]{len:1 cap:%d buckets:1 [1:a]}",
+		minBucketCapacity), m.String())
+	require.Equal(t, m.String(), fmt.Sprint(m))
+
+	for i := 2; i <= 1000; i++ {
+		m.Put(i, fmt.Sprint(i))
+	}
+	s := m.String()
+	require.True(t, strings.HasPrefix(s, "swiss.Map[int,string]{len:1000 "), s)
+	require.True(t, strings.HasSuffix(s, " ...]}"), s)
+	require.EqualValues(t, maxStringEntries, strings.Count(s, ":")-3)
+}
+
+func TestCompact(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 127} {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < 10_000; i++ {
+				m.Put(i, i)
+			}
+			for i := 0; i < 10_000; i++ {
+				if i%4 != 0 {
+					m.Delete(i)
+				}
+			}
+			e := m.toBuiltinMap()
+			before := m.Stats()
+			require.Greater(t, before.Tombstones, 0)
+			alloc := a.alloc
+
+			m.Compact()
+			after := m.Stats()
+			require.EqualValues(t, 0, after.Tombstones)
+			require.EqualValues(t, before.Capacity, after.Capacity)
+			require.EqualValues(t, before.BucketCount, after.BucketCount)
+			require.EqualValues(t, before.GrowthLeft+before.Tombstones, after.GrowthLeft)
+			require.EqualValues(t, alloc, a.alloc)
+			require.Equal(t, e, m.toBuiltinMap())
+			for k, v := range e {
+				got, ok := m.Get(k)
+				require.True(t, ok)
+				require.EqualValues(t, v, got)
+			}
+		})
+	}
+}
+
+func TestClearAndShrink(t *testing.T) {
+	testCases := []struct {
+		count             int
+		maxBucketCapacity uintptr
+	}{
+		{count: 1000, maxBucketCapacity: math.MaxUint64},
+		{count: 1000, maxBucketCapacity: 7},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			for i := 0; i < c.count; i++ {
+				m.Put(i, i)
+			}
+			require.Greater(t, a.alloc, a.free)
+
+			m.ClearAndShrink()
+			require.EqualValues(t, 0, m.Len())
+			require.EqualValues(t, 0, m.Cap())
+			require.EqualValues(t, 1, m.bucketCount())
+			require.EqualValues(t, a.alloc, a.free)
+
+			m.All(func(k, v int) bool {
+				require.Fail(t, "should not iterate")
+				return true
+			})
+
+			// The map is reusable and reallocates on the next Put.
+			alloc := a.alloc
+			m.Put(1, 1)
+			require.EqualValues(t, alloc+1, a.alloc)
+			require.Equal(t, map[int]int{1: 1}, m.toBuiltinMap())
+
+			m.Close()
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
 
 type countingAllocator[K comparable, V any] struct {
 	alloc int
@@ -483,6 +3259,101 @@ func (a *countingAllocator[K, V]) Free(_ []uint8, _ []Slot[K, V]) {
 	a.free++
 }
 
+func TestUseAfterClose(t *testing.T) {
+	for _, maxBucketCapacity := range []uintptr{math.MaxUint64, 7} {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			m := New[int, int](0, WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](maxBucketCapacity))
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			m.Close()
+			require.EqualValues(t, a.alloc, a.free)
+			// Close is idempotent.
+			m.Close()
+			require.EqualValues(t, a.alloc, a.free)
+
+			if invariants {
+				// Any use of a closed map panics.
+				const msg = "invariant failed: use of closed Map"
+				require.PanicsWithValue(t, msg, func() { m.Get(1) })
+				require.PanicsWithValue(t, msg, func() { m.Put(1, 1) })
+				require.PanicsWithValue(t, msg, func() { m.Delete(1) })
+				require.PanicsWithValue(t, msg, func() {
+					m.All(func(k, v int) bool { return true })
+				})
+				require.PanicsWithValue(t, msg, func() { m.Clear() })
+				return
+			}
+
+			// A closed map behaves as an empty map.
+			require.EqualValues(t, 0, m.Len())
+			_, ok := m.Get(1)
+			require.False(t, ok)
+			require.False(t, m.Contains(1))
+			require.Nil(t, m.GetPtr(1))
+			m.Delete(1)
+			m.All(func(k, v int) bool {
+				t.Fatalf("unexpected entry %d", k)
+				return true
+			})
+			require.EqualValues(t, 0, m.Len())
+
+			// Entries inserted into a closed map are allocated by the
+			// default allocator rather than the closed map's allocator.
+			alloc := a.alloc
+			for i := 0; i < 100; i++ {
+				m.Put(i, i)
+			}
+			require.EqualValues(t, 100, m.Len())
+			v, ok := m.Get(1)
+			require.True(t, ok)
+			require.EqualValues(t, 1, v)
+			require.EqualValues(t, alloc, a.alloc)
+			require.EqualValues(t, a.alloc, a.free)
+		})
+	}
+}
+
+func TestTablePadding(t *testing.T) {
+	m := New[int, int](0, WithTablePadding[int, int]())
+	e := make(map[int]int)
+	for i := 0; i < 10_000; i++ {
+		k := rand.Intn(5000)
+		if i%3 == 0 {
+			m.Delete(k)
+			delete(e, k)
+		} else {
+			m.Put(k, i)
+			e[k] = i
+		}
+	}
+	require.Equal(t, e, m.toBuiltinMap())
+	m.Close()
+
+	// The tables of small maps do not share cache lines: there is at least a
+	// cache line between the memory used by any two tables.
+	var a paddedAllocator[int, int]
+	type span struct{ start, end uintptr }
+	var spans []span
+	add := func(p unsafe.Pointer, n uintptr) {
+		spans = append(spans, span{uintptr(p), uintptr(p) + n})
+	}
+	for i := 0; i < 100; i++ {
+		ctrls, slots := a.Alloc(7+groupSize, 7)
+		require.Len(t, ctrls, 7+groupSize)
+		require.Len(t, slots, 7)
+		require.Equal(t, 7+groupSize, cap(ctrls))
+		add(unsafe.Pointer(&ctrls[0]), uintptr(len(ctrls)))
+		add(unsafe.Pointer(&slots[0]), uintptr(len(slots))*unsafe.Sizeof(slots[0]))
+	}
+	slices.SortFunc(spans, func(a, b span) int { return cmp.Compare(a.start, b.start) })
+	for i := 1; i < len(spans); i++ {
+		require.GreaterOrEqual(t, int(spans[i].start-spans[i-1].end), cacheLineSize)
+	}
+}
+
 func TestAllocator(t *testing.T) {
 	a := &countingAllocator[int, int]{}
 	m := New[int, int](0, WithAllocator[int, int](a),
@@ -492,8 +3363,8 @@ func TestAllocator(t *testing.T) {
 		m.Put(i, i)
 	}
 
-	// 8 -> 16 -> 32 -> 64 -> 128
-	const expected = 5
+	// 8 -> 16 -> 32 -> 64 -> 128 with 8-wide groups.
+	expected := bits.TrailingZeros(128/groupSize) + 1
 	require.EqualValues(t, expected, a.alloc)
 	require.EqualValues(t, expected-1, a.free)
 
@@ -502,6 +3373,264 @@ func TestAllocator(t *testing.T) {
 	require.EqualValues(t, expected, a.free)
 }
 
+// arenaAllocator is a bump allocator which carves ctrls and slots out of
+// preallocated arenas. Free is a noop and the memory is released all at once
+// by reset. The slots arena is a []Slot[K,V] so that the slots are properly
+// aligned and any pointers they contain are visible to the GC.
+type arenaAllocator[K comparable, V any] struct {
+	ctrls []uint8
+	slots []Slot[K, V]
+	// ctrlsUsed and slotsUsed are the number of ctrls and slots handed out
+	// since the last reset.
+	ctrlsUsed int
+	slotsUsed int
+	// fallback is the number of allocations which did not fit in the arenas
+	// and were satisfied from the Go heap.
+	fallback int
+}
+
+func newArenaAllocator[K comparable, V any](ctrls, slots int) *arenaAllocator[K, V] {
+	return &arenaAllocator[K, V]{
+		ctrls: make([]uint8, ctrls),
+		slots: make([]Slot[K, V], slots),
+	}
+}
+
+func (a *arenaAllocator[K, V]) Alloc(ctrls, slots int) ([]uint8, []Slot[K, V]) {
+	if a.ctrlsUsed+ctrls > len(a.ctrls) || a.slotsUsed+slots > len(a.slots) {
+		a.fallback++
+		return make([]uint8, ctrls), make([]Slot[K, V], slots)
+	}
+	c := a.ctrls[a.ctrlsUsed : a.ctrlsUsed+ctrls : a.ctrlsUsed+ctrls]
+	s := a.slots[a.slotsUsed : a.slotsUsed+slots : a.slotsUsed+slots]
+	a.ctrlsUsed += ctrls
+	a.slotsUsed += slots
+	return c, s
+}
+
+func (a *arenaAllocator[K, V]) Free(_ []uint8, _ []Slot[K, V]) {
+}
+
+// reset releases all of the memory handed out by the allocator. The memory
+// is cleared as the Allocator contract requires zeroed memory.
+func (a *arenaAllocator[K, V]) reset() {
+	clear(a.ctrls[:a.ctrlsUsed])
+	clear(a.slots[:a.slotsUsed])
+	a.ctrlsUsed = 0
+	a.slotsUsed = 0
+}
+
+func TestArenaAllocator(t *testing.T) {
+	const count = 1000
+	// The map grows 8 -> 16 -> ... -> 2048 slots while inserting count
+	// entries. Each table requires capacity+groupSize ctrls.
+	a := newArenaAllocator[int, *int](4096+9*groupSize, 4096)
+	options := []option[int, *int]{
+		WithAllocator[int, *int](a),
+		WithMaxBucketCapacity[int, *int](math.MaxUint64),
+	}
+	values := make([]int, count)
+
+	var m Map[int, *int]
+	run := func() {
+		a.reset()
+		m.Init(0, options...)
+		for i := 0; i < count; i++ {
+			m.Put(i, &values[i])
+		}
+		for i := 0; i < count; i += 2 {
+			m.Delete(i)
+		}
+		m.Close()
+	}
+
+	// None of the ctrls and slots are allocated from the Go heap.
+	require.EqualValues(t, 0, testing.AllocsPerRun(10, run))
+	require.EqualValues(t, 0, a.fallback)
+
+	// The map contains pointers into values which are only reachable through
+	// the arena.
+	a.reset()
+	m.Init(0, options...)
+	for i := 0; i < count; i++ {
+		v := new(int)
+		*v = i
+		m.Put(i, v)
+	}
+	runtime.GC()
+	for i := 0; i < count; i++ {
+		v, ok := m.Get(i)
+		require.True(t, ok)
+		require.EqualValues(t, i, *v)
+	}
+	m.Close()
+	require.EqualValues(t, 0, a.fallback)
+}
+
+// recyclingAllocator pools freed tables by size and hands them out again. It
+// counts the freed slots which were not cleared by the map. Freed slots are
+// then poisoned, and are deliberately not cleared when reused, so that a test
+// can detect the map surfacing the contents of a slot it has not written. Note
+// that this violates the Allocator contract if K or V contain pointers.
+type recyclingAllocator[K comparable, V any] struct {
+	poison Slot[K, V]
+	ctrls  map[int][][]uint8
+	slots  map[int][][]Slot[K, V]
+	reused int
+	stale  int
+}
+
+func (a *recyclingAllocator[K, V]) Alloc(ctrls, slots int) ([]uint8, []Slot[K, V]) {
+	if n := len(a.slots[slots]); n > 0 && len(a.ctrls[ctrls]) > 0 {
+		s := a.slots[slots][n-1]
+		a.slots[slots] = a.slots[slots][:n-1]
+		c := a.ctrls[ctrls][len(a.ctrls[ctrls])-1]
+		a.ctrls[ctrls] = a.ctrls[ctrls][:len(a.ctrls[ctrls])-1]
+		clear(c)
+		a.reused++
+		return c, s
+	}
+	return make([]uint8, ctrls), make([]Slot[K, V], slots)
+}
+
+func (a *recyclingAllocator[K, V]) Free(ctrls []uint8, slots []Slot[K, V]) {
+	for i := range slots {
+		if !reflect.ValueOf(slots[i]).IsZero() {
+			a.stale++
+		}
+		slots[i] = a.poison
+	}
+	a.ctrls[len(ctrls)] = append(a.ctrls[len(ctrls)], ctrls)
+	a.slots[len(slots)] = append(a.slots[len(slots)], slots)
+}
+
+func TestRecyclingAllocator(t *testing.T) {
+	for _, options := range [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](127)},
+		{WithIncrementalResize[int, int]()},
+	} {
+		t.Run("", func(t *testing.T) {
+			a := &recyclingAllocator[int, int]{
+				poison: Slot[int, int]{key: -1, value: -1},
+				ctrls:  make(map[int][][]uint8),
+				slots:  make(map[int][][]Slot[int, int]),
+			}
+			options := append(options, WithAllocator[int, int](a))
+			e := make(map[int]int)
+			for round := 0; round < 3; round++ {
+				m := New[int, int](0, options...)
+				for i := 0; i < 5000; i++ {
+					k := rand.Intn(1 << 20)
+					m.Put(k, k)
+					e[k] = k
+					if i%3 == 0 {
+						m.Delete(k)
+						delete(e, k)
+					}
+				}
+				// Reseeding rebuilds every table, freeing the old ones.
+				m.Reseed()
+
+				_, ok := m.Get(-1)
+				require.False(t, ok)
+				require.Equal(t, e, m.toBuiltinMap())
+				m.Close()
+				clear(e)
+			}
+			require.Greater(t, a.reused, 0)
+			require.Zero(t, a.stale)
+		})
+	}
+}
+
+func TestMetamorphic(t *testing.T) {
+	// Each configuration lays the map out differently: as a single bucket
+	// which is only ever resized, or as a directory of buckets split at
+	// various sizes. The observable behavior of the maps must be identical.
+	configs := [][]option[int, int]{
+		{WithMaxBucketCapacity[int, int](7)},
+		{WithMaxBucketCapacity[int, int](15)},
+		{WithMaxBucketCapacity[int, int](512)},
+		{WithMaxBucketCapacity[int, int](math.MaxUint64)},
+		{WithMaxBucketCapacity[int, int](15), WithIncrementalResize[int, int]()},
+		{WithMaxBucketCapacity[int, int](math.MaxUint64), WithIncrementalResize[int, int]()},
+	}
+
+	ops := 20000
+	if invariants {
+		ops = 5000
+	}
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %d", seed)
+	rng := rand.New(rand.NewSource(seed))
+
+	maps := make([]*Map[int, int], len(configs))
+	// results holds the observable result of an operation on each map.
+	results := make([][2]any, len(configs))
+	for i := range configs {
+		maps[i] = New[int, int](0, configs[i]...)
+	}
+	// Keys are drawn from a small domain so that operations often target
+	// keys which are present. The domain grows and shrinks so that the maps
+	// repeatedly grow and shrink.
+	domain := 1
+	for i := 0; i < ops; i++ {
+		if i%1000 == 0 {
+			domain = 1 << rng.Intn(14)
+		}
+		k := rng.Intn(domain)
+		v := rng.Int()
+		op := rng.Intn(100)
+		if op == 84 && rng.Intn(10) != 0 {
+			// Clear rarely, as it undoes the growth of the maps.
+			op = 99
+		}
+
+		for j, m := range maps {
+			var r [2]any
+			switch {
+			case op < 40:
+				m.Put(k, v)
+			case op < 50:
+				r[0], r[1] = m.GetOrPut(k, v)
+			case op < 60:
+				r[0], r[1] = m.Swap(k, v)
+			case op < 80:
+				m.Delete(k)
+			case op < 81:
+				m.DeleteFunc(func(key, _ int) bool { return key%3 == k%3 })
+			case op < 82:
+				m.Grow(k)
+			case op < 83:
+				m.Shrink()
+			case op < 84:
+				m.Compact()
+			case op < 85:
+				m.Clear()
+			default:
+				r[0], r[1] = m.Get(k)
+			}
+			results[j] = r
+		}
+
+		for j, m := range maps {
+			require.Equal(t, results[0], results[j], "op %d: %d", i, op)
+			require.Equal(t, maps[0].Len(), m.Len(), "op %d: %d", i, op)
+			v0, ok0 := maps[0].Get(k)
+			v, ok := m.Get(k)
+			require.Equal(t, ok0, ok, "op %d: %d", i, op)
+			require.Equal(t, v0, v, "op %d: %d", i, op)
+		}
+		if i%500 == 0 {
+			e := maps[0].toBuiltinMap()
+			for _, m := range maps[1:] {
+				require.Equal(t, e, m.toBuiltinMap())
+			}
+		}
+	}
+}
+
 func TestResizeVsSplit(t *testing.T) {
 	if invariants {
 		t.Skip("skipped due to slowness under invariants")
@@ -530,3 +3659,147 @@ func TestResizeVsSplit(t *testing.T) {
 		fmt.Printf("resize(%d): %6.3fms\n", count, time.Since(start).Seconds()*1000)
 	}
 }
+
+func TestIncrementalResize(t *testing.T) {
+	count := 20_000
+	if invariants {
+		count = 2_000
+	}
+
+	// migrating returns a map whose single bucket is in the middle of an
+	// incremental resize, along with the expected contents of the map.
+	migrating := func(t *testing.T) (*Map[int, int], map[int]int) {
+		m := New[int, int](0, WithIncrementalResize[int, int](),
+			WithMaxBucketCapacity[int, int](math.MaxUint64))
+		e := make(map[int]int)
+		for i := 0; m.bucket0.old == nil || m.bucket0.capacity < 1023; i++ {
+			m.Put(i, i)
+			e[i] = i
+		}
+		require.Less(t, int(m.bucket0.old.migrated), int(m.bucket0.old.capacity))
+		return m, e
+	}
+
+	t.Run("bounded", func(t *testing.T) {
+		// The migration is spread across multiple insertions.
+		m, _ := migrating(t)
+		puts := 0
+		for i := -1; m.bucket0.old != nil; i-- {
+			m.Put(i, i)
+			puts++
+		}
+		require.Greater(t, puts, 1)
+	})
+
+	t.Run("lookups", func(t *testing.T) {
+		m, e := migrating(t)
+		for k, v := range e {
+			got, ok := m.Get(k)
+			require.True(t, ok)
+			require.EqualValues(t, v, got)
+			require.True(t, m.Contains(k))
+			require.EqualValues(t, v, *m.GetPtr(k))
+		}
+		_, ok := m.Get(-1)
+		require.False(t, ok)
+		require.False(t, m.Contains(-1))
+		require.Nil(t, m.GetPtr(-1))
+		require.NotNil(t, m.bucket0.old)
+	})
+
+	t.Run("mutations", func(t *testing.T) {
+		m, e := migrating(t)
+		old := m.bucket0.old
+		// Keys at the end of the old table have not been migrated.
+		var k int
+		for i := old.capacity - 1; ; i-- {
+			if (old.ctrls.Get(i) & ctrlEmpty) != ctrlEmpty {
+				k = old.slots.At(i).key
+				break
+			}
+		}
+		m.Put(k, -k)
+		e[k] = -k
+		v, ok := m.Swap(k, k)
+		require.True(t, ok)
+		require.EqualValues(t, -k, v)
+		e[k] = k
+		require.True(t, CompareAndDelete(m, k, k))
+		delete(e, k)
+		require.EqualValues(t, len(e), m.Len())
+
+		c := m.Clone()
+		require.Equal(t, e, c.toBuiltinMap())
+		require.Equal(t, e, m.toBuiltinMap())
+		require.NotNil(t, m.bucket0.old)
+	})
+
+	t.Run("iteration", func(t *testing.T) {
+		m, e := migrating(t)
+		r := rand.New(rand.NewSource(1))
+		for i := 0; i < 100; i++ {
+			k, v, ok := m.RandomElement(r)
+			require.True(t, ok)
+			require.EqualValues(t, e[k], v)
+		}
+		keys, values := m.Sample(r, len(e))
+		require.Len(t, keys, len(e))
+		for i := range keys {
+			require.EqualValues(t, e[keys[i]], values[i])
+		}
+		var probed int
+		for _, n := range m.ProbeStats().Histogram {
+			probed += n
+		}
+		require.EqualValues(t, len(e), probed)
+
+		// Entries migrated by insertions performed during iteration are
+		// visited exactly once.
+		seen := make(map[int]int)
+		m.All(func(k, v int) bool {
+			seen[k]++
+			m.Put(-k-1, 0)
+			return true
+		})
+		for k := range e {
+			require.EqualValues(t, 1, seen[k], "key %d", k)
+		}
+		for k, n := range seen {
+			require.EqualValues(t, 1, n, "key %d", k)
+		}
+	})
+
+	t.Run("random", func(t *testing.T) {
+		m := New[int, int](0, WithIncrementalResize[int, int](),
+			WithMaxBucketCapacity[int, int](math.MaxUint64))
+		e := make(map[int]int)
+		var migratingOps int
+		for i := 0; i < count; i++ {
+			k := rand.Intn(count)
+			switch rand.Intn(4) {
+			case 0:
+				m.Delete(k)
+				delete(e, k)
+			case 1:
+				v, ok := m.Get(k)
+				ev, eok := e[k]
+				require.Equal(t, eok, ok)
+				require.Equal(t, ev, v)
+			default:
+				m.Put(k, i)
+				e[k] = i
+			}
+			if m.bucket0.old != nil {
+				migratingOps++
+			}
+			require.EqualValues(t, len(e), m.Len())
+		}
+		require.Greater(t, migratingOps, 0)
+		for k, v := range e {
+			got, ok := m.Get(k)
+			require.True(t, ok)
+			require.EqualValues(t, v, got)
+		}
+		require.Equal(t, e, m.toBuiltinMap())
+	})
+}
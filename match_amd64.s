@@ -0,0 +1,42 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_group32 && amd64 && swiss_simd
+
+#include "textflag.h"
+
+// func matchByte(ctrls, b uint64) uint64
+TEXT ·matchByte(SB), NOSPLIT, $0-24
+	MOVQ    ctrls+0(FP), X0
+	MOVQ    b+8(FP), X1
+	PCMPEQB X1, X0
+	MOVQ    X0, AX
+	MOVQ    $0x8080808080808080, BX
+	ANDQ    BX, AX
+	MOVQ    AX, ret+16(FP)
+	RET
+
+// func matchBytes2(ctrls, b1, b2 uint64) uint64
+TEXT ·matchBytes2(SB), NOSPLIT, $0-32
+	MOVQ    ctrls+0(FP), X0
+	MOVQ    b1+8(FP), X1
+	MOVQ    b2+16(FP), X2
+	PCMPEQB X0, X1
+	PCMPEQB X0, X2
+	POR     X2, X1
+	MOVQ    X1, AX
+	MOVQ    $0x8080808080808080, BX
+	ANDQ    BX, AX
+	MOVQ    AX, ret+24(FP)
+	RET
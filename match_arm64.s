@@ -0,0 +1,45 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_group32 && arm64 && swiss_simd
+
+#include "textflag.h"
+
+// func matchByte(ctrls, b uint64) uint64
+TEXT ·matchByte(SB), NOSPLIT, $0-24
+	MOVD  ctrls+0(FP), R0
+	MOVD  b+8(FP), R1
+	VMOV  R0, V0.D[0]
+	VMOV  R1, V1.D[0]
+	VCMEQ V0.B8, V1.B8, V2.B8
+	VMOV  V2.D[0], R0
+	AND   $0x8080808080808080, R0, R0
+	MOVD  R0, ret+16(FP)
+	RET
+
+// func matchBytes2(ctrls, b1, b2 uint64) uint64
+TEXT ·matchBytes2(SB), NOSPLIT, $0-32
+	MOVD  ctrls+0(FP), R0
+	MOVD  b1+8(FP), R1
+	MOVD  b2+16(FP), R2
+	VMOV  R0, V0.D[0]
+	VMOV  R1, V1.D[0]
+	VMOV  R2, V2.D[0]
+	VCMEQ V0.B8, V1.B8, V3.B8
+	VCMEQ V0.B8, V2.B8, V4.B8
+	VORR  V3.B8, V4.B8, V5.B8
+	VMOV  V5.D[0], R0
+	AND   $0x8080808080808080, R0, R0
+	MOVD  R0, ret+24(FP)
+	RET
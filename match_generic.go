@@ -0,0 +1,58 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !swiss_group32 && (!(amd64 || arm64) || !swiss_simd)
+
+package swiss
+
+// matchH2 returns the set of slots which are full and for which the 7-bit hash
+// matches the given value. May return false positives.
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	// NB: This generic matching routine produces false positive matches when
+	// h is 2^N and the control bytes have a seq of 2^N followed by 2^N+1. For
+	// example: if ctrls==0x0302 and h=02, we'll compute v as 0x0100. When we
+	// subtract off 0x0101 the first 2 bytes we'll become 0xffff and both be
+	// considered matches of h. The false positive matches are not a problem,
+	// just a rare inefficiency. Note that they only occur if there is a real
+	// match and never occur on ctrlEmpty, ctrlDeleted, or ctrlSentinel. The
+	// subsequent key comparisons ensure that there is no correctness issue.
+	v := uint64(*g) ^ (bitsetLSB * uint64(h))
+	return bitset(((v - bitsetLSB) &^ v) & bitsetMSB)
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	// An empty slot is              1000 0000
+	// A deleted or sentinel slot is 1111 111?
+	// A full slot is                0??? ????
+	//
+	// A slot is empty iff bit 7 is set and bit 1 is not.
+	// We could select any of the other bits here (e.g. v << 1 would also
+	// work).
+	v := uint64(*g)
+	return bitset((v &^ (v << 6)) & bitsetMSB)
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	// An empty slot is  1000 0000.
+	// A deleted slot is 1111 1110.
+	// The sentinel is   1111 1111.
+	// A full slot is    0??? ????
+	//
+	// A slot is empty or deleted iff bit 7 is set and bit 0 is not.
+	v := uint64(*g)
+	return bitset((v &^ (v << 7)) & bitsetMSB)
+}
@@ -0,0 +1,51 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_group32 && amd64.v3
+
+package swiss
+
+// The routines in this file match the control bytes of a 32-wide group using
+// AVX2 vector compare instructions, which GOAMD64=v3 guarantees are
+// available. A single VPCMPEQB compares the entire group, and VPMOVMSKB
+// produces the bitset directly. Unlike the SWAR routines, matchH2 never
+// returns false positives.
+
+// matchByte32 returns the set of slots in the group whose control byte is b.
+//
+//go:noescape
+func matchByte32(ctrls *ctrlGroup, b uintptr) bitset
+
+// matchEmptyOrDeleted32 returns the set of slots in the group whose control
+// byte has the high bit set and is not the sentinel.
+//
+//go:noescape
+func matchEmptyOrDeleted32(ctrls *ctrlGroup) bitset
+
+// matchH2 returns the set of slots which are full and for which the 7-bit hash
+// matches the given value.
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	return matchByte32(g, h)
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	return matchByte32(g, uintptr(ctrlEmpty))
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	return matchEmptyOrDeleted32(g)
+}
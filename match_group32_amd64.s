@@ -0,0 +1,43 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_group32 && amd64.v3
+
+#include "textflag.h"
+
+// func matchByte32(ctrls *ctrlGroup, b uintptr) bitset
+TEXT ·matchByte32(SB), NOSPLIT, $0-20
+	MOVQ         ctrls+0(FP), AX
+	VMOVDQU      (AX), Y0
+	MOVQ         b+8(FP), X1
+	VPBROADCASTB X1, Y1
+	VPCMPEQB     Y0, Y1, Y1
+	VPMOVMSKB    Y1, AX
+	VZEROUPPER
+	MOVL         AX, ret+16(FP)
+	RET
+
+// func matchEmptyOrDeleted32(ctrls *ctrlGroup) bitset
+TEXT ·matchEmptyOrDeleted32(SB), NOSPLIT, $0-12
+	MOVQ      ctrls+0(FP), AX
+	VMOVDQU   (AX), Y0
+	VPCMPEQB  Y1, Y1, Y1
+	VPCMPEQB  Y0, Y1, Y1
+	VPMOVMSKB Y0, AX
+	VPMOVMSKB Y1, BX
+	VZEROUPPER
+	NOTL      BX
+	ANDL      BX, AX
+	MOVL      AX, ret+8(FP)
+	RET
@@ -0,0 +1,61 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build swiss_group32 && !amd64.v3
+
+package swiss
+
+// The routines in this file match the control bytes of a 32-wide group by
+// applying the SWAR arithmetic of match_generic.go to each 8 byte word of the
+// group and packing the high bit of each byte into the bitset.
+
+// packMSBs packs the high bit of each byte of v, which must have no other
+// bits set, into the low 8 bits of the result.
+func packMSBs(v uint64) bitset {
+	// The multiplication moves the high bit of byte i to bit 56+i. The
+	// partial products are distinct powers of two, so no carries occur.
+	return bitset(((v >> 7) * 0x0102040810204080) >> 56)
+}
+
+// matchH2 returns the set of slots which are full and for which the 7-bit hash
+// matches the given value. May return false positives (see match_generic.go).
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	var b bitset
+	for i := range g {
+		v := g[i] ^ (bitsetLSB * uint64(h))
+		b |= packMSBs(((v-bitsetLSB)&^v)&bitsetMSB) << (8 * i)
+	}
+	return b
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	var b bitset
+	for i := range g {
+		v := g[i]
+		b |= packMSBs((v&^(v<<6))&bitsetMSB) << (8 * i)
+	}
+	return b
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	var b bitset
+	for i := range g {
+		v := g[i]
+		b |= packMSBs((v&^(v<<7))&bitsetMSB) << (8 * i)
+	}
+	return b
+}
@@ -0,0 +1,57 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+//go:build !swiss_group32 && (amd64 || arm64) && swiss_simd
+
+package swiss
+
+// The routines in this file match the control bytes of a group using vector
+// compare instructions (SSE2 PCMPEQB on amd64, NEON CMEQ on arm64) rather than
+// the portable SWAR arithmetic in match_generic.go. They are enabled by the
+// swiss_simd build tag.
+//
+// The group remains 8 bytes wide and the bitset representation returned by
+// the matching routines (the high bit of each byte, see group8.go) is relied
+// upon throughout map.go. The comparisons operate on 8 byte vectors and the
+// result is masked to produce a bitset identical to the one produced by the
+// SWAR routines. Wider groups are enabled by the swiss_group32 build tag
+// instead (see group32.go). Note that calls to assembly functions cannot be
+// inlined by the Go compiler which is why this implementation is opt-in
+// rather than the default.
+
+// matchByte returns a bitset with the high bit of each byte of ctrls set iff
+// that byte is equal to the corresponding byte of b.
+func matchByte(ctrls, b uint64) uint64
+
+// matchBytes2 returns a bitset with the high bit of each byte of ctrls set iff
+// that byte is equal to the corresponding byte of either b1 or b2.
+func matchBytes2(ctrls, b1, b2 uint64) uint64
+
+// matchH2 returns the set of slots which are full and for which the 7-bit hash
+// matches the given value. Unlike the generic implementation this never
+// returns false positives.
+func (g *ctrlGroup) matchH2(h uintptr) bitset {
+	return bitset(matchByte(uint64(*g), bitsetLSB*uint64(h)))
+}
+
+// matchEmpty returns the set of slots in the group that are empty.
+func (g *ctrlGroup) matchEmpty() bitset {
+	return bitset(matchByte(uint64(*g), bitsetLSB*uint64(ctrlEmpty)))
+}
+
+// matchEmptyOrDeleted returns the set of slots in the group that are empty or
+// deleted.
+func (g *ctrlGroup) matchEmptyOrDeleted() bitset {
+	return bitset(matchBytes2(uint64(*g),
+		bitsetLSB*uint64(ctrlEmpty), bitsetLSB*uint64(ctrlDeleted)))
+}
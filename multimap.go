@@ -0,0 +1,127 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+// MultiMap is a two-level map, the equivalent of a map[K1]map[K2]V, in which
+// both levels are Maps. The inner map for an outer key is created when the
+// first entry with that outer key is inserted, and removed (and closed) when
+// the last entry with that outer key is deleted, so empty inner maps are
+// never retained. The zero value of a MultiMap is ready to use.
+//
+// A MultiMap is NOT goroutine-safe.
+type MultiMap[K1, K2 comparable, V any] struct {
+	m    Map[K1, *Map[K2, V]]
+	used int
+}
+
+// NewMultiMap constructs a new MultiMap with the specified initial capacity
+// for the number of outer keys.
+func NewMultiMap[K1, K2 comparable, V any](initialCapacity int) *MultiMap[K1, K2, V] {
+	mm := &MultiMap[K1, K2, V]{}
+	mm.m.Init(initialCapacity)
+	return mm
+}
+
+// Get retrieves the value from the map for the specified keys, returning
+// ok=false if the keys are not present.
+func (mm *MultiMap[K1, K2, V]) Get(k1 K1, k2 K2) (value V, ok bool) {
+	inner, ok := mm.m.Get(k1)
+	if !ok {
+		return value, false
+	}
+	return inner.Get(k2)
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same keys already exists.
+func (mm *MultiMap[K1, K2, V]) Put(k1 K1, k2 K2, value V) {
+	inner, _ := mm.m.GetOrCompute(k1, func() *Map[K2, V] {
+		return New[K2, V](0)
+	})
+	n := inner.Len()
+	inner.Put(k2, value)
+	mm.used += inner.Len() - n
+}
+
+// Delete deletes the entry corresponding to the specified keys from the map,
+// removing the inner map for k1 if it becomes empty. It is a noop to delete a
+// non-existent entry.
+func (mm *MultiMap[K1, K2, V]) Delete(k1 K1, k2 K2) {
+	inner, ok := mm.m.Get(k1)
+	if !ok {
+		return
+	}
+	n := inner.Len()
+	inner.Delete(k2)
+	mm.used -= n - inner.Len()
+	if inner.Len() == 0 {
+		mm.m.Delete(k1)
+		inner.Close()
+	}
+}
+
+// DeleteAll deletes all of the entries with the outer key k1 from the map.
+func (mm *MultiMap[K1, K2, V]) DeleteAll(k1 K1) {
+	inner, ok := mm.m.Pop(k1)
+	if !ok {
+		return
+	}
+	mm.used -= inner.Len()
+	inner.Close()
+}
+
+// Len returns the number of entries in the map, across all outer keys.
+func (mm *MultiMap[K1, K2, V]) Len() int {
+	return mm.used
+}
+
+// OuterLen returns the number of distinct outer keys in the map.
+func (mm *MultiMap[K1, K2, V]) OuterLen() int {
+	return mm.m.Len()
+}
+
+// InnerLen returns the number of entries with the outer key k1.
+func (mm *MultiMap[K1, K2, V]) InnerLen(k1 K1) int {
+	inner, ok := mm.m.Get(k1)
+	if !ok {
+		return 0
+	}
+	return inner.Len()
+}
+
+// All calls yield sequentially for each entry present in the map. If yield
+// returns false, iteration stops. The map must not be mutated during
+// iteration.
+func (mm *MultiMap[K1, K2, V]) All(yield func(k1 K1, k2 K2, value V) bool) {
+	mm.m.All(func(k1 K1, inner *Map[K2, V]) bool {
+		cont := true
+		inner.All(func(k2 K2, value V) bool {
+			cont = yield(k1, k2, value)
+			return cont
+		})
+		return cont
+	})
+}
+
+// AllInner calls yield sequentially for each entry with the outer key k1. If
+// yield returns false, iteration stops. The map must not be mutated during
+// iteration.
+func (mm *MultiMap[K1, K2, V]) AllInner(k1 K1, yield func(k2 K2, value V) bool) {
+	inner, ok := mm.m.Get(k1)
+	if !ok {
+		return
+	}
+	inner.All(yield)
+}
@@ -0,0 +1,97 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMultiMap(t *testing.T) {
+	const outer = 10
+	const inner = 100
+
+	mm := NewMultiMap[int, int, int](0)
+	for i := 0; i < outer; i++ {
+		for j := 0; j < inner; j++ {
+			mm.Put(i, j, i*inner+j)
+		}
+	}
+	// Overwriting does not change the length.
+	mm.Put(0, 0, 0)
+	require.EqualValues(t, outer*inner, mm.Len())
+	require.EqualValues(t, outer, mm.OuterLen())
+	require.EqualValues(t, inner, mm.InnerLen(0))
+	require.EqualValues(t, 0, mm.InnerLen(outer))
+
+	for i := 0; i < outer; i++ {
+		for j := 0; j < inner; j++ {
+			v, ok := mm.Get(i, j)
+			require.True(t, ok)
+			require.EqualValues(t, i*inner+j, v)
+		}
+	}
+	_, ok := mm.Get(outer, 0)
+	require.False(t, ok)
+	_, ok = mm.Get(0, inner)
+	require.False(t, ok)
+
+	var n int
+	mm.All(func(i, j, v int) bool {
+		require.EqualValues(t, i*inner+j, v)
+		n++
+		return true
+	})
+	require.EqualValues(t, outer*inner, n)
+	n = 0
+	mm.All(func(i, j, v int) bool {
+		n++
+		return n < 5
+	})
+	require.EqualValues(t, 5, n)
+	n = 0
+	mm.AllInner(1, func(j, v int) bool {
+		require.EqualValues(t, inner+j, v)
+		n++
+		return true
+	})
+	require.EqualValues(t, inner, n)
+
+	// Deleting the last entry for an outer key removes its inner map.
+	for j := 0; j < inner; j++ {
+		mm.Delete(0, j)
+		mm.Delete(0, j)
+	}
+	mm.Delete(outer, 0)
+	require.EqualValues(t, (outer-1)*inner, mm.Len())
+	require.EqualValues(t, outer-1, mm.OuterLen())
+	_, ok = mm.m.Get(0)
+	require.False(t, ok)
+
+	mm.DeleteAll(1)
+	mm.DeleteAll(1)
+	require.EqualValues(t, (outer-2)*inner, mm.Len())
+	require.EqualValues(t, outer-2, mm.OuterLen())
+
+	// The zero value is ready to use.
+	var z MultiMap[string, string, int]
+	_, ok = z.Get("a", "b")
+	require.False(t, ok)
+	z.Put("a", "b", 1)
+	v, ok := z.Get("a", "b")
+	require.True(t, ok)
+	require.EqualValues(t, 1, v)
+}
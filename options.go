@@ -14,7 +14,11 @@
 
 package swiss
 
-import "unsafe"
+import (
+	"fmt"
+	"time"
+	"unsafe"
+)
 
 // option provide an interface to do work on Map while it is being created.
 type option[K comparable, V any] interface {
@@ -34,6 +38,41 @@ func WithHash[K comparable, V any](hash func(key *K, seed uintptr) uintptr) opti
 	return hashOption[K, V]{hash}
 }
 
+type seedOption[K comparable, V any] struct {
+	seed uintptr
+}
+
+func (op seedOption[K, V]) apply(m *Map[K, V]) {
+	m.seed = op.seed
+	m.fixedSeed = true
+}
+
+// WithSeed is an option to specify the seed passed to the hash function for a
+// Map[K,V] rather than a randomly chosen seed. Maps created with the same
+// seed, hash function, and sequence of operations place their entries
+// identically, which is useful for reproducible tests. Note that a fixed seed
+// makes it easier for an attacker to construct colliding keys. The seed is
+// retained when the map is cleared.
+func WithSeed[K comparable, V any](seed uintptr) option[K, V] {
+	return seedOption[K, V]{seed}
+}
+
+type valueHashOption[K comparable, V any] struct {
+	hash func(value *V, seed uintptr) uintptr
+}
+
+func (op valueHashOption[K, V]) apply(m *Map[K, V]) {
+	m.valueHash = op.hash
+}
+
+// WithValueHash is an option to specify the hash function for the values of
+// a Map[K,V], which is required by Map.Fingerprint. The hash must be
+// consistent with the notion of equality of the values: equal values must
+// have equal hashes.
+func WithValueHash[K comparable, V any](hash func(value *V, seed uintptr) uintptr) option[K, V] {
+	return valueHashOption[K, V]{hash}
+}
+
 type maxBucketCapacityOption[K comparable, V any] struct {
 	maxBucketCapacity uintptr
 }
@@ -54,15 +93,38 @@ func WithMaxBucketCapacity[K comparable, V any](v uintptr) option[K, V] {
 // GC to reclaim memory.
 //
 // If the allocator is manually managing memory and requires that slots and
-// controls be freed then Map.Close must be called in order to ensure
-// FreeSlots and FreeControls are called.
+// controls be freed then Map.Close must be called in order to ensure Free is
+// called.
+//
+// The memory returned by Alloc need not come from individual calls to make.
+// For example, a bump allocator may carve the ctrls and slots out of larger
+// preallocated arenas and release the arenas all at once after the Map is
+// closed. Such an allocator must observe the following requirements:
+//
+//   - The ctrls slice has no alignment requirement. The slots slice must be
+//     aligned for Slot[K,V], which is guaranteed if it is carved out of a
+//     larger []Slot[K,V].
+//   - If K or V contain pointers, the slots must be memory that is scanned by
+//     the GC with the type of Slot[K,V], such as a []Slot[K,V] allocated by
+//     make. Slots must not be carved out of a []byte or off-heap memory in
+//     that case, as the GC would not see the pointers stored in them.
+//   - The returned memory must be zeroed, as with make. Memory which is
+//     reused after being passed to Free must be cleared first.
+//   - Memory passed to Free is no longer read by the map, and may be reused
+//     immediately. A table freed while an iteration of the map (see Map.All)
+//     is in progress is passed to Free once the iteration has finished.
+//   - The map clears the slots it passes to Free, so freed memory does not
+//     keep the objects referenced by the keys and values of entries which
+//     were moved elsewhere by a resize or split alive, and reused memory
+//     does not expose their contents. The ctrls are not cleared.
 type Allocator[K comparable, V any] interface {
 	// Alloc should return slices equivalent to make([]uint8, ctrls) and
-	// make([]Slot[K,V], slots)
+	// make([]Slot[K,V], slots).
 	Alloc(ctrls, slots int) ([]uint8, []Slot[K, V])
 
 	// Free can optional release the memory associated with the supplied
-	// slices that is guaranteed to have been allocated by Alloc.
+	// slices that is guaranteed to have been allocated by Alloc. The slices
+	// have the same lengths as were requested from Alloc.
 	Free(ctrls []uint8, slots []Slot[K, V])
 }
 
@@ -128,3 +190,268 @@ func (smallAllocator[K, V]) Free(_ []uint8, _ []Slot[K, V]) {
 func WithSmallAllocator[K comparable, V any]() option[K, V] {
 	return allocatorOption[K, V]{smallAllocator[K, V]{}}
 }
+
+// cacheLineSize is the assumed size of a cache line, which is 64 bytes on
+// common amd64 and arm64 processors.
+const cacheLineSize = 64
+
+type paddedAllocator[K comparable, V any] struct{}
+
+func (paddedAllocator[K, V]) Alloc(ctrls, slots int) ([]uint8, []Slot[K, V]) {
+	return makePadded[uint8](ctrls), makePadded[Slot[K, V]](slots)
+}
+
+func (paddedAllocator[K, V]) Free(_ []uint8, _ []Slot[K, V]) {
+}
+
+// makePadded returns a slice of n elements which is preceded and followed in
+// its allocation by at least a cache line of unused memory, so that no other
+// allocation shares a cache line with the slice.
+func makePadded[T any](n int) []T {
+	var t T
+	pad := (cacheLineSize + int(unsafe.Sizeof(t)) - 1) / max(int(unsafe.Sizeof(t)), 1)
+	s := make([]T, n+2*pad)
+	return s[pad : pad+n : pad+n]
+}
+
+// WithTablePadding is an option that specifies usage of an allocator which
+// pads the allocations holding the control bytes and slots of every table
+// with a cache line of unused memory on either side, at the cost of at least
+// 256 bytes per table.
+// This avoids false sharing between the tables of different maps which are
+// written concurrently, such as the shards of a ShardedMap or maps owned by
+// different goroutines: without padding the small tables of such maps can
+// be allocated in adjacent memory and every insertion or deletion in one map
+// invalidates the cache line holding the other's control bytes. The entries
+// within a table are not padded individually as a Map is never written
+// concurrently with other accesses to it.
+func WithTablePadding[K comparable, V any]() option[K, V] {
+	return allocatorOption[K, V]{paddedAllocator[K, V]{}}
+}
+
+// Codec specifies how the keys and values of a Map are encoded by
+// Map.MarshalBinary and decoded by Map.UnmarshalBinary.
+type Codec[K comparable, V any] interface {
+	// AppendKey appends the encoding of key to buf and returns the extended
+	// buffer.
+	AppendKey(buf []byte, key K) ([]byte, error)
+	// AppendValue appends the encoding of value to buf and returns the
+	// extended buffer.
+	AppendValue(buf []byte, value V) ([]byte, error)
+	// DecodeKey decodes a key from the encoding produced by AppendKey. The
+	// data must not be retained after DecodeKey returns.
+	DecodeKey(data []byte) (K, error)
+	// DecodeValue decodes a value from the encoding produced by AppendValue.
+	// The data must not be retained after DecodeValue returns.
+	DecodeValue(data []byte) (V, error)
+}
+
+type codecOption[K comparable, V any] struct {
+	codec Codec[K, V]
+}
+
+func (op codecOption[K, V]) apply(m *Map[K, V]) {
+	m.codec = op.codec
+}
+
+// WithCodec is an option for specifying the Codec to use for the binary
+// encoding of a Map[K,V].
+func WithCodec[K comparable, V any](codec Codec[K, V]) option[K, V] {
+	return codecOption[K, V]{codec}
+}
+
+type shardsOption[K comparable, V any] struct {
+	shards int
+}
+
+// apply is only reached when the option is passed to a constructor other than
+// NewShardedMap, which consumes the option itself.
+func (op shardsOption[K, V]) apply(m *Map[K, V]) {
+	panic("swiss: WithShards: only supported by NewShardedMap")
+}
+
+// WithShards is an option for specifying the number of shards to use for a
+// ShardedMap[K,V]. The number of shards is rounded up to a power of 2. The
+// option panics if passed to a constructor other than NewShardedMap, such as
+// New.
+func WithShards[K comparable, V any](n int) option[K, V] {
+	return shardsOption[K, V]{n}
+}
+
+type ttlOption[K comparable, V any] struct {
+	ttl time.Duration
+}
+
+// apply is only reached when the option is passed to a constructor other than
+// NewExpiringMap, which consumes the option itself.
+func (op ttlOption[K, V]) apply(m *Map[K, V]) {
+	panic("swiss: WithTTL: only supported by NewExpiringMap")
+}
+
+// WithTTL is an option for specifying the default time-to-live of the entries
+// of an ExpiringMap[K,V]: entries inserted by Put expire d after they were
+// inserted. A TTL of zero, the default, means entries never expire. WithTTL
+// panics if d is negative, and the option panics if passed to a constructor
+// other than NewExpiringMap, such as New.
+func WithTTL[K comparable, V any](d time.Duration) option[K, V] {
+	if d < 0 {
+		panic(fmt.Sprintf("swiss: WithTTL: invalid TTL %s", d))
+	}
+	return ttlOption[K, V]{d}
+}
+
+type autoReseedOption[K comparable, V any] struct {
+	threshold int
+}
+
+func (op autoReseedOption[K, V]) apply(m *Map[K, V]) {
+	if op.threshold > 0 {
+		m.autoReseed = uintptr(op.threshold)
+	}
+}
+
+// WithAutoReseed is an option to automatically reseed a Map[K,V] (see
+// Map.Reseed) when Put inserts an entry whose probe sequence examined more
+// than threshold groups. Long probe sequences are indicative of a hash
+// flooding attack. After the map is automatically reseeded it will not be
+// automatically reseeded again until its size has doubled, bounding the cost
+// of reseeding if the collisions are not caused by the seed.
+func WithAutoReseed[K comparable, V any](threshold int) option[K, V] {
+	return autoReseedOption[K, V]{threshold}
+}
+
+type incrementalResizeOption[K comparable, V any] struct{}
+
+func (op incrementalResizeOption[K, V]) apply(m *Map[K, V]) {
+	m.incrementalResize = true
+}
+
+// WithIncrementalResize is an option to resize the buckets of a Map[K,V]
+// incrementally. Rather than migrating all of a bucket's entries to its new,
+// larger table in a single pass, both tables are kept live and the entries are
+// migrated in bounded chunks by subsequent insertions and deletions. This
+// bounds the pause caused by an individual operation on maps which use a large
+// maximum bucket capacity (see WithMaxBucketCapacity), at the cost of lookups
+// which miss in the new table also searching the old table while the
+// migration is in progress. Lookups and iteration via All never migrate
+// entries and thus never mutate the map.
+func WithIncrementalResize[K comparable, V any]() option[K, V] {
+	return incrementalResizeOption[K, V]{}
+}
+
+type maxLoadFactorOption[K comparable, V any] struct {
+	maxLoad uintptr
+}
+
+func (op maxLoadFactorOption[K, V]) apply(m *Map[K, V]) {
+	m.maxLoad = op.maxLoad
+}
+
+// WithMaxLoadFactor is an option to specify the maximum load factor of the
+// buckets of a Map[K,V]: the fraction of a bucket's slots which may be filled
+// (by entries or deletion tombstones) before the bucket is rehashed, resized,
+// or split. The default is 7/8. A higher load factor packs entries more
+// densely, saving memory at the cost of longer probe sequences, while a lower
+// load factor trades memory for shorter probe sequences. WithMaxLoadFactor
+// panics if f is not in the range [0.25, 0.9375].
+func WithMaxLoadFactor[K comparable, V any](f float64) option[K, V] {
+	if !(f >= minMaxLoadFactor && f <= maxMaxLoadFactor) {
+		panic(fmt.Sprintf("swiss: WithMaxLoadFactor: %g not in range [%g, %g]",
+			f, minMaxLoadFactor, maxMaxLoadFactor))
+	}
+	return maxLoadFactorOption[K, V]{uintptr(f * (1 << loadFactorShift))}
+}
+
+type autoCompactOption[K comparable, V any] struct {
+	threshold uintptr
+}
+
+func (op autoCompactOption[K, V]) apply(m *Map[K, V]) {
+	m.autoCompact = op.threshold
+}
+
+// WithAutoCompact is an option to specify the fraction of a bucket's slots
+// which must be occupied by deletion tombstones for a full bucket to be
+// compacted, dropping the tombstones by rehashing the bucket in place, rather
+// than being resized or split. By default a full bucket is compacted if at
+// least 1/3 of its capacity (scaled by the maximum load factor) is
+// reclaimable. A lower threshold prevents tombstone-driven growth in
+// workloads which churn through insertions and deletions while the number of
+// live entries is stable, at the cost of compacting more often. Compaction
+// only occurs when an insertion finds the bucket full, never during a
+// deletion. WithAutoCompact panics if threshold is not in the range
+// [0.0625, 1].
+func WithAutoCompact[K comparable, V any](threshold float64) option[K, V] {
+	if !(threshold >= minAutoCompact && threshold <= 1) {
+		panic(fmt.Sprintf("swiss: WithAutoCompact: %g not in range [%g, 1]",
+			threshold, minAutoCompact))
+	}
+	return autoCompactOption[K, V]{uintptr(threshold * (1 << loadFactorShift))}
+}
+
+type deterministicIterationOption[K comparable, V any] struct{}
+
+func (op deterministicIterationOption[K, V]) apply(m *Map[K, V]) {
+	m.deterministicIteration = true
+}
+
+// WithDeterministicIteration is an option to make iteration of a Map[K,V]
+// via All (and AllKeys, AllValues, etc) visit the entries in a fixed order
+// for a given state of the map: in the order of the bucket directory, and
+// within a bucket in the order of the slots. By default the iteration order
+// is randomized in order to expose code which depends on the order. Note
+// that the placement of entries, and thus the iteration order, depends on
+// the hash seed, so maps which should iterate in the same order should also
+// specify the same seed via WithSeed.
+func WithDeterministicIteration[K comparable, V any]() option[K, V] {
+	return deterministicIterationOption[K, V]{}
+}
+
+type stableRandomIterationOption[K comparable, V any] struct{}
+
+func (op stableRandomIterationOption[K, V]) apply(m *Map[K, V]) {
+	m.stableIteration = true
+	m.iterationSeed = uintptr(fastrand64())
+}
+
+// WithStableRandomIteration is an option to make iteration of a Map[K,V] via
+// All (and AllKeys, AllValues, etc) randomized once, when the map is
+// constructed, rather than on every call. Repeated iteration of the map
+// visits the entries in the same order for a given state of the map, while
+// separately constructed maps iterate in different orders. Unlike
+// WithDeterministicIteration, which takes precedence if both are specified,
+// the order cannot be reproduced by another map.
+func WithStableRandomIteration[K comparable, V any]() option[K, V] {
+	return stableRandomIterationOption[K, V]{}
+}
+
+type initialBucketsOption[K comparable, V any] struct {
+	n uintptr
+}
+
+func (op initialBucketsOption[K, V]) apply(m *Map[K, V]) {
+	m.initialBuckets = op.n
+}
+
+// WithInitialBuckets is an option to create a Map[K,V] already split into n
+// buckets, rather than starting with a single bucket which is split as the
+// map grows (see WithMaxBucketCapacity). The initial capacity of the map is
+// divided evenly between the buckets. WithInitialBuckets panics if n is not a
+// power of two.
+//
+// A key is routed to a bucket by the high bits of its hash (see Map.Hash):
+// with n = 2^d buckets, the key belongs to bucket Hash(key) >> (64 - d) on a
+// 64-bit platform, as returned by Map.BucketIndex. A loader can use this to
+// partition its input by bucket and insert the partitions in parallel using
+// Map.LoadBuckets. The map is otherwise not safe for concurrent mutation,
+// even of distinct buckets, as Put updates state shared by all of the
+// buckets.
+//
+// The split layout is retained by Clear, Grow, Shrink and Reseed, while
+// ClearAndShrink and Reset return the map to a single bucket.
+func WithInitialBuckets[K comparable, V any](n int) option[K, V] {
+	if n <= 0 || n&(n-1) != 0 {
+		panic(fmt.Sprintf("swiss: WithInitialBuckets: %d is not a power of two", n))
+	}
+	return initialBucketsOption[K, V]{uintptr(n)}
+}
@@ -0,0 +1,169 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"cmp"
+	"slices"
+)
+
+// OrderedMap is a Map with ordered keys which additionally supports range
+// queries and finding the minimum and maximum keys. Point operations (Get,
+// Put, and Delete) are those of the underlying Map. Ordered operations
+// (Range, Min, and Max) are served from a sorted index of the keys which is
+// built lazily and discarded whenever a key is inserted or deleted, so an
+// ordered operation following such a mutation costs O(n log n) to rebuild
+// the index, while subsequent ordered operations cost O(log n) plus the
+// number of entries visited. OrderedMap is therefore suited to workloads
+// dominated by point operations with occasional ordered scans. Overwriting
+// the value of an existing key does not discard the index.
+//
+// NaN keys cannot be retrieved from the map, and are not visited by the
+// ordered operations.
+//
+// An OrderedMap is NOT goroutine-safe.
+type OrderedMap[K cmp.Ordered, V any] struct {
+	m Map[K, V]
+	// keys is the sorted index of the keys in m. It is valid only if dirty
+	// is false.
+	keys  []K
+	dirty bool
+}
+
+// NewOrderedMap constructs a new OrderedMap with the specified initial
+// capacity and options. See New for details.
+func NewOrderedMap[K cmp.Ordered, V any](
+	initialCapacity int, options ...option[K, V],
+) *OrderedMap[K, V] {
+	o := &OrderedMap[K, V]{}
+	o.Init(initialCapacity, options...)
+	return o
+}
+
+// Init initializes an OrderedMap with the specified initial capacity and
+// options. See Map.Init for details.
+func (o *OrderedMap[K, V]) Init(initialCapacity int, options ...option[K, V]) {
+	o.m.Init(initialCapacity, options...)
+	o.keys = nil
+	o.dirty = false
+}
+
+// Close closes the map, releasing any memory back to its configured
+// allocator. See Map.Close.
+func (o *OrderedMap[K, V]) Close() {
+	o.m.Close()
+	o.keys = nil
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present.
+func (o *OrderedMap[K, V]) Get(key K) (value V, ok bool) {
+	return o.m.Get(key)
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists.
+func (o *OrderedMap[K, V]) Put(key K, value V) {
+	if o.m.PutReturningInserted(key, value) {
+		o.dirty = true
+	}
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (o *OrderedMap[K, V]) Delete(key K) {
+	if _, ok := o.m.Pop(key); ok {
+		o.dirty = true
+	}
+}
+
+// Len returns the number of entries in the map.
+func (o *OrderedMap[K, V]) Len() int {
+	return o.m.Len()
+}
+
+// Clear removes all entries from the map.
+func (o *OrderedMap[K, V]) Clear() {
+	o.m.Clear()
+	o.keys = nil
+	o.dirty = false
+}
+
+// All calls yield sequentially for each key and value present in the map, in
+// no particular order. See Map.All for details.
+func (o *OrderedMap[K, V]) All(yield func(key K, value V) bool) {
+	o.m.All(yield)
+}
+
+// Range calls fn sequentially in ascending key order for each key and value
+// present in the map with lo <= key < hi. If fn returns false, iteration
+// stops. The map may be mutated by fn: entries deleted during iteration are
+// not visited, and entries inserted during iteration are not visited.
+func (o *OrderedMap[K, V]) Range(lo, hi K, fn func(key K, value V) bool) {
+	keys := o.index()
+	i, _ := slices.BinarySearch(keys, lo)
+	for _, key := range keys[i:] {
+		if !cmp.Less(key, hi) {
+			return
+		}
+		if value, ok := o.m.Get(key); ok && !fn(key, value) {
+			return
+		}
+	}
+}
+
+// Min returns the entry with the smallest key, or ok=false if the map is
+// empty.
+func (o *OrderedMap[K, V]) Min() (key K, value V, ok bool) {
+	keys := o.index()
+	if len(keys) == 0 {
+		return key, value, false
+	}
+	value, _ = o.m.Get(keys[0])
+	return keys[0], value, true
+}
+
+// Max returns the entry with the largest key, or ok=false if the map is
+// empty.
+func (o *OrderedMap[K, V]) Max() (key K, value V, ok bool) {
+	keys := o.index()
+	if len(keys) == 0 {
+		return key, value, false
+	}
+	value, _ = o.m.Get(keys[len(keys)-1])
+	return keys[len(keys)-1], value, true
+}
+
+// index returns the sorted index of the keys, rebuilding it if it has been
+// discarded by a mutation. NaN keys are omitted. A new slice is allocated on
+// each rebuild so that a Range which mutates the map can continue to use the
+// index it started with.
+func (o *OrderedMap[K, V]) index() []K {
+	if !o.dirty {
+		return o.keys
+	}
+	keys := make([]K, 0, o.m.Len())
+	o.m.AllKeys(func(key K) bool {
+		// NaN is the only value not equal to itself.
+		if key == key {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	slices.Sort(keys)
+	o.keys = keys
+	o.dirty = false
+	return keys
+}
@@ -0,0 +1,107 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderedMap(t *testing.T) {
+	o := NewOrderedMap[int, int](0)
+	_, _, ok := o.Min()
+	require.False(t, ok)
+	_, _, ok = o.Max()
+	require.False(t, ok)
+
+	const count = 1000
+	for _, i := range rand.Perm(count) {
+		o.Put(i*2, i)
+	}
+	require.EqualValues(t, count, o.Len())
+
+	collect := func(lo, hi int) []int {
+		var keys []int
+		o.Range(lo, hi, func(k, v int) bool {
+			require.EqualValues(t, k/2, v)
+			keys = append(keys, k)
+			return true
+		})
+		return keys
+	}
+	require.Equal(t, []int{10, 12, 14}, collect(10, 16))
+	require.Equal(t, []int{12, 14, 16}, collect(11, 17))
+	require.Len(t, collect(math.MinInt, math.MaxInt), count)
+	require.Empty(t, collect(5, 5))
+	require.Empty(t, collect(2*count, math.MaxInt))
+
+	// Overwriting values keeps the index, while insertions and deletions are
+	// reflected in subsequent ordered operations.
+	o.Put(10, -1)
+	o.Put(11, -2)
+	o.Delete(12)
+	o.Delete(13)
+	var vals []int
+	o.Range(10, 14, func(k, v int) bool {
+		vals = append(vals, v)
+		return true
+	})
+	require.Equal(t, []int{-1, -2}, vals)
+
+	k, v, ok := o.Min()
+	require.True(t, ok)
+	require.Equal(t, []int{0, 0}, []int{k, v})
+	o.Put(-1, 7)
+	k, v, ok = o.Max()
+	require.True(t, ok)
+	require.Equal(t, []int{2 * (count - 1), count - 1}, []int{k, v})
+	k, v, _ = o.Min()
+	require.Equal(t, []int{-1, 7}, []int{k, v})
+
+	// Range stops when fn returns false, and entries deleted during the range
+	// are not visited.
+	var keys []int
+	o.Range(0, 20, func(k, v int) bool {
+		keys = append(keys, k)
+		o.Delete(k + 2)
+		return len(keys) < 3
+	})
+	require.Equal(t, []int{0, 4, 8}, keys)
+
+	o.Clear()
+	require.Empty(t, collect(math.MinInt, math.MaxInt))
+	_, _, ok = o.Min()
+	require.False(t, ok)
+}
+
+func TestOrderedMapNaN(t *testing.T) {
+	o := NewOrderedMap[float64, int](0)
+	o.Put(math.NaN(), 1)
+	o.Put(1, 2)
+	o.Put(math.Inf(-1), 3)
+	require.EqualValues(t, 3, o.Len())
+
+	k, _, _ := o.Min()
+	require.Equal(t, math.Inf(-1), k)
+	var n int
+	o.Range(math.Inf(-1), math.Inf(1), func(k float64, v int) bool {
+		n++
+		return true
+	})
+	require.Equal(t, 2, n)
+}
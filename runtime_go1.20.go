@@ -17,10 +17,10 @@
 // bumping of the go versions supported by adjusting the build tags below. The
 // way go version tags work the tag for goX.Y will be declared for every
 // subsequent release. So go1.20 will be defined for go1.21, go1.22, etc. The
-// build tag "go1.20 && !go1.23" defines the range [go1.20, go1.23) (inclusive
-// on go1.20, exclusive on go1.23).
+// build tag "go1.20 && !go1.24" defines the range [go1.20, go1.24) (inclusive
+// on go1.20, exclusive on go1.24).
 
-//go:build go1.20 && !go1.23
+//go:build go1.20 && !go1.24
 
 package swiss
 
@@ -43,6 +43,12 @@ type hashFn func(key unsafe.Pointer, seed uintptr) uintptr
 // for integer types. This hackiness is quite localized. If it breaks in a
 // future Go version we can either repair it or go the reflection route.
 //
+// For string keys the extracted function is runtime.strhash which uses AES
+// hardware acceleration where available. Calling runtime.strhash directly
+// would only save the hashFn indirection at the cost of another dependency on
+// runtime internals, and a pure Go string hash cannot use the AES
+// instructions, so string keys use the same path as every other key type.
+//
 // https://github.com/dolthub/maphash provided the inspiration and general
 // implementation technique.
 func getRuntimeHasher[K comparable]() hashFn {
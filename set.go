@@ -0,0 +1,165 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+// Set is an unordered set of keys with Add, Remove, Contains, and All
+// operations. A Set is implemented as a Map with zero-sized values and shares
+// its design and options. Because of the layout of Slot, the values occupy no
+// memory.
+//
+// A Set is NOT goroutine-safe.
+type Set[K comparable] struct {
+	m Map[K, struct{}]
+}
+
+// NewSet constructs a new Set with the specified initial capacity and
+// options. See New for details.
+func NewSet[K comparable](initialCapacity int, options ...option[K, struct{}]) *Set[K] {
+	s := &Set[K]{}
+	s.Init(initialCapacity, options...)
+	return s
+}
+
+// Init initializes a Set with the specified initial capacity and options. See
+// Map.Init for details.
+func (s *Set[K]) Init(initialCapacity int, options ...option[K, struct{}]) {
+	s.m.Init(initialCapacity, options...)
+}
+
+// Close closes the set, releasing any memory back to its configured
+// allocator. See Map.Close.
+func (s *Set[K]) Close() {
+	s.m.Close()
+}
+
+// Add inserts the key into the set. It is a noop to add a key which is
+// already present.
+func (s *Set[K]) Add(key K) {
+	s.m.Put(key, struct{}{})
+}
+
+// Remove removes the key from the set. It is a noop to remove a key which is
+// not present.
+func (s *Set[K]) Remove(key K) {
+	s.m.Delete(key)
+}
+
+// Contains returns true if the key is present in the set.
+func (s *Set[K]) Contains(key K) bool {
+	return s.m.Contains(key)
+}
+
+// Len returns the number of keys in the set.
+func (s *Set[K]) Len() int {
+	return s.m.Len()
+}
+
+// Clear removes all keys from the set.
+func (s *Set[K]) Clear() {
+	s.m.Clear()
+}
+
+// All calls yield sequentially for each key present in the set. If yield
+// returns false, iteration stops. See Map.All for the semantics of mutating
+// the set during iteration.
+//
+// The signature of All conforms to iter.Seq[K] which allows iterating over the
+// set using range-over-func (Go 1.23+).
+func (s *Set[K]) All(yield func(key K) bool) {
+	s.m.AllKeys(yield)
+}
+
+// Union returns a new set containing the keys present in either s or other.
+// The new set has the same options as s.
+func (s *Set[K]) Union(other *Set[K]) *Set[K] {
+	r := &Set[K]{}
+	s.m.cloneInto(&r.m)
+	r.UnionInPlace(other)
+	return r
+}
+
+// Intersect returns a new set containing the keys present in both s and
+// other. The new set has the same options as s. Intersect iterates over the
+// smaller of the two sets, probing the larger.
+func (s *Set[K]) Intersect(other *Set[K]) *Set[K] {
+	small, large := s, other
+	if large.Len() < small.Len() {
+		small, large = large, small
+	}
+	r := &Set[K]{}
+	r.m.initLike(&s.m, small.Len())
+	small.All(func(key K) bool {
+		if large.Contains(key) {
+			r.Add(key)
+		}
+		return true
+	})
+	return r
+}
+
+// Difference returns a new set containing the keys present in s but not in
+// other. The new set has the same options as s.
+func (s *Set[K]) Difference(other *Set[K]) *Set[K] {
+	r := &Set[K]{}
+	r.m.initLike(&s.m, s.Len())
+	s.All(func(key K) bool {
+		if !other.Contains(key) {
+			r.Add(key)
+		}
+		return true
+	})
+	return r
+}
+
+// UnionInPlace adds the keys present in other to s.
+func (s *Set[K]) UnionInPlace(other *Set[K]) {
+	if other == s {
+		return
+	}
+	s.m.Grow(other.Len())
+	other.All(func(key K) bool {
+		s.Add(key)
+		return true
+	})
+}
+
+// IntersectInPlace removes the keys from s which are not present in other.
+func (s *Set[K]) IntersectInPlace(other *Set[K]) {
+	if other == s {
+		return
+	}
+	s.m.DeleteFunc(func(key K, _ struct{}) bool {
+		return !other.Contains(key)
+	})
+}
+
+// DifferenceInPlace removes the keys present in other from s. Whichever of
+// the two sets is smaller is iterated over.
+func (s *Set[K]) DifferenceInPlace(other *Set[K]) {
+	if other == s {
+		s.Clear()
+		return
+	}
+	if other.Len() < s.Len() {
+		other.All(func(key K) bool {
+			s.Remove(key)
+			return true
+		})
+		return
+	}
+	s.m.DeleteFunc(func(key K, _ struct{}) bool {
+		return other.Contains(key)
+	})
+}
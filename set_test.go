@@ -0,0 +1,249 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+// toBuiltinMap returns the keys as a map[K]struct{}. Useful for testing.
+func (s *Set[K]) toBuiltinMap() map[K]struct{} {
+	r := make(map[K]struct{})
+	s.All(func(k K) bool {
+		r[k] = struct{}{}
+		return true
+	})
+	return r
+}
+
+func TestSetSlotSize(t *testing.T) {
+	// The zero-sized values of a Set occupy no space in its slots.
+	require.EqualValues(t, unsafe.Sizeof(int(0)), unsafe.Sizeof(Slot[int, struct{}]{}))
+	require.EqualValues(t, unsafe.Sizeof(""), unsafe.Sizeof(Slot[string, struct{}]{}))
+}
+
+func TestSetBasic(t *testing.T) {
+	test := func(t *testing.T, s *Set[int]) {
+		const count = 100
+
+		e := make(map[int]struct{})
+		require.EqualValues(t, 0, s.Len())
+
+		// Non-existent.
+		for i := 0; i < count; i++ {
+			require.False(t, s.Contains(i))
+		}
+
+		// Add.
+		for i := 0; i < count; i++ {
+			s.Add(i)
+			e[i] = struct{}{}
+			require.True(t, s.Contains(i))
+			require.EqualValues(t, i+1, s.Len())
+			require.Equal(t, e, s.toBuiltinMap())
+		}
+
+		// Re-add.
+		for i := 0; i < count; i++ {
+			s.Add(i)
+			require.True(t, s.Contains(i))
+			require.EqualValues(t, count, s.Len())
+		}
+		require.Equal(t, e, s.toBuiltinMap())
+
+		// Remove.
+		for i := 0; i < count; i++ {
+			s.Remove(i)
+			delete(e, i)
+			require.EqualValues(t, count-i-1, s.Len())
+			require.False(t, s.Contains(i))
+			require.Equal(t, e, s.toBuiltinMap())
+		}
+
+		// Clear.
+		for i := 0; i < count; i++ {
+			s.Add(i)
+		}
+		s.Clear()
+		require.EqualValues(t, 0, s.Len())
+		require.Empty(t, s.toBuiltinMap())
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		test(t, NewSet[int](0))
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		testDegenerate := func(t *testing.T, h uintptr) {
+			s := NewSet[int](0,
+				WithHash[int, struct{}](func(key *int, seed uintptr) uintptr {
+					return h
+				}),
+				WithMaxBucketCapacity[int, struct{}](7))
+			test(t, s)
+		}
+
+		for _, v := range []uintptr{0, ^uintptr(0)} {
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+		for i := 0; i < 10; i++ {
+			v := uintptr(rand.Uint64())
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+	})
+}
+
+func TestSetRandom(t *testing.T) {
+	test := func(t *testing.T, s *Set[int]) {
+		e := make(map[int]struct{})
+		for i := 0; i < 10000; i++ {
+			switch r := rand.Float64(); {
+			case r < 0.5: // 50% adds
+				k := rand.Int()
+				s.Add(k)
+				e[k] = struct{}{}
+			case r < 0.75: // 25% removes
+				if k, _, ok := s.m.randElement(); !ok {
+					require.EqualValues(t, 0, s.Len(), e)
+				} else {
+					s.Remove(k)
+					delete(e, k)
+				}
+			case r < 0.95: // 20% lookups
+				if k, _, ok := s.m.randElement(); !ok {
+					require.EqualValues(t, 0, s.Len(), e)
+				} else {
+					_, ok := e[k]
+					require.True(t, ok)
+					require.True(t, s.Contains(k))
+				}
+			default: // 5% rehash in place and iterate
+				s.m.bucket0.rehashInPlace(&s.m)
+				require.Equal(t, e, s.toBuiltinMap())
+			}
+			require.EqualValues(t, len(e), s.Len())
+		}
+	}
+
+	t.Run("normal", func(t *testing.T) {
+		test(t, NewSet[int](0))
+	})
+
+	t.Run("degenerate", func(t *testing.T) {
+		testDegenerate := func(t *testing.T, h uintptr) {
+			s := NewSet[int](0,
+				WithHash[int, struct{}](func(key *int, seed uintptr) uintptr {
+					return h
+				}),
+				WithMaxBucketCapacity[int, struct{}](512))
+			test(t, s)
+		}
+
+		for _, v := range []uintptr{0, ^uintptr(0)} {
+			t.Run(fmt.Sprintf("%016x", v), func(t *testing.T) {
+				testDegenerate(t, v)
+			})
+		}
+	})
+}
+
+func TestSetAlgebra(t *testing.T) {
+	makeSet := func(start, end int) *Set[int] {
+		s := NewSet[int](0)
+		for i := start; i < end; i++ {
+			s.Add(i)
+		}
+		return s
+	}
+	makeExpected := func(a, b *Set[int], keep func(inA, inB bool) bool) map[int]struct{} {
+		e := make(map[int]struct{})
+		for _, s := range []*Set[int]{a, b} {
+			s.All(func(k int) bool {
+				if keep(a.Contains(k), b.Contains(k)) {
+					e[k] = struct{}{}
+				}
+				return true
+			})
+		}
+		return e
+	}
+	union := func(inA, inB bool) bool { return inA || inB }
+	intersect := func(inA, inB bool) bool { return inA && inB }
+	difference := func(inA, inB bool) bool { return inA && !inB }
+
+	testCases := []struct {
+		name string
+		a, b func() *Set[int]
+	}{
+		{"disjoint", func() *Set[int] { return makeSet(0, 100) }, func() *Set[int] { return makeSet(100, 300) }},
+		{"identical", func() *Set[int] { return makeSet(0, 100) }, func() *Set[int] { return makeSet(0, 100) }},
+		{"subset", func() *Set[int] { return makeSet(10, 20) }, func() *Set[int] { return makeSet(0, 100) }},
+		{"superset", func() *Set[int] { return makeSet(0, 100) }, func() *Set[int] { return makeSet(10, 20) }},
+		{"overlapping", func() *Set[int] { return makeSet(0, 100) }, func() *Set[int] { return makeSet(50, 150) }},
+		{"empty", func() *Set[int] { return makeSet(0, 100) }, func() *Set[int] { return makeSet(0, 0) }},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			a, b := c.a(), c.b()
+			aKeys, bKeys := a.toBuiltinMap(), b.toBuiltinMap()
+
+			require.Equal(t, makeExpected(a, b, union), a.Union(b).toBuiltinMap())
+			require.Equal(t, makeExpected(a, b, intersect), a.Intersect(b).toBuiltinMap())
+			require.Equal(t, makeExpected(a, b, difference), a.Difference(b).toBuiltinMap())
+			// The operands are not modified.
+			require.Equal(t, aKeys, a.toBuiltinMap())
+			require.Equal(t, bKeys, b.toBuiltinMap())
+
+			for _, op := range []struct {
+				keep    func(inA, inB bool) bool
+				inPlace func(s, other *Set[int])
+			}{
+				{union, (*Set[int]).UnionInPlace},
+				{intersect, (*Set[int]).IntersectInPlace},
+				{difference, (*Set[int]).DifferenceInPlace},
+			} {
+				a := c.a()
+				e := makeExpected(a, b, op.keep)
+				op.inPlace(a, b)
+				require.Equal(t, e, a.toBuiltinMap())
+				require.EqualValues(t, len(e), a.Len())
+				require.Equal(t, bKeys, b.toBuiltinMap())
+			}
+		})
+	}
+
+	t.Run("self", func(t *testing.T) {
+		s := makeSet(0, 100)
+		e := s.toBuiltinMap()
+		require.Equal(t, e, s.Union(s).toBuiltinMap())
+		require.Equal(t, e, s.Intersect(s).toBuiltinMap())
+		require.Empty(t, s.Difference(s).toBuiltinMap())
+		s.UnionInPlace(s)
+		require.Equal(t, e, s.toBuiltinMap())
+		s.IntersectInPlace(s)
+		require.Equal(t, e, s.toBuiltinMap())
+		s.DifferenceInPlace(s)
+		require.EqualValues(t, 0, s.Len())
+	})
+}
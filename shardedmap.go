@@ -0,0 +1,172 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"math/bits"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ShardedMap is a Map which is safe for concurrent use by multiple goroutines
+// and which is partitioned into independently locked shards. A key is routed
+// to a shard by its hash, so concurrent operations on keys in different
+// shards do not contend with one another. A ShardedMap should be preferred
+// over a SyncMap when there are many concurrent writers.
+type ShardedMap[K comparable, V any] struct {
+	hash   hashFn
+	seed   uintptr
+	mask   uintptr
+	shards []shard[K, V]
+}
+
+// shard is a single partition of a ShardedMap.
+type shard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  Map[K, V]
+	// len mirrors m.Len() so that it can be read without holding mu. It is
+	// updated under mu after every mutation of m.
+	len atomic.Int64
+	// Pad the shard to avoid false sharing between the locks of adjacent
+	// shards.
+	_ [64]byte
+}
+
+// NewShardedMap constructs a new ShardedMap with the specified initial
+// capacity and options. The initial capacity is divided evenly between the
+// shards. The number of shards is specified by WithShards and defaults to
+// GOMAXPROCS rounded up to a power of 2. The remaining options are applied to
+// every shard. See New for details.
+func NewShardedMap[K comparable, V any](
+	initialCapacity int, options ...option[K, V],
+) *ShardedMap[K, V] {
+	n := runtime.GOMAXPROCS(0)
+	mapOptions := make([]option[K, V], 0, len(options))
+	for _, op := range options {
+		if s, ok := op.(shardsOption[K, V]); ok {
+			n = s.shards
+		} else {
+			mapOptions = append(mapOptions, op)
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	n = 1 << bits.Len(uint(n-1))
+
+	s := &ShardedMap[K, V]{
+		seed:   uintptr(fastrand64()),
+		mask:   uintptr(n - 1),
+		shards: make([]shard[K, V], n),
+	}
+	for i := range s.shards {
+		s.shards[i].m.Init((initialCapacity+n-1)/n, mapOptions...)
+	}
+	// Route keys using the same hash function as the shards (which may have
+	// been specified by WithHash), but with an independent seed so that the
+	// routing is uncorrelated with the hashing within a shard.
+	s.hash = s.shards[0].m.hash
+	return s
+}
+
+// shard returns the shard for the specified key.
+func (s *ShardedMap[K, V]) shard(key *K) *shard[K, V] {
+	h := s.hash(noescape(unsafe.Pointer(key)), s.seed)
+	return &s.shards[h&s.mask]
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present.
+func (s *ShardedMap[K, V]) Get(key K) (value V, ok bool) {
+	sh := s.shard(&key)
+	sh.mu.RLock()
+	value, ok = sh.m.Get(key)
+	sh.mu.RUnlock()
+	return value, ok
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists.
+func (s *ShardedMap[K, V]) Put(key K, value V) {
+	sh := s.shard(&key)
+	sh.mu.Lock()
+	sh.m.Put(key, value)
+	sh.len.Store(int64(sh.m.Len()))
+	sh.mu.Unlock()
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (s *ShardedMap[K, V]) Delete(key K) {
+	sh := s.shard(&key)
+	sh.mu.Lock()
+	sh.m.Delete(key)
+	sh.len.Store(int64(sh.m.Len()))
+	sh.mu.Unlock()
+}
+
+// Len returns the number of entries in the map. Each shard is locked in turn
+// while its length is read, so the result is not an atomic snapshot of the
+// map if it is being concurrently mutated.
+func (s *ShardedMap[K, V]) Len() int {
+	var n int
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		n += sh.m.Len()
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// ApproxLen returns the number of entries in the map without acquiring any
+// locks, making it suitable for frequent polling such as by a metrics
+// exporter. The length of each shard is read as of its most recently
+// completed mutation, so mutations which are in progress are not reflected,
+// and the sum is not an atomic snapshot of the map if it is being
+// concurrently mutated. Once the map is quiescent ApproxLen equals Len.
+func (s *ShardedMap[K, V]) ApproxLen() int {
+	var n int64
+	for i := range s.shards {
+		n += s.shards[i].len.Load()
+	}
+	return int(n)
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, range stops the iteration. The map is iterated shard
+// by shard. The entries of each shard are copied under the shard's read lock
+// and yield is called without the lock held, so yield may access the map.
+func (s *ShardedMap[K, V]) All(yield func(key K, value V) bool) {
+	var entries []Slot[K, V]
+	for i := range s.shards {
+		sh := &s.shards[i]
+		sh.mu.RLock()
+		entries = entries[:0]
+		sh.m.All(func(key K, value V) bool {
+			entries = append(entries, Slot[K, V]{key: key, value: value})
+			return true
+		})
+		sh.mu.RUnlock()
+
+		for j := range entries {
+			if !yield(entries[j].key, entries[j].value) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestShardedMapShards(t *testing.T) {
+	testCases := []struct {
+		shards   int
+		expected int
+	}{
+		{-1, 1},
+		{0, 1},
+		{1, 1},
+		{3, 4},
+		{8, 8},
+		{9, 16},
+	}
+	for _, c := range testCases {
+		s := NewShardedMap[int, int](0, WithShards[int, int](c.shards))
+		require.Len(t, s.shards, c.expected)
+	}
+
+	s := NewShardedMap[int, int](0)
+	require.GreaterOrEqual(t, len(s.shards), runtime.GOMAXPROCS(0))
+	require.Less(t, len(s.shards), 2*runtime.GOMAXPROCS(0))
+
+	// Every shard receives a share of the keys.
+	s = NewShardedMap[int, int](0, WithShards[int, int](4))
+	for i := 0; i < 1000; i++ {
+		s.Put(i, i)
+	}
+	for i := range s.shards {
+		require.Greater(t, s.shards[i].m.Len(), 0)
+	}
+
+	// WithShards is only supported by NewShardedMap.
+	require.Panics(t, func() { New[int, int](0, WithShards[int, int](8)) })
+}
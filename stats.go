@@ -0,0 +1,266 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Stats holds statistics about the internal state of a Map.
+type Stats struct {
+	// Len is the number of entries in the map.
+	Len int
+	// Capacity is the total number of slots across all buckets.
+	Capacity int
+	// BucketCount is the number of distinct buckets. Note that this may be
+	// smaller than the number of entries in the bucket directory.
+	BucketCount int
+	// Tombstones is the number of slots containing deletion tombstones.
+	// Tombstones consume capacity until the bucket containing them is
+	// rehashed.
+	Tombstones int
+	// GrowthLeft is the number of entries that can be inserted across all
+	// buckets before a bucket needs to be rehashed, resized, or split.
+	GrowthLeft int
+	// LoadFactor is Len/Capacity, or 0 if the map has no capacity.
+	LoadFactor float64
+	// Resizes is the number of times a bucket has been resized to a larger
+	// capacity over the lifetime of the map. A large number of resizes
+	// relative to the size of the map indicates the map would benefit from a
+	// larger initial capacity or a call to Grow.
+	Resizes int
+	// Splits is the number of times a bucket has been split in two over the
+	// lifetime of the map.
+	Splits int
+	// Allocs and Frees are the number of calls to the map's allocator to
+	// allocate and release the backing arrays of a bucket over the lifetime of
+	// the map.
+	Allocs int
+	Frees  int
+}
+
+// Stats returns statistics about the internal state of the map. Stats is
+// cheap to compute as it only requires visiting each bucket, not each slot.
+func (m *Map[K, V]) Stats() Stats {
+	s := Stats{
+		Len:     m.used,
+		Resizes: m.resizes,
+		Splits:  m.splits,
+		Allocs:  m.allocs,
+		Frees:   m.frees,
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		s.Capacity += int(b.capacity)
+		s.BucketCount++
+		s.GrowthLeft += b.growthLeft
+		// A bucket maintains the invariant:
+		//
+		//   growthLeft == maxGrowth(capacity) - used - tombstones
+		//
+		// which allows the number of tombstones to be computed without
+		// scanning the control bytes.
+		s.Tombstones += int(b.tombstones(m)) - b.growthLeft
+		if b.old != nil {
+			// Room is reserved for the entries yet to be migrated from the
+			// old table of an incremental resize.
+			s.GrowthLeft -= b.old.used
+		}
+		return true
+	})
+	if s.Capacity > 0 {
+		s.LoadFactor = float64(s.Len) / float64(s.Capacity)
+	}
+	return s
+}
+
+// BucketCount returns the number of distinct buckets in the map. A map starts
+// with a single bucket and a bucket is split in two when it would otherwise
+// grow beyond the max bucket capacity (see WithMaxBucketCapacity).
+func (m *Map[K, V]) BucketCount() int {
+	var n int
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// BucketStats holds statistics about a single bucket of a Map.
+type BucketStats struct {
+	// Capacity is the number of slots in the bucket.
+	Capacity int
+	// Len is the number of entries in the bucket.
+	Len int
+	// GrowthLeft is the number of entries that can be inserted into the
+	// bucket before it needs to be rehashed, resized, or split.
+	GrowthLeft int
+	// LocalDepth is the number of high bits of the hash of a key which
+	// determine whether the key belongs in the bucket. A bucket with a
+	// LocalDepth of d holds 1/2^d of the map's hash space.
+	LocalDepth int
+}
+
+// BucketStats returns statistics about each of the map's buckets, in the
+// order of the bucket directory (i.e. in the order of the hash space the
+// buckets cover). Like Stats, BucketStats only requires visiting each bucket,
+// not each slot.
+func (m *Map[K, V]) BucketStats() []BucketStats {
+	var s []BucketStats
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		bs := BucketStats{
+			Capacity:   int(b.capacity),
+			Len:        b.used,
+			GrowthLeft: b.growthLeft,
+			LocalDepth: int(b.localDepth),
+		}
+		if b.old != nil {
+			// Count the entries yet to be migrated from the old table of an
+			// incremental resize, for which room is reserved in the bucket.
+			bs.Len += b.old.used
+			bs.GrowthLeft -= b.old.used
+		}
+		s = append(s, bs)
+		return true
+	})
+	return s
+}
+
+// ProbeStats holds statistics about the length of the probe sequences needed
+// to find the entries in a Map. The probe length of an entry is the number of
+// groups examined in order to find the entry. Long probe sequences indicate
+// that the hash function is distributing keys poorly, such as when under a
+// hash flooding attack.
+type ProbeStats struct {
+	// Mean is the mean probe length across all entries, or 0 if the map is
+	// empty.
+	Mean float64
+	// Max is the maximum probe length across all entries.
+	Max int
+	// Histogram[i] is the number of entries with a probe length of i+1. The
+	// last element counts all entries with a probe length of len(Histogram) or
+	// longer.
+	Histogram [8]int
+}
+
+// ProbeStats returns statistics about the probe lengths of the entries in the
+// map. ProbeStats re-probes for every entry in the map and is intended for
+// diagnostics, not for use on a hot path.
+func (m *Map[K, V]) ProbeStats() ProbeStats {
+	var s ProbeStats
+	var total int
+	probe := func(b *bucket[K, V]) {
+		for i := b.migrated; i < b.capacity; i++ {
+			if (b.ctrls.Get(i) & ctrlEmpty) == ctrlEmpty {
+				continue
+			}
+			n := b.probeLength(m, i)
+			total += n
+			s.Max = max(s.Max, n)
+			s.Histogram[min(n, len(s.Histogram))-1]++
+		}
+	}
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		probe(b)
+		if b.old != nil {
+			probe(b.old)
+		}
+		return true
+	})
+	if m.used > 0 {
+		s.Mean = float64(total) / float64(m.used)
+	}
+	return s
+}
+
+// probeLength returns the number of groups examined by the probe sequence for
+// the key in slot i before finding the slot.
+func (b *bucket[K, V]) probeLength(m *Map[K, V], i uintptr) int {
+	slot := b.slots.At(i)
+	h := m.hash(noescape(unsafe.Pointer(&slot.key)), m.seed)
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for n := 1; n <= int(b.capacity/groupSize)+1; n, seq = n+1, seq.next() {
+		match := b.ctrls.GroupAt(seq.offset).matchH2(h2(h))
+		for match != 0 {
+			slotIdx := match.first()
+			if seq.offsetAt(slotIdx) == i {
+				return n
+			}
+			match = match.remove(slotIdx)
+		}
+	}
+	panic(fmt.Sprintf("invariant failed: slot(%d): %v not found\n%#v", i, slot.key, b))
+}
+
+// DebugProbe returns the offsets of the groups examined, in order, by the
+// probe sequence when looking up key: the probe ends at the group containing
+// key or, if key is not present, at the first group containing an empty slot.
+// The length of the result is the probe length of key (see ProbeStats). If
+// the bucket containing key is being incrementally resized only the probe of
+// its new table is returned. DebugProbe is intended for diagnosing keys with
+// long probe sequences, not for use on a hot path.
+func (m *Map[K, V]) DebugProbe(key K) []uintptr {
+	if m.hash == nil {
+		return nil
+	}
+	h := m.hash(noescape(unsafe.Pointer(&key)), m.seed)
+	b := m.bucket(h)
+	var offsets []uintptr
+	seq := makeProbeSeq(h1(h), b.capacity)
+	for ; ; seq = seq.next() {
+		offsets = append(offsets, seq.offset)
+		g := b.ctrls.GroupAt(seq.offset)
+		match := g.matchH2(h2(h))
+		for match != 0 {
+			slotIdx := match.first()
+			if key == b.slots.At(seq.offsetAt(slotIdx)).key {
+				return offsets
+			}
+			match = match.remove(slotIdx)
+		}
+		if g.matchEmpty() != 0 {
+			return offsets
+		}
+	}
+}
+
+// MemoryUsage returns the approximate number of bytes of memory held by the
+// map, including unused capacity. This includes the control bytes and slots
+// of every bucket (including the old tables of incremental resizes), the
+// bucket directory, and the buckets other than the one embedded in the Map
+// itself. Memory referenced by the keys and values (e.g.
+// the bytes of a string) is not included.
+func (m *Map[K, V]) MemoryUsage() uintptr {
+	var n uintptr
+	m.buckets(0, func(b *bucket[K, V]) bool {
+		if b.capacity > 0 {
+			n += (b.capacity + groupSize) * unsafe.Sizeof(ctrl(0))
+			n += b.capacity * unsafe.Sizeof(Slot[K, V]{})
+		}
+		if b != &m.bucket0 {
+			n += unsafe.Sizeof(*b)
+		}
+		if ob := b.old; ob != nil {
+			n += (ob.capacity + groupSize) * unsafe.Sizeof(ctrl(0))
+			n += ob.capacity * unsafe.Sizeof(Slot[K, V]{})
+			n += unsafe.Sizeof(*ob)
+		}
+		return true
+	})
+	if m.globalShift != 0 {
+		n += m.bucketCount() * unsafe.Sizeof((*bucket[K, V])(nil))
+	}
+	return n
+}
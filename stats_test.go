@@ -0,0 +1,330 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	testCases := []struct {
+		maxBucketCapacity uintptr
+	}{
+		{math.MaxUint64},
+		{7},
+		{127},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			m := New[int, int](0, WithMaxBucketCapacity[int, int](c.maxBucketCapacity))
+			require.Equal(t, Stats{BucketCount: 1}, m.Stats())
+
+			// check verifies the stats against a scan of the control bytes.
+			check := func() {
+				var expected Stats
+				m.buckets(0, func(b *bucket[int, int]) bool {
+					expected.BucketCount++
+					expected.Capacity += int(b.capacity)
+					expected.GrowthLeft += b.growthLeft
+					for i := uintptr(0); i < b.capacity; i++ {
+						switch b.ctrls.Get(i) {
+						case ctrlDeleted:
+							expected.Tombstones++
+						case ctrlEmpty:
+						default:
+							expected.Len++
+						}
+					}
+					return true
+				})
+				expected.LoadFactor = float64(expected.Len) / float64(expected.Capacity)
+				// The lifetime counters are verified by TestStatsCounters.
+				s := m.Stats()
+				expected.Resizes, expected.Splits = s.Resizes, s.Splits
+				expected.Allocs, expected.Frees = s.Allocs, s.Frees
+				require.Equal(t, expected, s)
+				require.EqualValues(t, s.Capacity, m.Cap())
+			}
+
+			const count = 5000
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+			check()
+
+			// Deleting random keys leaves tombstones behind, except in
+			// buckets which fit in a single group.
+			for i := 0; i < count; i++ {
+				m.Delete(rand.Intn(count))
+			}
+			check()
+			var multiGroup bool
+			m.buckets(0, func(b *bucket[int, int]) bool {
+				multiGroup = multiGroup || b.capacity >= groupSize
+				return true
+			})
+			if multiGroup {
+				require.Greater(t, m.Stats().Tombstones, 0)
+			}
+
+			for i := 0; i < count; i++ {
+				m.Put(rand.Intn(2*count), i)
+				m.Delete(rand.Intn(2 * count))
+			}
+			check()
+
+			m.Clear()
+			check()
+			require.EqualValues(t, 0, m.Stats().Tombstones)
+		})
+	}
+}
+
+func TestStatsCounters(t *testing.T) {
+	testCases := []struct {
+		maxBucketCapacity uintptr
+		incremental       bool
+	}{
+		{math.MaxUint64, false},
+		{math.MaxUint64, true},
+		{7, false},
+		{127, false},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			a := &countingAllocator[int, int]{}
+			options := []option[int, int]{
+				WithAllocator[int, int](a),
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity),
+			}
+			if c.incremental {
+				options = append(options, WithIncrementalResize[int, int]())
+			}
+			m := New[int, int](0, options...)
+
+			// check verifies the allocator counters against the allocator. Every
+			// resize (including the initial allocation of the map's first
+			// table) and split allocates a table. A split which fails to divide
+			// the entries of a bucket falls back to a resize and allocates an
+			// additional table.
+			check := func() {
+				s := m.Stats()
+				require.EqualValues(t, a.alloc, s.Allocs)
+				require.EqualValues(t, a.free, s.Frees)
+				require.GreaterOrEqual(t, s.Allocs, s.Resizes+s.Splits)
+			}
+
+			const count = 5000
+			for i := 0; i < count; i++ {
+				m.Put(i, i)
+			}
+			check()
+			s := m.Stats()
+			require.Greater(t, s.Resizes, 0)
+			if c.maxBucketCapacity == math.MaxUint64 {
+				require.EqualValues(t, 0, s.Splits)
+			} else {
+				require.EqualValues(t, s.BucketCount-1, s.Splits)
+			}
+
+			// The counters are not reset by Clear.
+			m.Clear()
+			require.EqualValues(t, s.Resizes, m.Stats().Resizes)
+			require.EqualValues(t, s.Splits, m.Stats().Splits)
+
+			// Stats cannot be called on a closed map, so check the counters
+			// directly.
+			m.Close()
+			require.EqualValues(t, a.alloc, m.allocs)
+			require.EqualValues(t, a.free, m.frees)
+			require.EqualValues(t, m.allocs, m.frees)
+		})
+	}
+}
+
+func TestBucketStats(t *testing.T) {
+	testCases := []struct {
+		maxBucketCapacity uintptr
+		incremental       bool
+	}{
+		{math.MaxUint64, false},
+		{math.MaxUint64, true},
+		{7, false},
+		{127, false},
+		{127, true},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			options := []option[int, int]{
+				WithMaxBucketCapacity[int, int](c.maxBucketCapacity),
+			}
+			if c.incremental {
+				options = append(options, WithIncrementalResize[int, int]())
+			}
+			m := New[int, int](0, options...)
+
+			check := func() {
+				bs := m.BucketStats()
+				s := m.Stats()
+				require.EqualValues(t, s.BucketCount, len(bs))
+				require.EqualValues(t, s.BucketCount, m.BucketCount())
+
+				// The buckets partition the hash space and the entries.
+				var space float64
+				var total BucketStats
+				for _, b := range bs {
+					space += math.Ldexp(1, -b.LocalDepth)
+					total.Capacity += b.Capacity
+					total.Len += b.Len
+					total.GrowthLeft += b.GrowthLeft
+					require.LessOrEqual(t, b.Len, b.Capacity)
+				}
+				require.Equal(t, 1.0, space)
+				require.EqualValues(t, s.Capacity, total.Capacity)
+				require.EqualValues(t, s.Len, total.Len)
+				require.EqualValues(t, s.GrowthLeft, total.GrowthLeft)
+			}
+
+			check()
+			for i := 0; i < 5000; i++ {
+				m.Put(i, i)
+				if i%97 == 0 {
+					check()
+				}
+			}
+			check()
+			if c.maxBucketCapacity != math.MaxUint64 {
+				require.Greater(t, m.BucketCount(), 1)
+			}
+		})
+	}
+}
+
+func TestProbeStats(t *testing.T) {
+	check := func(t *testing.T, m *Map[int, int]) ProbeStats {
+		s := m.ProbeStats()
+		var sum, total int
+		for i, n := range s.Histogram {
+			sum += n
+			total += (i + 1) * n
+		}
+		require.EqualValues(t, m.Len(), sum)
+		if s.Max < len(s.Histogram) {
+			require.InDelta(t, float64(total)/float64(m.Len()), s.Mean, 1e-9)
+		}
+		return s
+	}
+
+	m := New[int, int](0)
+	require.Equal(t, ProbeStats{}, m.ProbeStats())
+
+	const count = 10000
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+	s := check(t, m)
+	require.GreaterOrEqual(t, s.Mean, 1.0)
+	require.Less(t, s.Mean, 2.0)
+	require.GreaterOrEqual(t, s.Max, 1)
+
+	// A degenerate hash function results in long probe sequences.
+	d := New[int, int](0, WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		return 0
+	}))
+	for i := 0; i < 1000; i++ {
+		d.Put(i, i)
+	}
+	s = check(t, d)
+	require.Greater(t, s.Mean, 8.0)
+	require.GreaterOrEqual(t, s.Max, 1000/groupSize)
+	require.Greater(t, s.Histogram[len(s.Histogram)-1], 0)
+}
+
+func TestDebugProbe(t *testing.T) {
+	var z Map[int, int]
+	require.Nil(t, z.DebugProbe(1))
+
+	m := New[int, int](0)
+	const count = 1000
+	for i := 0; i < count; i++ {
+		m.Put(i, i)
+	}
+	for i := 0; i < count; i++ {
+		offsets := m.DebugProbe(i)
+		require.NotEmpty(t, offsets)
+		// The probe sequence of a present key ends at the group containing
+		// it, and is as long as the probe length used by ProbeStats.
+		b, slot, found := m.find(m.hash(noescape(unsafe.Pointer(&i)), m.seed), i)
+		require.True(t, found)
+		require.EqualValues(t, b.probeLength(m, slot), len(offsets))
+		last := offsets[len(offsets)-1]
+		require.EqualValues(t, 0, (slot-last)&b.capacity/groupSize)
+	}
+	require.NotEmpty(t, m.DebugProbe(-1))
+
+	// With a degenerate hash function every key has the same probe sequence
+	// and the walk grows with the number of colliding keys.
+	d := New[int, int](0, WithHash[int, int](func(key *int, seed uintptr) uintptr {
+		return 0
+	}), WithMaxBucketCapacity[int, int](math.MaxUint64))
+	for i := 0; i < count; i++ {
+		d.Put(i, i)
+	}
+	last := d.DebugProbe(count - 1)
+	require.GreaterOrEqual(t, len(last), count/groupSize)
+	require.Equal(t, last[:len(d.DebugProbe(0))], d.DebugProbe(0))
+	require.GreaterOrEqual(t, len(d.DebugProbe(-1)), len(last))
+}
+
+func TestMemoryUsage(t *testing.T) {
+	testCases := []struct {
+		maxBucketCapacity uintptr
+		epsilon           float64
+	}{
+		{math.MaxUint64, 0.1},
+		{7, 0.75},
+		{127, 0.1},
+	}
+	for _, c := range testCases {
+		t.Run("", func(t *testing.T) {
+			m := New[int, [4]int](0, WithMaxBucketCapacity[int, [4]int](c.maxBucketCapacity))
+			require.EqualValues(t, 0, m.MemoryUsage())
+
+			slotSize := unsafe.Sizeof(Slot[int, [4]int]{})
+			for i := 0; i < 10000; i++ {
+				m.Put(i, [4]int{i})
+
+				// The slots dominate the memory usage. The control bytes, bucket
+				// structs, and directory add overhead which is significant only
+				// for small buckets.
+				expected := float64(uintptr(m.Cap()) * slotSize)
+				require.InEpsilon(t, expected, float64(m.MemoryUsage()), c.epsilon)
+				require.Greater(t, float64(m.MemoryUsage()), expected)
+			}
+
+			// Clearing the map retains its capacity.
+			usage := m.MemoryUsage()
+			m.Clear()
+			require.EqualValues(t, usage, m.MemoryUsage())
+			m.ClearAndShrink()
+			require.EqualValues(t, 0, m.MemoryUsage())
+		})
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// SyncMap is a Map which is safe for concurrent use by multiple goroutines.
+// Reads are performed under a read lock and mutations under a write lock, so
+// concurrent readers do not block one another. A Map should be preferred when
+// it is only accessed by a single goroutine at a time.
+type SyncMap[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  Map[K, V]
+	// len mirrors m.Len() so that it can be read without holding mu. It is
+	// updated under mu after every mutation of m.
+	len atomic.Int64
+}
+
+// NewSyncMap constructs a new SyncMap with the specified initial capacity and
+// options. See New for details.
+func NewSyncMap[K comparable, V any](initialCapacity int, options ...option[K, V]) *SyncMap[K, V] {
+	s := &SyncMap[K, V]{}
+	s.m.Init(initialCapacity, options...)
+	return s
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// ok=false if the key is not present.
+func (s *SyncMap[K, V]) Get(key K) (value V, ok bool) {
+	s.mu.RLock()
+	value, ok = s.m.Get(key)
+	s.mu.RUnlock()
+	return value, ok
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists.
+func (s *SyncMap[K, V]) Put(key K, value V) {
+	s.mu.Lock()
+	s.m.Put(key, value)
+	s.len.Store(int64(s.m.Len()))
+	s.mu.Unlock()
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (s *SyncMap[K, V]) Delete(key K) {
+	s.mu.Lock()
+	s.m.Delete(key)
+	s.len.Store(int64(s.m.Len()))
+	s.mu.Unlock()
+}
+
+// Len returns the number of entries in the map.
+func (s *SyncMap[K, V]) Len() int {
+	s.mu.RLock()
+	n := s.m.Len()
+	s.mu.RUnlock()
+	return n
+}
+
+// ApproxLen returns the number of entries in the map without acquiring the
+// lock, making it suitable for frequent polling such as by a metrics
+// exporter. The length is read as of the most recently completed mutation,
+// so a mutation which is in progress is not reflected.
+func (s *SyncMap[K, V]) ApproxLen() int {
+	return int(s.len.Load())
+}
+
+// All calls yield sequentially for each key and value present in the map. If
+// yield returns false, range stops the iteration. The entries are copied
+// under the read lock and yield is called without the lock held, so yield
+// may access the map, but the iteration reflects the map at the time All was
+// called rather than any subsequent mutations.
+func (s *SyncMap[K, V]) All(yield func(key K, value V) bool) {
+	s.mu.RLock()
+	entries := make([]Slot[K, V], 0, s.m.Len())
+	s.m.All(func(key K, value V) bool {
+		entries = append(entries, Slot[K, V]{key: key, value: value})
+		return true
+	})
+	s.mu.RUnlock()
+
+	for i := range entries {
+		if !yield(entries[i].key, entries[i].value) {
+			return
+		}
+	}
+}
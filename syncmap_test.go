@@ -0,0 +1,117 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package swiss
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// concurrentMap is the interface implemented by the goroutine-safe maps.
+type concurrentMap interface {
+	Get(key int) (value int, ok bool)
+	Put(key int, value int)
+	Delete(key int)
+	Len() int
+	ApproxLen() int
+	All(yield func(key int, value int) bool)
+}
+
+func TestConcurrentMaps(t *testing.T) {
+	testCases := []struct {
+		name string
+		new  func() concurrentMap
+	}{
+		{"SyncMap", func() concurrentMap { return NewSyncMap[int, int](0) }},
+		{"ShardedMap", func() concurrentMap {
+			return NewShardedMap[int, int](0, WithShards[int, int](4))
+		}},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			testConcurrentMap(t, c.new())
+		})
+	}
+}
+
+func testConcurrentMap(t *testing.T, s concurrentMap) {
+	const goroutines = 8
+	const count = 1000
+
+	// Failures in the goroutines are reported with t.Errorf, as require must
+	// only be used on the test goroutine.
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				k := g*count + i
+				s.Put(k, k)
+				if v, ok := s.Get(k); !ok || v != k {
+					t.Errorf("Get(%d) = %d, %t; expected %d, true", k, v, ok, k)
+					return
+				}
+				if i%2 == 0 {
+					s.Delete(k)
+				}
+				s.Len()
+				if n := s.ApproxLen(); n > goroutines*count {
+					t.Errorf("ApproxLen() = %d; expected at most %d", n, goroutines*count)
+					return
+				}
+			}
+		}(g)
+	}
+
+	// Iterate concurrently with the mutations.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			s.All(func(k, v int) bool {
+				if k != v {
+					t.Errorf("All yielded %d, %d; expected equal key and value", k, v)
+					return false
+				}
+				return true
+			})
+		}
+	}()
+	wg.Wait()
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	require.EqualValues(t, goroutines*count/2, s.Len())
+	require.EqualValues(t, goroutines*count/2, s.ApproxLen())
+	for k := 0; k < goroutines*count; k++ {
+		_, ok := s.Get(k)
+		require.Equal(t, k%2 == 1, ok)
+	}
+
+	// The map may be mutated from within the All callback.
+	n := 0
+	s.All(func(k, v int) bool {
+		s.Delete(k)
+		n++
+		return true
+	})
+	require.EqualValues(t, goroutines*count/2, n)
+	require.EqualValues(t, 0, s.Len())
+	require.EqualValues(t, 0, s.ApproxLen())
+}
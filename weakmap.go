@@ -0,0 +1,107 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package swiss
+
+import "weak"
+
+// WeakMap is a map from keys to pointers which does not keep the pointed-to
+// values alive: the values are held through weak pointers (see the weak
+// package), so a value which is not referenced from elsewhere may be garbage
+// collected while it is in the map. This makes WeakMap suitable for caches of
+// large values which should not prevent the values from being reclaimed.
+//
+// The entry of a value which has been collected is dead. Get reports a dead
+// entry as absent and deletes it, and All skips dead entries. Dead entries
+// which are not looked up remain in the map, and are counted by Len, until
+// they are removed by Purge. WeakMap requires Go 1.24 or later.
+//
+// A WeakMap is NOT goroutine-safe. Note that Get deletes dead entries and is
+// therefore a mutation.
+type WeakMap[K comparable, T any] struct {
+	m Map[K, weak.Pointer[T]]
+}
+
+// NewWeakMap constructs a new WeakMap with the specified initial capacity and
+// options. See New for details.
+func NewWeakMap[K comparable, T any](
+	initialCapacity int, options ...option[K, weak.Pointer[T]],
+) *WeakMap[K, T] {
+	w := &WeakMap[K, T]{}
+	w.m.Init(initialCapacity, options...)
+	return w
+}
+
+// Get retrieves the value from the map for the specified key, returning
+// (nil, false) if the key is not present or its value has been collected. In
+// the latter case the dead entry is deleted.
+func (w *WeakMap[K, T]) Get(key K) (value *T, ok bool) {
+	p, ok := w.m.Get(key)
+	if !ok {
+		return nil, false
+	}
+	if value = p.Value(); value == nil {
+		w.m.Delete(key)
+		return nil, false
+	}
+	return value, true
+}
+
+// Put inserts an entry into the map, overwriting an existing value if an
+// entry with the same key already exists. The map does not keep value alive.
+// Putting a nil value is equivalent to deleting the key.
+func (w *WeakMap[K, T]) Put(key K, value *T) {
+	if value == nil {
+		w.m.Delete(key)
+		return
+	}
+	w.m.Put(key, weak.Make(value))
+}
+
+// Delete deletes the entry corresponding to the specified key from the map.
+// It is a noop to delete a non-existent key.
+func (w *WeakMap[K, T]) Delete(key K) {
+	w.m.Delete(key)
+}
+
+// Purge deletes all dead entries from the map, returning the number of
+// entries deleted.
+func (w *WeakMap[K, T]) Purge() int {
+	n := w.m.Len()
+	w.m.DeleteFunc(func(_ K, p weak.Pointer[T]) bool {
+		return p.Value() == nil
+	})
+	return n - w.m.Len()
+}
+
+// Len returns the number of entries in the map, including dead entries which
+// have not yet been deleted.
+func (w *WeakMap[K, T]) Len() int {
+	return w.m.Len()
+}
+
+// All calls yield sequentially for each key and live value present in the
+// map. If yield returns false, iteration stops. Values which are returned to
+// yield are kept alive for the duration of the call. See Map.All for the
+// semantics of mutating the map during iteration.
+func (w *WeakMap[K, T]) All(yield func(key K, value *T) bool) {
+	w.m.All(func(key K, p weak.Pointer[T]) bool {
+		if value := p.Value(); value != nil {
+			return yield(key, value)
+		}
+		return true
+	})
+}
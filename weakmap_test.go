@@ -0,0 +1,75 @@
+// Copyright 2024 The Cockroach Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.24
+
+package swiss
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeakMap(t *testing.T) {
+	type big [1 << 10]byte
+	const count = 100
+
+	w := NewWeakMap[int, big](0)
+	// Keep the values of the even keys alive.
+	live := make([]*big, count)
+	func() {
+		for i := 0; i < count; i++ {
+			v := new(big)
+			v[0] = byte(i)
+			w.Put(i, v)
+			if i%2 == 0 {
+				live[i] = v
+			}
+		}
+	}()
+	require.EqualValues(t, count, w.Len())
+	runtime.GC()
+
+	// The values of the odd keys have been collected. Their entries are
+	// skipped by All.
+	var n int
+	w.All(func(k int, v *big) bool {
+		require.EqualValues(t, 0, k%2)
+		require.EqualValues(t, k, v[0])
+		n++
+		return true
+	})
+	require.EqualValues(t, count/2, n)
+
+	// Get deletes a dead entry, and Purge deletes the rest.
+	_, ok := w.Get(1)
+	require.False(t, ok)
+	require.EqualValues(t, count-1, w.Len())
+	require.EqualValues(t, count/2-1, w.Purge())
+	require.EqualValues(t, count/2, w.Len())
+	for i := 0; i < count; i += 2 {
+		v, ok := w.Get(i)
+		require.True(t, ok)
+		require.Same(t, live[i], v)
+	}
+
+	w.Put(0, nil)
+	_, ok = w.Get(0)
+	require.False(t, ok)
+	w.Delete(2)
+	require.EqualValues(t, count/2-2, w.Len())
+	runtime.KeepAlive(live)
+}